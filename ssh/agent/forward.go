@@ -5,6 +5,7 @@
 package agent
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"net"
@@ -101,3 +102,35 @@ func forwardUnixSocket(channel ssh.Channel, addr string) {
 	conn.Close()
 	channel.Close()
 }
+
+// UpstreamAuth returns a function suited for ssh.Upstream.DownstreamAgentAuth.
+// It authenticates with the keys held by the agent forwarded by the
+// downstream. If keys are given, only the matching keys of the agent are used.
+func UpstreamAuth(keys ...ssh.PublicKey) func(agent io.ReadWriter) ([]ssh.AuthMethod, error) {
+	return func(agent io.ReadWriter) ([]ssh.AuthMethod, error) {
+		signers, err := NewClient(agent).Signers()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(keys) > 0 {
+			var matched []ssh.Signer
+			for _, signer := range signers {
+				pub := signer.PublicKey().Marshal()
+				for _, key := range keys {
+					if bytes.Equal(pub, key.Marshal()) {
+						matched = append(matched, signer)
+						break
+					}
+				}
+			}
+			signers = matched
+		}
+
+		if len(signers) == 0 {
+			return nil, errors.New("agent: no matching keys in the downstream agent")
+		}
+
+		return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, nil
+	}
+}
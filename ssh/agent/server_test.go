@@ -5,10 +5,14 @@
 package agent
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	pseudorand "math/rand"
+	"net"
 	"reflect"
 	"strings"
 	"testing"
@@ -264,3 +268,240 @@ func TestParseConstraints(t *testing.T) {
 		t.Errorf("unexpected error: %v", err)
 	}
 }
+
+// writeNotifyConn signals writes, without blocking, on a channel.
+type writeNotifyConn struct {
+	net.Conn
+	writes chan struct{}
+}
+
+func (c *writeNotifyConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	select {
+	case c.writes <- struct{}{}:
+	default:
+	}
+	return n, err
+}
+
+func TestUpstreamAuthViaPiper(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		key     ssh.PublicKey
+		x11     bool
+		forward bool
+		ok      bool
+	}{
+		{"matching", testPublicKeys["rsa"], false, true, true},
+		{"after x11", testPublicKeys["rsa"], true, true, true},
+		{"missing", testPublicKeys["ed25519"], false, true, false},
+		{"not requested", testPublicKeys["rsa"], false, false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testUpstreamAuthViaPiper(t, tt.key, tt.x11, tt.forward, tt.ok)
+		})
+	}
+}
+
+func testUpstreamAuthViaPiper(t *testing.T, key ssh.PublicKey, x11, forward, ok bool) {
+	upstreamKeys := make(chan ssh.PublicKey, 1)
+	upstreamConf := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), testPublicKeys["rsa"].Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			upstreamKeys <- key
+			return nil, nil
+		},
+	}
+	upstreamConf.AddHostKey(testSigners["rsa"])
+
+	piperConf := &ssh.PiperConfig{
+		NoClientAuthCallback: func(conn ssh.ConnMetadata, challengeCtx ssh.ChallengeContext) (*ssh.Upstream, error) {
+			c, s, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+
+			// an echoing shell, also accepting agent forwarding
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(s, upstreamConf)
+				if err != nil {
+					s.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newCh := range chans {
+					ch, reqs, err := newCh.Accept()
+					if err != nil {
+						continue
+					}
+					go func() {
+						for req := range reqs {
+							req.Reply(req.Type == "auth-agent-req@openssh.com" || req.Type == "shell", nil)
+						}
+					}()
+					go func() {
+						io.Copy(ch, ch)
+						ch.Close()
+					}()
+				}
+			}()
+
+			return &ssh.Upstream{
+				Conn: c,
+				ClientConfig: ssh.ClientConfig{
+					HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+				},
+				DownstreamAgentAuth: UpstreamAuth(key),
+			}, nil
+		},
+	}
+	piperConf.AddHostKey(testSigners["ecdsa"])
+
+	a, b, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer a.Close()
+	defer b.Close()
+
+	piped := make(chan error, 1)
+	go func() {
+		p, err := ssh.NewSSHPiperConn(a, piperConf)
+		if err != nil {
+			piped <- err
+			return
+		}
+		defer p.Close()
+		piped <- nil
+		p.Wait()
+	}()
+
+	keyring := NewKeyring()
+	if err := keyring.Add(AddedKey{PrivateKey: testPrivateKeys["rsa"]}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := keyring.Add(AddedKey{PrivateKey: testPrivateKeys["ecdsa"]}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	// writes tells when the x11-req is sent, see below
+	writes := make(chan struct{}, 1)
+	conn, chans, reqs, err := ssh.NewClientConn(&writeNotifyConn{b, writes}, "", &ssh.ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	agentOpened := make(chan bool, 1)
+	go func() {
+		for ch := range chans {
+			if ch.ChannelType() != channelType {
+				ch.Reject(ssh.UnknownChannelType, "")
+				continue
+			}
+			agentOpened <- true
+			channel, reqs, err := ch.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				ServeAgent(keyring, channel)
+				channel.Close()
+			}()
+		}
+	}()
+
+	// confirmed by the piper, the session is handed over to the upstream
+	// once piping starts
+	session, err := ssh.NewClient(conn, nil, nil).NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe: %v", err)
+	}
+
+	// like OpenSSH, x11-req is sent before auth-agent-req, which does not
+	// wait for its reply: the upstream gives it once piped
+	x11Reply := make(chan error, 1)
+	if x11 {
+		select {
+		case <-writes:
+		default:
+		}
+		go func() {
+			ok, err := session.SendRequest("x11-req", true, ssh.Marshal(struct {
+				SingleConnection bool
+				AuthProtocol     string
+				AuthCookie       string
+				ScreenNumber     uint32
+			}{false, "MIT-MAGIC-COOKIE-1", "00", 0}))
+			if err == nil && ok {
+				err = errors.New("x11-req accepted, want rejected by the upstream")
+			}
+			x11Reply <- err
+		}()
+		<-writes
+	}
+
+	switch {
+	case x11:
+		_, err = session.SendRequest("auth-agent-req@openssh.com", false, nil)
+	case forward:
+		err = RequestAgentForwarding(session)
+	default:
+		err = session.Shell()
+	}
+
+	pipeErr := <-piped
+	if !ok {
+		if pipeErr == nil {
+			t.Fatal("NewSSHPiperConn succeeded, want error")
+		}
+		if err == nil {
+			t.Fatal("request succeeded after upstream auth failure")
+		}
+		if !forward && len(agentOpened) > 0 {
+			t.Fatal("agent channel opened without forwarding requested")
+		}
+		return
+	}
+
+	if pipeErr != nil {
+		t.Fatalf("NewSSHPiperConn: %v", pipeErr)
+	}
+	if err != nil {
+		t.Fatalf("RequestAgentForwarding: %v", err)
+	}
+	if got := <-upstreamKeys; !bytes.Equal(got.Marshal(), key.Marshal()) {
+		t.Fatalf("upstream got key %s, want %s", got.Type(), key.Type())
+	}
+	if x11 {
+		if err := <-x11Reply; err != nil {
+			t.Fatalf("x11-req: %v", err)
+		}
+	}
+
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell: %v", err)
+	}
+	if _, err := stdin.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(stdout, got); err != nil || string(got) != "hello" {
+		t.Fatalf("got %q, %v through the session, want hello", got, err)
+	}
+}
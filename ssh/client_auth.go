@@ -777,3 +777,77 @@ func (g *gssAPIWithMICCallback) auth(session []byte, user string, c packetConn,
 func (g *gssAPIWithMICCallback) method() string {
 	return "gssapi-with-mic"
 }
+
+type hostbasedAuthMsg struct {
+	User       string `sshtype:"50"`
+	Service    string
+	Method     string
+	Algoname   string
+	HostKey    []byte
+	ClientHost string
+	ClientUser string
+	// Sig is tagged with "rest" so Marshal will exclude it when empty.
+	Sig []byte `ssh:"rest"`
+}
+
+// hostbasedAuth is an AuthMethod authenticating with the host key of the
+// client host.
+type hostbasedAuth struct {
+	signer     Signer
+	clientHost string
+	localUser  string
+}
+
+func (h *hostbasedAuth) method() string {
+	return "hostbased"
+}
+
+func (h *hostbasedAuth) auth(session []byte, user string, c packetConn, rand io.Reader, extensions map[string][]byte) (authResult, []string, error) {
+	as, algo, err := pickSignatureAlgorithm(h.signer, extensions)
+	if err != nil {
+		return authFailure, nil, err
+	}
+
+	hostKey := h.signer.PublicKey().Marshal()
+	data := buildDataSignedForHostbased(session, userAuthRequestMsg{
+		User:    user,
+		Service: serviceSSH,
+		Method:  h.method(),
+	}, algo, hostKey, h.clientHost, h.localUser)
+	sign, err := as.SignWithAlgorithm(rand, data, underlyingAlgo(algo))
+	if err != nil {
+		return authFailure, nil, err
+	}
+
+	// manually wrap the serialized signature in a string
+	s := Marshal(sign)
+	sig := make([]byte, stringLength(len(s)))
+	marshalString(sig, s)
+	msg := hostbasedAuthMsg{
+		User:       user,
+		Service:    serviceSSH,
+		Method:     h.method(),
+		Algoname:   algo,
+		HostKey:    hostKey,
+		ClientHost: h.clientHost,
+		ClientUser: h.localUser,
+		Sig:        sig,
+	}
+	if err := c.writePacket(Marshal(&msg)); err != nil {
+		return authFailure, nil, err
+	}
+
+	return handleAuthResponse(c)
+}
+
+// Hostbased returns an AuthMethod with "hostbased" authentication, see RFC
+// 4252 section 9. hostSigner holds the host key of the client host, which
+// the server must trust, clientHost is the fully qualified name of the
+// client host, and localUser the name of the user on the client host.
+func Hostbased(hostSigner Signer, clientHost, localUser string) AuthMethod {
+	return &hostbasedAuth{
+		signer:     hostSigner,
+		clientHost: clientHost,
+		localUser:  localUser,
+	}
+}
@@ -1282,3 +1282,53 @@ func TestCertAuthOpenSSHCompat(t *testing.T) {
 		t.Fatalf("unable to dial remote side: %s", err)
 	}
 }
+
+func TestAuthMethodHostbased(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		hostKey    Signer
+		clientHost string
+		wantErr    bool
+	}{
+		{"trusted host", testSigners["ecdsa"], "node1.example.com.", false},
+		{"rsa host key", testSigners["rsa"], "node2.example.com.", false},
+		{"untrusted host key", testSigners["ed25519"], "node1.example.com.", true},
+		{"other host", testSigners["ecdsa"], "node2.example.com.", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2, err := netPipe()
+			if err != nil {
+				t.Fatalf("netPipe: %v", err)
+			}
+			defer c1.Close()
+			defer c2.Close()
+
+			trusted := map[string]PublicKey{
+				"node1.example.com.": testPublicKeys["ecdsa"],
+				"node2.example.com.": testPublicKeys["rsa"],
+			}
+			serverConfig := &ServerConfig{
+				HostbasedCallback: func(conn ConnMetadata, clientHost, clientUser string, key PublicKey) (*Permissions, error) {
+					if clientUser != "localuser" {
+						t.Errorf("got client user %q, want localuser", clientUser)
+					}
+					if k, ok := trusted[clientHost]; !ok || !bytes.Equal(k.Marshal(), key.Marshal()) {
+						return nil, fmt.Errorf("host key of %s not trusted", clientHost)
+					}
+					return nil, nil
+				},
+			}
+			serverConfig.AddHostKey(testSigners["rsa"])
+			go newServer(c2, serverConfig)
+
+			_, _, _, err = NewClientConn(c1, "", &ClientConfig{
+				User:            "testuser",
+				Auth:            []AuthMethod{Hostbased(tt.hostKey, tt.clientHost, "localuser")},
+				HostKeyCallback: InsecureIgnoreHostKey(),
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
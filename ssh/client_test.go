@@ -12,6 +12,7 @@ import (
 	"net"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestClientVersion(t *testing.T) {
@@ -365,3 +366,77 @@ func TestUnsupportedAlgorithm(t *testing.T) {
 		})
 	}
 }
+
+func TestConnAlgorithms(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+	}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+
+	serverConns := make(chan *ServerConn, 1)
+	go func() {
+		conn, _, reqs, err := NewServerConn(c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			close(serverConns)
+			return
+		}
+		go DiscardRequests(reqs)
+		serverConns <- conn
+	}()
+
+	clientConn, _, reqs, err := NewClientConn(c2, "", &ClientConfig{
+		Config: Config{
+			KeyExchanges: []string{kexAlgoCurve25519SHA256},
+			Ciphers:      []string{"aes128-ctr"},
+			MACs:         []string{"hmac-sha2-256"},
+		},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer clientConn.Close()
+	go DiscardRequests(reqs)
+
+	serverConn := <-serverConns
+	if serverConn == nil {
+		t.FailNow()
+	}
+
+	want := NegotiatedAlgorithms{
+		KeyExchange: kexAlgoCurve25519SHA256,
+		HostKey:     KeyAlgoECDSA256,
+		Read:        DirectionAlgorithms{Cipher: "aes128-ctr", MAC: "hmac-sha2-256", Compression: compressionNone},
+		Write:       DirectionAlgorithms{Cipher: "aes128-ctr", MAC: "hmac-sha2-256", Compression: compressionNone},
+	}
+	clientAlgs := clientConn.(AlgorithmsConnMetadata)
+	serverAlgs := serverConn.Conn.(AlgorithmsConnMetadata)
+	if got := clientAlgs.Algorithms(); got != want {
+		t.Fatalf("got client algorithms %+v, want %+v", got, want)
+	}
+	if got := serverAlgs.Algorithms(); got != want {
+		t.Fatalf("got server algorithms %+v, want %+v", got, want)
+	}
+
+	// the config is only read again to start the rekey
+	tr := clientConn.(*connection).transport
+	tr.config.Ciphers = []string{"aes256-ctr"}
+	tr.requestKeyExchange()
+
+	want.Read.Cipher, want.Write.Cipher = "aes256-ctr", "aes256-ctr"
+	for deadline := time.Now().Add(5 * time.Second); clientAlgs.Algorithms() != want || serverAlgs.Algorithms() != want; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got client algorithms %+v and server algorithms %+v after rekey, want %+v",
+				clientAlgs.Algorithms(), serverAlgs.Algorithms(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
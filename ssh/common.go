@@ -169,15 +169,15 @@ func findCommon(what string, client []string, server []string) (common string, e
 	return "", fmt.Errorf("ssh: no common algorithm for %s; client offered: %v, server offered: %v", what, client, server)
 }
 
-// directionAlgorithms records algorithm choices in one direction (either read or write)
-type directionAlgorithms struct {
+// DirectionAlgorithms records algorithm choices in one direction (either read or write).
+type DirectionAlgorithms struct {
 	Cipher      string
 	MAC         string
 	Compression string
 }
 
 // rekeyBytes returns a rekeying intervals in bytes.
-func (a *directionAlgorithms) rekeyBytes() int64 {
+func (a *DirectionAlgorithms) rekeyBytes() int64 {
 	// According to RFC 4344 block ciphers should rekey after
 	// 2^(BLOCKSIZE/4) blocks. For all AES flavors BLOCKSIZE is
 	// 128.
@@ -200,8 +200,28 @@ var aeadCiphers = map[string]bool{
 type algorithms struct {
 	kex     string
 	hostKey string
-	w       directionAlgorithms
-	r       directionAlgorithms
+	w       DirectionAlgorithms
+	r       DirectionAlgorithms
+}
+
+// NegotiatedAlgorithms holds the algorithms agreed in a key exchange.
+type NegotiatedAlgorithms struct {
+	KeyExchange string
+	HostKey     string
+
+	// Read and Write are the algorithms of the packets received and sent
+	// by the local side.
+	Read  DirectionAlgorithms
+	Write DirectionAlgorithms
+}
+
+func (a *algorithms) negotiated() NegotiatedAlgorithms {
+	return NegotiatedAlgorithms{
+		KeyExchange: a.kex,
+		HostKey:     a.hostKey,
+		Read:        a.r,
+		Write:       a.w,
+	}
 }
 
 func findAgreedAlgorithms(isClient bool, clientKexInit, serverKexInit *kexInitMsg) (algs *algorithms, err error) {
@@ -287,6 +307,9 @@ type Config struct {
 	// The allowed MAC algorithms. If unspecified then a sensible default is
 	// used. Unsupported values are silently ignored.
 	MACs []string
+
+	// kexCallback, if non-nil, is called after each completed key exchange.
+	kexCallback func(algs NegotiatedAlgorithms, first bool)
 }
 
 // SetDefaults sets sensible values for unset fields in config. This is
@@ -368,6 +391,34 @@ func buildDataSignedForAuth(sessionID []byte, req userAuthRequestMsg, algo strin
 	return Marshal(data)
 }
 
+// buildDataSignedForHostbased returns the data that is signed in order to
+// prove the possession of the host key of the client host, see RFC 4252
+// section 9.
+func buildDataSignedForHostbased(sessionID []byte, req userAuthRequestMsg, algo string, hostKey []byte, clientHost, clientUser string) []byte {
+	data := struct {
+		Session    []byte
+		Type       byte
+		User       string
+		Service    string
+		Method     string
+		Algo       string
+		HostKey    []byte
+		ClientHost string
+		ClientUser string
+	}{
+		sessionID,
+		msgUserAuthRequest,
+		req.User,
+		req.Service,
+		req.Method,
+		algo,
+		hostKey,
+		clientHost,
+		clientUser,
+	}
+	return Marshal(data)
+}
+
 func appendU16(buf []byte, n uint16) []byte {
 	return append(buf, byte(n>>8), byte(n))
 }
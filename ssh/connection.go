@@ -43,6 +43,17 @@ type ConnMetadata interface {
 	LocalAddr() net.Addr
 }
 
+// AlgorithmsConnMetadata is a ConnMetadata that can return the algorithms
+// negotiated for the connection. The ConnMetadata of this package implement
+// it.
+type AlgorithmsConnMetadata interface {
+	ConnMetadata
+
+	// Algorithms returns the algorithms negotiated in the last key
+	// exchange. They change when the connection is rekeyed.
+	Algorithms() NegotiatedAlgorithms
+}
+
 // Conn represents an SSH connection for both server and client roles.
 // Conn is the basis for implementing an application layer, such
 // as ClientConn, which implements the traditional shell access for
@@ -97,6 +108,13 @@ func (c *connection) Close() error {
 	return c.sshConn.conn.Close()
 }
 
+func (c *connection) Algorithms() NegotiatedAlgorithms {
+	if c.transport == nil {
+		return NegotiatedAlgorithms{}
+	}
+	return c.transport.negotiatedAlgorithms()
+}
+
 // sshConn provides net.Conn metadata, but disallows direct reads and
 // writes.
 type sshConn struct {
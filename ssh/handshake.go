@@ -13,6 +13,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // debugHandshake, if set, prints messages sent and received.  Key
@@ -104,6 +105,9 @@ type handshakeTransport struct {
 	// Algorithms agreed in the last key exchange.
 	algorithms *algorithms
 
+	// negotiated is a copy of algorithms, safe to read from any goroutine.
+	negotiated atomic.Pointer[NegotiatedAlgorithms]
+
 	// Counters exclusively owned by readLoop.
 	readPacketsLeft uint32
 	readBytesLeft   int64
@@ -170,6 +174,15 @@ func (t *handshakeTransport) getSessionID() []byte {
 	return t.sessionID
 }
 
+// negotiatedAlgorithms returns the algorithms agreed in the last key
+// exchange, or zero if the first one did not complete yet.
+func (t *handshakeTransport) negotiatedAlgorithms() NegotiatedAlgorithms {
+	if algs := t.negotiated.Load(); algs != nil {
+		return *algs
+	}
+	return NegotiatedAlgorithms{}
+}
+
 // waitSession waits for the session to be established. This should be
 // the first thing to call after instantiating handshakeTransport.
 func (t *handshakeTransport) waitSession() error {
@@ -727,6 +740,13 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 		t.conn.setInitialKEXDone()
 	}
 
+	negotiated := t.algorithms.negotiated()
+	t.negotiated.Store(&negotiated)
+
+	if t.config.kexCallback != nil {
+		t.config.kexCallback(negotiated, firstKeyExchange)
+	}
+
 	return nil
 }
 
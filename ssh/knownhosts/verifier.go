@@ -0,0 +1,129 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package knownhosts
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Verifier checks the host keys of upstreams against a known_hosts database,
+// accepting the host certificates signed by its @cert-authority keys and
+// rejecting its @revoked keys. Unlike New, the principals expected in the
+// certificates are set per upstream, and keys may be revoked while the
+// Verifier is in use.
+type Verifier struct {
+	mu sync.RWMutex
+	db *hostKeyDB
+}
+
+// NewVerifier returns a Verifier reading the given OpenSSH host key files.
+func NewVerifier(files ...string) (*Verifier, error) {
+	v := &Verifier{db: newHostKeyDB()}
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+
+		err = v.Read(f, fn)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// Read adds the lines of a known_hosts file to the database. filename is only
+// used in errors.
+func (v *Verifier) Read(r io.Reader, filename string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.db.Read(r, filename)
+}
+
+// Revoke rejects key from now on: a host key, a host certificate, the key it
+// certifies or the authority signing it.
+func (v *Verifier) Revoke(key ssh.PublicKey) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.db.revoked[string(key.Marshal())] = &KnownKey{Key: key}
+}
+
+// revoked returns the entry revoking key, or the certified key or the
+// authority of a certificate.
+func (v *Verifier) revoked(key ssh.PublicKey) *KnownKey {
+	keys := []ssh.PublicKey{key}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		keys = append(keys, cert.Key, cert.SignatureKey)
+	}
+
+	for _, k := range keys {
+		if revoked := v.db.revoked[string(k.Marshal())]; revoked != nil {
+			return revoked
+		}
+	}
+	return nil
+}
+
+// HostKeyCallback returns a callback for the ssh.ClientConfig of an
+// upstream. Host certificates must be valid for one of principals, or, if
+// none is given, for the hostname of the upstream, as with OpenSSH. Plain
+// host keys, and certificates signed by no authority of the hostname, are
+// checked as known_hosts entries.
+func (v *Verifier) HostKeyCallback(principals ...string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+
+		if revoked := v.revoked(key); revoked != nil {
+			return &RevokedError{Revoked: *revoked}
+		}
+
+		cert, ok := key.(*ssh.Certificate)
+		if !ok {
+			return v.db.check(hostname, remote, key)
+		}
+
+		if cert.CertType != ssh.HostCert {
+			return fmt.Errorf("knownhosts: certificate presented as a host key has type %d", cert.CertType)
+		}
+
+		if !v.db.IsHostAuthority(cert.SignatureKey, hostname) {
+			// no matching authority, retry with the plain key like OpenSSH
+			return v.db.check(hostname, remote, cert.Key)
+		}
+
+		expected := principals
+		if len(expected) == 0 {
+			host, _, err := net.SplitHostPort(hostname)
+			if err != nil {
+				return err
+			}
+			expected = []string{host}
+		}
+
+		checker := ssh.CertChecker{
+			IsRevoked: func(cert *ssh.Certificate) bool {
+				return v.revoked(cert) != nil
+			},
+		}
+
+		var err error
+		for _, principal := range expected {
+			if err = checker.CheckCert(principal, cert); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package knownhosts
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newHostCert(t *testing.T, ca ssh.Signer, serial uint64, principals ...string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             newTestSigner(t).PublicKey(),
+		Serial:          serial,
+		CertType:        ssh.HostCert,
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestVerifier(t *testing.T) {
+	ca := newTestSigner(t)
+	otherCA := newTestSigner(t)
+
+	v := &Verifier{db: newHostKeyDB()}
+	db := Line([]string{"plain.example.com"}, edKey) + "\n" +
+		"@cert-authority *.example.com " + string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+	if err := v.Read(strings.NewReader(db), "testdb"); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	web := newHostCert(t, ca, 1, "web.example.com", "web-01")
+	if err := v.HostKeyCallback()("web.example.com:22", testAddr, web); err != nil {
+		t.Errorf("certificate valid for the hostname: %v", err)
+	}
+	if err := v.HostKeyCallback("web-01")("web.example.com:22", testAddr, web); err != nil {
+		t.Errorf("certificate valid for the expected principal: %v", err)
+	}
+	if err := v.HostKeyCallback("db-01")("web.example.com:22", testAddr, web); err == nil {
+		t.Error("accepted a certificate without the expected principal")
+	}
+	if err := v.HostKeyCallback()("web.other.com:22", testAddr, web); err == nil {
+		t.Error("accepted a certificate for a host out of the authority")
+	}
+
+	// no authority, the plain key of the certificate is unknown
+	if err := v.HostKeyCallback()("web.example.com:22", testAddr, newHostCert(t, otherCA, 2, "web.example.com")); err == nil {
+		t.Error("accepted a certificate of an unknown authority")
+	}
+
+	if err := v.HostKeyCallback()("plain.example.com:22", testAddr, edKey); err != nil {
+		t.Errorf("known plain key: %v", err)
+	}
+
+	var revokedErr *RevokedError
+	v.Revoke(edKey)
+	if err := v.HostKeyCallback()("plain.example.com:22", testAddr, edKey); !errors.As(err, &revokedErr) {
+		t.Errorf("revoked plain key: got %v, want a *RevokedError", err)
+	}
+
+	v.Revoke(web)
+	if err := v.HostKeyCallback("web-01")("web.example.com:22", testAddr, web); !errors.As(err, &revokedErr) {
+		t.Errorf("revoked certificate: got %v, want a *RevokedError", err)
+	}
+
+	v.Revoke(ca.PublicKey())
+	if err := v.HostKeyCallback()("db.example.com:22", testAddr, newHostCert(t, ca, 3, "db.example.com")); !errors.As(err, &revokedErr) {
+		t.Errorf("certificate of a revoked authority: got %v, want a *RevokedError", err)
+	}
+}
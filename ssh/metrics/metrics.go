@@ -0,0 +1,265 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+// Package metrics turns the lifecycle events of piped connections into
+// Prometheus counters and histograms, served in the Prometheus text
+// exposition format (https://prometheus.io/docs/instrumenting/exposition_formats/)
+// without depending on the Prometheus client library.
+package metrics // import "golang.org/x/crypto/ssh/metrics"
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DurationBuckets are the default upper bounds, in seconds, of the
+// histogram of the upstream handshake durations.
+var DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ConnectionBuckets are the default upper bounds, in seconds, of the
+// histogram of the piped connection durations.
+var ConnectionBuckets = []float64{1, 10, 60, 300, 900, 1800, 3600, 4 * 3600, 12 * 3600, 24 * 3600}
+
+// Metrics is a ssh.PiperObserver counting the events of piped connections.
+// It serves the metrics over HTTP, and can be shared by all connections.
+type Metrics struct {
+	namespace string
+
+	mu      sync.Mutex
+	metrics []metric
+
+	handshakes         *counter
+	authAttempts       *counter
+	upstreamHandshakes *counter
+	upstreamDuration   *histogram
+	rekeys             *counter
+	packets            *counter
+	bytes              *counter
+	disconnects        *counter
+	connectionDuration *histogram
+}
+
+// New returns Metrics whose names are prefixed with namespace, e.g. "sshpiper".
+func New(namespace string) *Metrics {
+	m := &Metrics{namespace: namespace}
+
+	m.handshakes = m.counter("downstream_handshakes_total", "Completed downstream handshakes.", "kex", "cipher")
+	m.authAttempts = m.counter("auth_attempts_total", "Downstream authentication attempts.", "method", "result")
+	m.upstreamHandshakes = m.counter("upstream_handshakes_total", "Upstream connection attempts.", "result")
+	m.upstreamDuration = m.histogram("upstream_handshake_duration_seconds", "Time to connect, handshake and authenticate with an upstream.", DurationBuckets)
+	m.rekeys = m.counter("rekeys_total", "Key exchanges after the first one.", "side")
+	m.packets = m.counter("piped_packets_total", "Packets piped, by the side sending them.", "from")
+	m.bytes = m.counter("piped_bytes_total", "Bytes of channel data piped, by the side sending them.", "from")
+	m.disconnects = m.counter("disconnects_total", "Piped connections ended, by the side ending first.", "side")
+	m.connectionDuration = m.histogram("connection_duration_seconds", "Duration of the piped connections.", ConnectionBuckets)
+
+	return m
+}
+
+// Observe implements ssh.PiperObserver.
+func (m *Metrics) Observe(conn ssh.ConnMetadata, event ssh.PiperEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch e := event.(type) {
+	case *ssh.DownstreamHandshakeEvent:
+		m.handshakes.add(1, e.Algorithms.KeyExchange, e.Algorithms.Read.Cipher)
+	case *ssh.AuthAttemptEvent:
+		m.authAttempts.add(1, authMethod(e.Method), result(e.Err))
+	case *ssh.UpstreamHandshakeEvent:
+		m.upstreamHandshakes.add(1, result(e.Err))
+		m.upstreamDuration.observe(e.Duration.Seconds())
+	case *ssh.RekeyEvent:
+		m.rekeys.add(1, e.Side.String())
+	case *ssh.TrafficEvent:
+		m.packets.add(float64(e.Packets), e.Direction.String())
+		m.bytes.add(float64(e.Bytes), e.Direction.String())
+	case *ssh.DisconnectEvent:
+		m.disconnects.add(1, e.Side.String())
+		m.connectionDuration.observe(e.Duration.Seconds())
+	}
+}
+
+// authMethod returns the label of method, which is sent by the client before
+// it is authenticated: unknown methods share a single series.
+func authMethod(method string) string {
+	switch method {
+	case "none", "password", "publickey", "keyboard-interactive", "hostbased", "gssapi-with-mic":
+		return method
+	}
+	return "other"
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	m.mu.Lock()
+	for _, metric := range m.metrics {
+		metric.write(cw)
+	}
+	m.mu.Unlock()
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+
+	return cw.n, cw.w.Flush()
+}
+
+// ServeHTTP serves the metrics to a Prometheus scraper.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+type metric interface {
+	write(w *countingWriter)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) printf(format string, args ...interface{}) {
+	if c.err != nil {
+		return
+	}
+
+	n, err := fmt.Fprintf(c.w, format, args...)
+	c.n += int64(n)
+	c.err = err
+}
+
+func (m *Metrics) name(name string) string {
+	if m.namespace == "" {
+		return name
+	}
+	return m.namespace + "_" + name
+}
+
+type counter struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func (m *Metrics) counter(name, help string, labels ...string) *counter {
+	c := &counter{
+		name:   m.name(name),
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	m.metrics = append(m.metrics, c)
+	return c
+}
+
+func (c *counter) add(v float64, labelValues ...string) {
+	c.values[formatLabels(c.labels, labelValues)] += v
+}
+
+func (c *counter) write(w *countingWriter) {
+	w.printf("# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		w.printf("%s%s %s\n", c.name, k, formatValue(c.values[k]))
+	}
+}
+
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (m *Metrics) histogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{
+		name:    m.name(name),
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	m.metrics = append(m.metrics, h)
+	return h
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w *countingWriter) {
+	w.printf("# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	for i, le := range h.buckets {
+		w.printf("%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(le), h.counts[i])
+	}
+	w.printf("%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	w.printf("%s_sum %s\n", h.name, formatValue(h.sum))
+	w.printf("%s_count %d\n", h.name, h.count)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
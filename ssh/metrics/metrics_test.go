@@ -0,0 +1,86 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New("sshpiper")
+
+	algs := ssh.NegotiatedAlgorithms{
+		KeyExchange: "curve25519-sha256",
+		Read:        ssh.DirectionAlgorithms{Cipher: "aes128-gcm@openssh.com"},
+	}
+
+	for _, e := range []ssh.PiperEvent{
+		&ssh.DownstreamHandshakeEvent{Algorithms: algs},
+		&ssh.AuthAttemptEvent{Method: "none", Err: errors.New("denied")},
+		&ssh.AuthAttemptEvent{Method: "password", Err: errors.New("denied")},
+		&ssh.AuthAttemptEvent{Method: "password"},
+		&ssh.AuthAttemptEvent{Method: "made-up-1", Err: errors.New("denied")},
+		&ssh.AuthAttemptEvent{Method: "made\"up\n2", Err: errors.New("denied")},
+		&ssh.UpstreamHandshakeEvent{Duration: 20 * time.Millisecond},
+		&ssh.RekeyEvent{Side: ssh.FromUpstream},
+		&ssh.TrafficEvent{Direction: ssh.FromDownstream, Packets: 3, Bytes: 100},
+		&ssh.TrafficEvent{Direction: ssh.FromUpstream, Packets: 5, Bytes: 2000},
+		&ssh.DisconnectEvent{Side: ssh.FromDownstream, Duration: 90 * time.Second},
+	} {
+		m.Observe(nil, e)
+	}
+
+	var b bytes.Buffer
+	n, err := m.WriteTo(&b)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if n != int64(b.Len()) {
+		t.Fatalf("WriteTo returned %d, wrote %d", n, b.Len())
+	}
+
+	for _, want := range []string{
+		"# TYPE sshpiper_downstream_handshakes_total counter\n",
+		`sshpiper_downstream_handshakes_total{kex="curve25519-sha256",cipher="aes128-gcm@openssh.com"} 1` + "\n",
+		`sshpiper_auth_attempts_total{method="none",result="failure"} 1` + "\n",
+		`sshpiper_auth_attempts_total{method="password",result="failure"} 1` + "\n",
+		`sshpiper_auth_attempts_total{method="password",result="success"} 1` + "\n",
+		`sshpiper_auth_attempts_total{method="other",result="failure"} 2` + "\n",
+		`sshpiper_upstream_handshakes_total{result="success"} 1` + "\n",
+		`sshpiper_upstream_handshake_duration_seconds_bucket{le="0.01"} 0` + "\n",
+		`sshpiper_upstream_handshake_duration_seconds_bucket{le="0.025"} 1` + "\n",
+		`sshpiper_upstream_handshake_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"sshpiper_upstream_handshake_duration_seconds_sum 0.02\n",
+		`sshpiper_rekeys_total{side="upstream"} 1` + "\n",
+		`sshpiper_piped_packets_total{from="downstream"} 3` + "\n",
+		`sshpiper_piped_bytes_total{from="upstream"} 2000` + "\n",
+		`sshpiper_disconnects_total{side="downstream"} 1` + "\n",
+		`sshpiper_connection_duration_seconds_bucket{le="60"} 0` + "\n",
+		`sshpiper_connection_duration_seconds_bucket{le="300"} 1` + "\n",
+		"sshpiper_connection_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("missing %q in\n%s", want, b.String())
+		}
+	}
+
+	// the methods sent by the clients never become labels
+	if strings.Contains(b.String(), "made") {
+		t.Errorf("unknown method used as a label in\n%s", b.String())
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	got := formatLabels([]string{"a", "b"}, []string{`x"y`, "back\\slash\nline"})
+	if want := `{a="x\"y",b="back\\slash\nline"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
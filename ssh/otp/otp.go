@@ -0,0 +1,400 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+// Package otp authenticates with one-time codes asked over
+// keyboard-interactive, time-based (TOTP, RFC 6238) or counter-based (HOTP,
+// RFC 4226), as generated by authenticator apps and hardware tokens. The same
+// Authenticator serves an ssh.ServerConfig, a ssh.PiperConfig or a step of a
+// ssh.AuthChain.
+package otp // import "golang.org/x/crypto/ssh/otp"
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HOTP returns the RFC 4226 code of secret for counter, with digits digits,
+// computed with h, or SHA-1 if h is nil.
+func HOTP(secret []byte, counter uint64, digits int, h func() hash.Hash) string {
+	if h == nil {
+		h = sha1.New
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(h, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := uint64(binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff)
+
+	mod := uint64(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// TOTP returns the RFC 6238 code of secret at t, for time steps of period,
+// with digits digits, computed with h, or SHA-1 if h is nil.
+func TOTP(secret []byte, t time.Time, period time.Duration, digits int, h func() hash.Hash) string {
+	return HOTP(secret, timeStep(t, period), digits, h)
+}
+
+func timeStep(t time.Time, period time.Duration) uint64 {
+	secs := int64(period / time.Second)
+	if secs <= 0 {
+		secs = 1
+	}
+	return uint64(t.Unix() / secs)
+}
+
+// DecodeSecret decodes a base32 secret, as shown by authenticator apps and in
+// otpauth:// URIs. Case, spaces and padding are ignored.
+func DecodeSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	s = strings.TrimRight(s, "=")
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+}
+
+// Store remembers the last code accepted for each user, so codes cannot be
+// replayed. Counters are HOTP counters, or TOTP time steps.
+type Store interface {
+	// Last returns the last counter accepted for user, if any.
+	Last(user string) (counter uint64, ok bool, err error)
+
+	// Accept records counter as the last one accepted for user, if it is
+	// greater than the last one. It reports false otherwise, the code being
+	// replayed.
+	Accept(user string, counter uint64) (bool, error)
+}
+
+// MemoryStore is a Store in memory, for a single piper process.
+type MemoryStore struct {
+	mu   sync.Mutex
+	last map[string]uint64
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{last: make(map[string]uint64)}
+}
+
+// Last implements Store.
+func (s *MemoryStore) Last(user string) (uint64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter, ok := s.last[user]
+	return counter, ok, nil
+}
+
+// Accept implements Store.
+func (s *MemoryStore) Accept(user string, counter uint64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if last, ok := s.last[user]; ok && counter <= last {
+		return false, nil
+	}
+
+	s.last[user] = counter
+	return true, nil
+}
+
+var (
+	// ErrInvalidCode is returned for a code which does not match.
+	ErrInvalidCode = errors.New("otp: invalid code")
+
+	// ErrReplayedCode is returned for a code which was already used.
+	ErrReplayedCode = errors.New("otp: code already used")
+
+	// ErrTooManyAttempts is returned, without asking for a code, once a
+	// connection entered MaxAttempts wrong codes.
+	ErrTooManyAttempts = errors.New("otp: too many attempts")
+)
+
+// Authenticator verifies the one-time codes of the users.
+type Authenticator struct {
+	// Secret returns the secret shared with the token of user. An error
+	// rejects the user.
+	Secret func(user string) ([]byte, error)
+
+	// HOTP selects counter-based codes instead of time-based codes. It
+	// requires a Store, which holds the counters.
+	HOTP bool
+
+	// Digits is the length of the codes. If zero, 6 is used.
+	Digits int
+
+	// Hash is the HMAC hash. If nil, SHA-1 is used, as by most tokens.
+	Hash func() hash.Hash
+
+	// Period is the time step of time-based codes. If zero, 30 seconds is
+	// used.
+	Period time.Duration
+
+	// Skew is the number of time steps accepted before and after the current
+	// one, for clocks out of sync, or the number of counters accepted after
+	// the expected one, for codes generated but never used.
+	Skew int
+
+	// Store, if non-nil, rejects replayed codes.
+	Store Store
+
+	// Prompt is the question asked to the user. If empty, "Verification
+	// code: " is used.
+	Prompt string
+
+	// MaxAttempts is the number of wrong codes a connection may enter, as
+	// the piper does not limit the authentication attempts of the
+	// downstream. If zero, 3 is used. If negative, the attempts are not
+	// limited.
+	MaxAttempts int
+
+	// Now, if non-nil, returns the current time.
+	Now func() time.Time
+
+	// mu guards failures, the wrong codes entered by each connection, by
+	// session ID.
+	mu       sync.Mutex
+	failures map[string]attempts
+}
+
+// attempts counts the wrong codes of a connection.
+type attempts struct {
+	n    int
+	last time.Time
+}
+
+// maxTrackedConns is the number of connections whose wrong codes are
+// remembered: past it, the connection with the oldest wrong code is forgotten.
+const maxTrackedConns = 1024
+
+func (a *Authenticator) digits() int {
+	if a.Digits == 0 {
+		return 6
+	}
+	return a.Digits
+}
+
+func (a *Authenticator) period() time.Duration {
+	if a.Period == 0 {
+		return 30 * time.Second
+	}
+	return a.Period
+}
+
+func (a *Authenticator) maxAttempts() int {
+	if a.MaxAttempts == 0 {
+		return 3
+	}
+	return a.MaxAttempts
+}
+
+func (a *Authenticator) now() time.Time {
+	if a.Now == nil {
+		return time.Now()
+	}
+	return a.Now()
+}
+
+// candidates returns the counters whose codes are accepted for user.
+func (a *Authenticator) candidates(user string) ([]uint64, error) {
+	if a.HOTP {
+		if a.Store == nil {
+			return nil, errors.New("otp: HOTP requires a Store")
+		}
+
+		next, ok, err := a.Store.Last(user)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			next++
+		}
+
+		var counters []uint64
+		for i := 0; i <= a.Skew; i++ {
+			counters = append(counters, next+uint64(i))
+		}
+		return counters, nil
+	}
+
+	now := timeStep(a.now(), a.period())
+
+	var counters []uint64
+	for i := -a.Skew; i <= a.Skew; i++ {
+		if i < 0 && uint64(-i) > now {
+			continue
+		}
+		counters = append(counters, now+uint64(i))
+	}
+	return counters, nil
+}
+
+// Verify checks code for user, and consumes it if Store is set.
+func (a *Authenticator) Verify(user, code string) error {
+	if a.Secret == nil {
+		return errors.New("otp: no secrets configured")
+	}
+
+	secret, err := a.Secret(user)
+	if err != nil {
+		return err
+	}
+
+	counters, err := a.candidates(user)
+	if err != nil {
+		return err
+	}
+
+	code = strings.TrimSpace(code)
+	for _, counter := range counters {
+		want := HOTP(secret, counter, a.digits(), a.Hash)
+		if subtle.ConstantTimeCompare([]byte(code), []byte(want)) != 1 {
+			continue
+		}
+
+		if a.Store == nil {
+			return nil
+		}
+
+		ok, err := a.Store.Accept(user, counter)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrReplayedCode
+		}
+		return nil
+	}
+
+	return ErrInvalidCode
+}
+
+// Challenge asks the user for a code over client, and verifies it. It does
+// not limit the attempts, see MaxAttempts.
+func (a *Authenticator) Challenge(user string, client ssh.KeyboardInteractiveChallenge) error {
+	prompt := a.Prompt
+	if prompt == "" {
+		prompt = "Verification code: "
+	}
+
+	answers, err := client("", "", []string{prompt}, []bool{false})
+	if err != nil {
+		return err
+	}
+
+	if len(answers) != 1 {
+		return fmt.Errorf("otp: got %d answers, want 1", len(answers))
+	}
+
+	return a.Verify(user, answers[0])
+}
+
+// challengeConn is Challenge for the user of conn, once conn entered less
+// than MaxAttempts wrong codes.
+func (a *Authenticator) challengeConn(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) error {
+	limit := a.maxAttempts()
+	if limit < 0 {
+		return a.Challenge(conn.User(), client)
+	}
+
+	id := string(conn.SessionID())
+
+	a.mu.Lock()
+	n := a.failures[id].n
+	a.mu.Unlock()
+	if n >= limit {
+		return ErrTooManyAttempts
+	}
+
+	err := a.Challenge(conn.User(), client)
+	switch {
+	case err == nil:
+		a.mu.Lock()
+		delete(a.failures, id)
+		a.mu.Unlock()
+	case errors.Is(err, ErrInvalidCode), errors.Is(err, ErrReplayedCode):
+		a.fail(id)
+	}
+
+	return err
+}
+
+// fail records a wrong code entered by the connection of session ID id.
+func (a *Authenticator) fail(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.failures == nil {
+		a.failures = make(map[string]attempts)
+	}
+
+	f, ok := a.failures[id]
+	if !ok && len(a.failures) >= maxTrackedConns {
+		var oldest string
+		for k, g := range a.failures {
+			if oldest == "" || g.last.Before(a.failures[oldest].last) {
+				oldest = k
+			}
+		}
+		delete(a.failures, oldest)
+	}
+
+	f.n++
+	f.last = a.now()
+	a.failures[id] = f
+}
+
+// ServerCallback is a ssh.ServerConfig.KeyboardInteractiveCallback accepting
+// the users entering a valid code.
+func (a *Authenticator) ServerCallback(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	if err := a.challengeConn(conn, client); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// PiperCallback returns a ssh.PiperConfig.KeyboardInteractiveCallback which,
+// once the user entered a valid code, returns the upstream returned by
+// upstream. If upstream is nil, it returns ssh.ErrPartialSuccess, the code
+// being one step of a multi-step authentication.
+func (a *Authenticator) PiperCallback(upstream func(conn ssh.ConnMetadata, challengeCtx ssh.ChallengeContext) (*ssh.Upstream, error)) func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge, challengeCtx ssh.ChallengeContext) (*ssh.Upstream, error) {
+	return func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge, challengeCtx ssh.ChallengeContext) (*ssh.Upstream, error) {
+		if err := a.challengeConn(conn, client); err != nil {
+			return nil, err
+		}
+
+		if upstream == nil {
+			return nil, ssh.ErrPartialSuccess
+		}
+		return upstream(conn, challengeCtx)
+	}
+}
+
+// AuthStep returns a step of a ssh.AuthChain satisfied by a valid code.
+func (a *Authenticator) AuthStep() ssh.AuthStep {
+	return ssh.AuthStep{
+		KeyboardInteractive: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge, chainCtx *ssh.AuthChainContext) error {
+			return a.challengeConn(conn, client)
+		},
+	}
+}
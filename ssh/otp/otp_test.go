@@ -0,0 +1,308 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package otp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var rfcSecret = []byte("12345678901234567890")
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226 appendix D
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		if got := HOTP(rfcSecret, uint64(counter), 6, nil); got != code {
+			t.Errorf("HOTP(%d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B
+	secrets := map[string][]byte{
+		"sha1":   rfcSecret,
+		"sha256": []byte("12345678901234567890123456789012"),
+		"sha512": []byte("1234567890123456789012345678901234567890123456789012345678901234"),
+	}
+	hashes := map[string]func() hash.Hash{
+		"sha1":   nil,
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+	}
+
+	for _, tt := range []struct {
+		unix int64
+		hash string
+		code string
+	}{
+		{59, "sha1", "94287082"},
+		{59, "sha256", "46119246"},
+		{59, "sha512", "90693936"},
+		{1111111109, "sha1", "07081804"},
+		{1111111111, "sha256", "67062674"},
+		{1234567890, "sha512", "93441116"},
+		{2000000000, "sha1", "69279037"},
+		{20000000000, "sha256", "77737706"},
+	} {
+		got := TOTP(secrets[tt.hash], time.Unix(tt.unix, 0), 30*time.Second, 8, hashes[tt.hash])
+		if got != tt.code {
+			t.Errorf("TOTP(%d, %s) = %s, want %s", tt.unix, tt.hash, got, tt.code)
+		}
+	}
+}
+
+func TestDecodeSecret(t *testing.T) {
+	secret, err := DecodeSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	if err != nil {
+		t.Fatalf("DecodeSecret: %v", err)
+	}
+	if string(secret) != string(rfcSecret) {
+		t.Errorf("got secret %q, want %q", secret, rfcSecret)
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	a := &Authenticator{
+		Secret: func(user string) ([]byte, error) { return rfcSecret, nil },
+		Skew:   1,
+		Store:  NewMemoryStore(),
+		Now:    func() time.Time { return now },
+	}
+
+	previous := TOTP(rfcSecret, now.Add(-30*time.Second), 30*time.Second, 6, nil)
+	current := TOTP(rfcSecret, now, 30*time.Second, 6, nil)
+	tooOld := TOTP(rfcSecret, now.Add(-60*time.Second), 30*time.Second, 6, nil)
+
+	if err := a.Verify("user", tooOld); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("verify code outside of the skew: got %v, want ErrInvalidCode", err)
+	}
+	if err := a.Verify("user", previous); err != nil {
+		t.Errorf("verify code within the skew: %v", err)
+	}
+	if err := a.Verify("user", current); err != nil {
+		t.Errorf("verify current code: %v", err)
+	}
+	if err := a.Verify("user", current); !errors.Is(err, ErrReplayedCode) {
+		t.Errorf("verify replayed code: got %v, want ErrReplayedCode", err)
+	}
+	if err := a.Verify("user", previous); !errors.Is(err, ErrReplayedCode) {
+		t.Errorf("verify code older than the last one: got %v, want ErrReplayedCode", err)
+	}
+	if err := a.Verify("other", current); err != nil {
+		t.Errorf("verify code of another user: %v", err)
+	}
+}
+
+func TestVerifyHOTP(t *testing.T) {
+	a := &Authenticator{
+		Secret: func(user string) ([]byte, error) { return rfcSecret, nil },
+		HOTP:   true,
+		Skew:   2,
+	}
+
+	if err := a.Verify("user", "755224"); err == nil {
+		t.Fatal("verified HOTP without a Store")
+	}
+
+	a.Store = NewMemoryStore()
+
+	if err := a.Verify("user", "755224"); err != nil {
+		t.Errorf("verify first code: %v", err)
+	}
+	if err := a.Verify("user", "755224"); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("verify used code: got %v, want ErrInvalidCode", err)
+	}
+	// 287082 was skipped
+	if err := a.Verify("user", "359152"); err != nil {
+		t.Errorf("verify code within the look-ahead: %v", err)
+	}
+	if err := a.Verify("user", "287922"); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("verify code beyond the look-ahead: got %v, want ErrInvalidCode", err)
+	}
+}
+
+// tcpPipe returns a connected pair of TCP connections, as the handshake
+// needs buffered writes.
+func tcpPipe() (net.Conn, net.Conn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s, err := l.Accept()
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+
+	return c, s, nil
+}
+
+func TestServerCallback(t *testing.T) {
+	now := time.Now()
+	a := &Authenticator{
+		Secret: func(user string) ([]byte, error) {
+			if user != "user" {
+				return nil, errors.New("unknown user")
+			}
+			return rfcSecret, nil
+		},
+		Store: NewMemoryStore(),
+		Now:   func() time.Time { return now },
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func(user, code string) error {
+		config := &ssh.ServerConfig{KeyboardInteractiveCallback: a.ServerCallback}
+		config.AddHostKey(hostKey)
+
+		c, s, err := tcpPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		go func() {
+			defer s.Close()
+			ssh.NewServerConn(s, config)
+		}()
+
+		conn, _, _, err := ssh.NewClientConn(c, "", &ssh.ClientConfig{
+			User: user,
+			Auth: []ssh.AuthMethod{ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				if len(questions) != 1 || questions[0] != "Verification code: " {
+					t.Errorf("got questions %q", questions)
+				}
+				return []string{code}, nil
+			})},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	code := TOTP(rfcSecret, now, 30*time.Second, 6, nil)
+	if err := dial("user", "000000"); err == nil {
+		t.Error("authenticated with a wrong code")
+	}
+	if err := dial("other", code); err == nil {
+		t.Error("authenticated an unknown user")
+	}
+	if err := dial("user", code); err != nil {
+		t.Errorf("authenticate with a valid code: %v", err)
+	}
+	if err := dial("user", code); err == nil {
+		t.Error("authenticated with a replayed code")
+	}
+}
+
+// sessionConn is the ssh.ConnMetadata of a connection, for the callbacks
+// called directly.
+type sessionConn struct {
+	ssh.ConnMetadata
+	user, sessionID string
+}
+
+func (c *sessionConn) User() string      { return c.user }
+func (c *sessionConn) SessionID() []byte { return []byte(c.sessionID) }
+
+func TestMaxAttempts(t *testing.T) {
+	now := time.Now()
+	a := &Authenticator{
+		Secret:      func(user string) ([]byte, error) { return rfcSecret, nil },
+		MaxAttempts: 2,
+		Now:         func() time.Time { return now },
+	}
+	callback := a.PiperCallback(func(conn ssh.ConnMetadata, challengeCtx ssh.ChallengeContext) (*ssh.Upstream, error) {
+		return &ssh.Upstream{}, nil
+	})
+
+	asked := 0
+	answer := func(code string) ssh.KeyboardInteractiveChallenge {
+		return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			asked++
+			return []string{code}, nil
+		}
+	}
+
+	code := TOTP(rfcSecret, now, 30*time.Second, 6, nil)
+	conn := &sessionConn{user: "user", sessionID: "1"}
+
+	for i := 0; i < 2; i++ {
+		if _, err := callback(conn, answer("000000"), nil); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("attempt %d: got %v, want ErrInvalidCode", i, err)
+		}
+	}
+	if _, err := callback(conn, answer(code), nil); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("got %v once the attempts are exhausted, want ErrTooManyAttempts", err)
+	}
+	if asked != 2 {
+		t.Errorf("asked for %d codes, want 2", asked)
+	}
+
+	// the limit is per connection
+	if _, err := callback(&sessionConn{user: "user", sessionID: "2"}, answer(code), nil); err != nil {
+		t.Errorf("authenticate another connection: %v", err)
+	}
+}
+
+func TestMaxTrackedConns(t *testing.T) {
+	now := time.Now()
+	a := &Authenticator{
+		Now: func() time.Time { return now },
+	}
+
+	for i := 0; i < maxTrackedConns+10; i++ {
+		a.fail(fmt.Sprint(i))
+		now = now.Add(time.Second)
+	}
+
+	if len(a.failures) != maxTrackedConns {
+		t.Fatalf("tracking %d connections, want %d", len(a.failures), maxTrackedConns)
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := a.failures[fmt.Sprint(i)]; ok {
+			t.Errorf("connection %d, among the oldest, still tracked", i)
+		}
+	}
+
+	// another wrong code of a tracked connection evicts nothing
+	a.fail("10")
+	if f := a.failures["10"]; f.n != 2 || !f.last.Equal(now) {
+		t.Errorf("got %+v for connection 10, want 2 wrong codes at %v", f, now)
+	}
+	if len(a.failures) != maxTrackedConns {
+		t.Errorf("tracking %d connections, want %d", len(a.failures), maxTrackedConns)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// asciicastEncoder writes an asciicast v2 file: a JSON header line followed
+// by one JSON array per event.
+type asciicastEncoder struct {
+	w     io.WriteCloser
+	buf   *bufio.Writer
+	s     *session
+	start int64
+
+	// partial holds the trailing bytes of an incomplete UTF-8 sequence per
+	// event type, as JSON strings cannot hold them.
+	partial map[eventType][]byte
+}
+
+func newAsciicastEncoder(w io.WriteCloser) *asciicastEncoder {
+	return &asciicastEncoder{
+		w:       w,
+		buf:     bufio.NewWriter(w),
+		partial: make(map[eventType][]byte),
+	}
+}
+
+func (a *asciicastEncoder) writeHeader(s *session) error {
+	a.s = s
+	h := asciicastHeader{
+		Version:   2,
+		Width:     s.width,
+		Height:    s.height,
+		Timestamp: s.start.Unix(),
+		Command:   s.command,
+	}
+	if s.term != "" {
+		h.Env = map[string]string{"TERM": s.term}
+	}
+
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	b = append(b, '\n')
+	if _, err := a.buf.Write(b); err != nil {
+		return err
+	}
+
+	return a.buf.Flush()
+}
+
+func (a *asciicastEncoder) writeEvent(e *event) error {
+	var data string
+
+	switch e.typ {
+	case eventResize:
+		data = fmt.Sprintf("%dx%d", e.width, e.height)
+	default:
+		b := append(a.partial[e.typ], e.data...)
+		b, a.partial[e.typ] = splitUTF8(b)
+		if len(b) == 0 {
+			return nil
+		}
+		data = string(b)
+	}
+
+	quoted, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	elapsed := e.at.Sub(a.s.start).Seconds()
+	line := make([]byte, 0, len(quoted)+32)
+	line = append(line, '[')
+	line = strconv.AppendFloat(line, elapsed, 'f', 6, 64)
+	line = append(line, ", \""...)
+	line = append(line, byte(e.typ))
+	line = append(line, "\", "...)
+	line = append(line, quoted...)
+	line = append(line, "]\n"...)
+
+	if _, err := a.buf.Write(line); err != nil {
+		return err
+	}
+
+	return a.buf.Flush()
+}
+
+func (a *asciicastEncoder) Close() error {
+	err := a.buf.Flush()
+	if cerr := a.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// splitUTF8 splits b before a trailing incomplete UTF-8 sequence.
+func splitUTF8(b []byte) (complete, rest []byte) {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(b[i]) {
+			continue
+		}
+
+		if !utf8.FullRune(b[i:]) {
+			rest = make([]byte, len(b)-i)
+			copy(rest, b[i:])
+			return b[:i], rest
+		}
+		break
+	}
+
+	return b, nil
+}
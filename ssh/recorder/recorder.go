@@ -0,0 +1,330 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+// Package recorder records the interactive sessions going through a
+// ssh.PiperConn, in the asciicast v2 format of asciinema
+// (https://docs.asciinema.org/manual/asciicast/v2/) and in the typescript
+// and timing format read by scriptreplay.
+package recorder // import "golang.org/x/crypto/ssh/recorder"
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrEventsDropped is returned by Recorder.Close if events were dropped
+// because a writer did not keep up with the session.
+var ErrEventsDropped = errors.New("recorder: events dropped, writer too slow")
+
+// Config holds the destinations and options of a Recorder.
+type Config struct {
+	// Asciicast, if non-nil, opens the destination of the asciicast v2
+	// recording of a session channel.
+	Asciicast func(ch *ssh.PipedChannel) (io.WriteCloser, error)
+
+	// Typescript, if non-nil, opens the destinations of the typescript and
+	// timing files of a session channel.
+	Typescript func(ch *ssh.PipedChannel) (typescript, timing io.WriteCloser, err error)
+
+	// RecordInput adds the data typed by the downstream user to the
+	// asciicast recording. Typescript files only hold the output.
+	RecordInput bool
+
+	// QueueSize is the number of events buffered per channel while the
+	// writers are busy. Events beyond are dropped instead of stalling the
+	// piped connection. If zero, 1024 is used.
+	QueueSize int
+}
+
+type eventType byte
+
+const (
+	eventOutput eventType = 'o'
+	eventInput  eventType = 'i'
+	eventResize eventType = 'r'
+)
+
+type event struct {
+	at   time.Time
+	typ  eventType
+	data []byte
+
+	width, height uint32
+}
+
+// session is the header information of a recorded channel.
+type session struct {
+	start         time.Time
+	term          string
+	command       string
+	width, height uint32
+}
+
+// encoder writes the events of a channel in one recording format.
+type encoder interface {
+	writeHeader(s *session) error
+	writeEvent(e *event) error
+	Close() error
+}
+
+type channel struct {
+	session
+	recording bool
+	events    chan *event
+}
+
+// Recorder records the session channels of one piped connection. Install its
+// hooks with PiperConn.WaitWithMessageHooks and call Close once the
+// connection ended.
+type Recorder struct {
+	config Config
+	now    func() time.Time
+
+	mu       sync.Mutex
+	channels map[*ssh.PipedChannel]*channel
+	wg       sync.WaitGroup
+	err      error
+	closed   bool
+}
+
+// New returns a Recorder for a single piped connection.
+func New(config Config) *Recorder {
+	if config.QueueSize == 0 {
+		config.QueueSize = 1024
+	}
+
+	return &Recorder{
+		config:   config,
+		now:      time.Now,
+		channels: make(map[*ssh.PipedChannel]*channel),
+	}
+}
+
+// Hooks returns the message hooks feeding the recorder.
+func (r *Recorder) Hooks() *ssh.MessageHooks {
+	return &ssh.MessageHooks{
+		OnChannelRequest: r.onChannelRequest,
+		OnChannelData:    r.onChannelData,
+		OnChannelClose:   r.onChannelClose,
+	}
+}
+
+// Close finishes all recordings and returns the first error hit while
+// writing them.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	for ch, c := range r.channels {
+		if c.recording {
+			close(c.events)
+		}
+		delete(r.channels, ch)
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) setError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+type ptyRequest struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	Width    uint32
+	Height   uint32
+	Modelist string
+}
+
+type windowChangeRequest struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+type execRequest struct {
+	Command string
+}
+
+func (r *Recorder) onChannelRequest(dir ssh.PipeDirection, msg *ssh.PipedChannelRequest) (ssh.PipeVerdict, error) {
+	if dir != ssh.FromDownstream || msg.Channel.ChanType != "session" {
+		return ssh.PipeForward, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ssh.PipeForward, nil
+	}
+
+	c := r.channels[msg.Channel]
+	if c == nil {
+		c = &channel{session: session{width: 80, height: 24}}
+		r.channels[msg.Channel] = c
+	}
+
+	switch msg.Type {
+	case "pty-req":
+		var req ptyRequest
+		if ssh.Unmarshal(msg.Payload, &req) == nil {
+			c.term, c.width, c.height = req.Term, req.Columns, req.Rows
+		}
+	case "window-change":
+		var req windowChangeRequest
+		if ssh.Unmarshal(msg.Payload, &req) == nil {
+			c.width, c.height = req.Columns, req.Rows
+			if c.recording {
+				r.queue(c, &event{at: r.now(), typ: eventResize, width: req.Columns, height: req.Rows})
+			}
+		}
+	case "exec":
+		var req execRequest
+		if ssh.Unmarshal(msg.Payload, &req) == nil {
+			c.command = req.Command
+			r.start(msg.Channel, c)
+		}
+	case "shell":
+		r.start(msg.Channel, c)
+	}
+
+	return ssh.PipeForward, nil
+}
+
+func (r *Recorder) onChannelData(dir ssh.PipeDirection, msg *ssh.PipedChannelData) (ssh.PipeVerdict, error) {
+	typ := eventOutput
+	if dir == ssh.FromDownstream {
+		if !r.config.RecordInput {
+			return ssh.PipeForward, nil
+		}
+		typ = eventInput
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c := r.channels[msg.Channel]; c != nil && c.recording {
+		data := make([]byte, len(msg.Data))
+		copy(data, msg.Data)
+		r.queue(c, &event{at: r.now(), typ: typ, data: data})
+	}
+
+	return ssh.PipeForward, nil
+}
+
+func (r *Recorder) onChannelClose(ch *ssh.PipedChannel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c := r.channels[ch]; c != nil {
+		if c.recording {
+			close(c.events)
+		}
+		delete(r.channels, ch)
+	}
+}
+
+// queue hands an event to the writer goroutine of c without blocking.
+// r.mu must be held.
+func (r *Recorder) queue(c *channel, e *event) {
+	select {
+	case c.events <- e:
+	default:
+		if r.err == nil {
+			r.err = ErrEventsDropped
+		}
+	}
+}
+
+// start begins recording c. r.mu must be held.
+func (r *Recorder) start(ch *ssh.PipedChannel, c *channel) {
+	if c.recording {
+		return
+	}
+
+	c.recording = true
+	c.start = r.now()
+	c.events = make(chan *event, r.config.QueueSize)
+
+	s := c.session
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.write(ch, &s, c.events)
+	}()
+}
+
+// write opens the encoders of a channel and feeds them until events is
+// closed. It runs on its own goroutine, so slow writers never block the pipe.
+func (r *Recorder) write(ch *ssh.PipedChannel, s *session, events <-chan *event) {
+	encoders, err := r.open(ch)
+	if err == nil {
+		for _, enc := range encoders {
+			if err = enc.writeHeader(s); err != nil {
+				break
+			}
+		}
+	}
+
+	for e := range events {
+		if err != nil {
+			// keep draining, so the pipe never blocks on a dead writer
+			continue
+		}
+
+		for _, enc := range encoders {
+			if err = enc.writeEvent(e); err != nil {
+				break
+			}
+		}
+	}
+
+	for _, enc := range encoders {
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	if err != nil {
+		r.setError(err)
+	}
+}
+
+func (r *Recorder) open(ch *ssh.PipedChannel) ([]encoder, error) {
+	var encoders []encoder
+
+	if r.config.Asciicast != nil {
+		w, err := r.config.Asciicast(ch)
+		if err != nil {
+			return encoders, err
+		}
+		encoders = append(encoders, newAsciicastEncoder(w))
+	}
+
+	if r.config.Typescript != nil {
+		script, timing, err := r.config.Typescript(ch)
+		if err != nil {
+			return encoders, err
+		}
+		encoders = append(encoders, newTypescriptEncoder(script, timing))
+	}
+
+	return encoders, nil
+}
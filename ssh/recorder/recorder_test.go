@@ -0,0 +1,231 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/testdata"
+)
+
+type buffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *buffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func netPipe(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	s, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+
+	return c, s
+}
+
+func hostKey(t *testing.T) ssh.Signer {
+	signer, err := ssh.ParsePrivateKey(testdata.PEMBytes["rsa"])
+	if err != nil {
+		t.Fatalf("ParsePrivateKey: %v", err)
+	}
+	return signer
+}
+
+// shellServer runs an upstream that prints output in two packets, splitting
+// a UTF-8 sequence, on the first shell request.
+func shellServer(conn net.Conn, t *testing.T) {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey(t))
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		t.Errorf("NewServerConn: %v", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newCh := range chans {
+		ch, in, err := newCh.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			return
+		}
+
+		go func() {
+			defer ch.Close()
+			for req := range in {
+				req.Reply(true, nil)
+				if req.Type == "shell" {
+					ch.Write([]byte("hello w\xc3"))
+					ch.Write([]byte("\xb6rld"))
+					ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	cast := &buffer{}
+	script := &buffer{}
+	timing := &buffer{}
+
+	rec := New(Config{
+		Asciicast: func(ch *ssh.PipedChannel) (io.WriteCloser, error) {
+			return cast, nil
+		},
+		Typescript: func(ch *ssh.PipedChannel) (io.WriteCloser, io.WriteCloser, error) {
+			return script, timing, nil
+		},
+	})
+
+	piper := &ssh.PiperConfig{
+		NoClientAuthCallback: func(conn ssh.ConnMetadata, challengeCtx ssh.ChallengeContext) (*ssh.Upstream, error) {
+			c, s := netPipe(t)
+			go shellServer(s, t)
+			return &ssh.Upstream{
+				Conn: c,
+				ClientConfig: ssh.ClientConfig{
+					HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+				},
+			}, nil
+		},
+	}
+	piper.AddHostKey(hostKey(t))
+
+	c, s := netPipe(t)
+	done := make(chan error, 1)
+	go func() {
+		p, err := ssh.NewSSHPiperConn(s, piper)
+		if err != nil {
+			t.Errorf("NewSSHPiperConn: %v", err)
+			done <- err
+			return
+		}
+		p.WaitWithMessageHooks(rec.Hooks())
+
+		done <- rec.Close()
+	}()
+
+	sshc, chans, reqs, err := ssh.NewClientConn(c, "", &ssh.ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := ssh.NewClient(sshc, chans, reqs)
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+
+	if err := session.RequestPty("xterm", 40, 100, nil); err != nil {
+		t.Fatalf("RequestPty: %v", err)
+	}
+
+	var out bytes.Buffer
+	session.Stdout = &out
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell: %v", err)
+	}
+	session.Wait()
+	session.Close()
+	client.Close()
+
+	if err := <-done; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if out.String() != "hello wörld" {
+		t.Fatalf("got output %q", out.String())
+	}
+
+	lines := strings.Split(strings.TrimSuffix(cast.String(), "\n"), "\n")
+	var header asciicastHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatalf("bad header %q: %v", lines[0], err)
+	}
+	if header.Version != 2 || header.Width != 100 || header.Height != 40 || header.Env["TERM"] != "xterm" {
+		t.Fatalf("got header %+v", header)
+	}
+
+	var output string
+	for _, line := range lines[1:] {
+		var e []interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad event %q: %v", line, err)
+		}
+		if e[1] == "o" {
+			output += e[2].(string)
+		}
+	}
+	if output != "hello wörld" {
+		t.Fatalf("got asciicast output %q", output)
+	}
+
+	if !strings.HasPrefix(script.String(), "Script started on ") || !strings.HasSuffix(script.String(), "\nhello wörld") {
+		t.Fatalf("got typescript %q", script.String())
+	}
+	if n := strings.Count(timing.String(), "\n"); n != 2 {
+		t.Fatalf("got %d timing lines, want 2", n)
+	}
+	if !cast.closed || !script.closed || !timing.closed {
+		t.Fatalf("writers not closed")
+	}
+}
+
+func TestAsciicastEncoder(t *testing.T) {
+	start := time.Unix(1000, 0)
+	w := &buffer{}
+	enc := newAsciicastEncoder(w)
+
+	if err := enc.writeHeader(&session{start: start, width: 80, height: 24, command: "ls"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []*event{
+		{at: start.Add(time.Second / 2), typ: eventOutput, data: []byte("a\xe2\x82")},
+		{at: start.Add(time.Second), typ: eventOutput, data: []byte("\xac\"")},
+		{at: start.Add(2 * time.Second), typ: eventResize, width: 100, height: 50},
+	} {
+		if err := enc.writeEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := `{"version":2,"width":80,"height":24,"timestamp":1000,"command":"ls"}
+[0.500000, "o", "a"]
+[1.000000, "o", "€\""]
+[2.000000, "r", "100x50"]
+`
+	if w.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", w.String(), want)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package recorder
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// typescriptEncoder writes the output of a session as script(1) does, along
+// with the timing file needed by scriptreplay(1).
+type typescriptEncoder struct {
+	script io.WriteCloser
+	timing io.WriteCloser
+	last   time.Time
+}
+
+func newTypescriptEncoder(script, timing io.WriteCloser) *typescriptEncoder {
+	return &typescriptEncoder{
+		script: script,
+		timing: timing,
+	}
+}
+
+func (t *typescriptEncoder) writeHeader(s *session) error {
+	t.last = s.start
+
+	// scriptreplay skips the first line of the typescript
+	_, err := fmt.Fprintf(t.script, "Script started on %s [COMMAND=%q TERM=%q COLUMNS=%d LINES=%d]\n",
+		s.start.Format(time.RFC3339), s.command, s.term, s.width, s.height)
+	return err
+}
+
+func (t *typescriptEncoder) writeEvent(e *event) error {
+	if e.typ != eventOutput || len(e.data) == 0 {
+		return nil
+	}
+
+	delay := e.at.Sub(t.last).Seconds()
+	t.last = e.at
+
+	if _, err := t.script.Write(e.data); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(t.timing, "%.6f %d\n", delay, len(e.data))
+	return err
+}
+
+func (t *typescriptEncoder) Close() error {
+	err := t.script.Close()
+	if cerr := t.timing.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
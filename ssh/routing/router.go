@@ -0,0 +1,106 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package routing
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Router routes downstreams with the table of a file, which may be reloaded
+// at any time.
+type Router struct {
+	file  string
+	opts  []Option
+	table atomic.Pointer[Table]
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// NewRouter returns a Router loading its table from file, see LoadFile.
+func NewRouter(file string, opts ...Option) (*Router, error) {
+	r := &Router{file: file, opts: opts}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the table of the file again. On error, the current table is
+// kept.
+func (r *Router) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info, err := os.Stat(r.file)
+	if err != nil {
+		return err
+	}
+
+	t, err := LoadFile(r.file, r.opts...)
+	if err != nil {
+		return err
+	}
+
+	r.table.Store(t)
+	r.modTime = info.ModTime()
+	return nil
+}
+
+// Watch checks the file every interval, reloading it once modified, until ctx
+// is done. onError, if non-nil, is called with the errors of the reloads, and
+// with the errors checking the file when they change.
+func (r *Router) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	r.mu.Lock()
+	seen := r.modTime
+	r.mu.Unlock()
+
+	// a missing or broken file is reported once, not at every check
+	var statErr string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(r.file)
+		if err != nil {
+			if err.Error() != statErr && onError != nil {
+				onError(err)
+			}
+			statErr = err.Error()
+			continue
+		}
+		statErr = ""
+
+		if info.ModTime().Equal(seen) {
+			continue
+		}
+		seen = info.ModTime()
+		if err := r.Reload(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// Table returns the current table.
+func (r *Router) Table() *Table {
+	return r.table.Load()
+}
+
+// Upstream routes conn with the current table, see Table.Upstream.
+func (r *Router) Upstream(conn ssh.ConnMetadata, base *ssh.Upstream) (*ssh.Upstream, error) {
+	return r.Table().Upstream(conn, base)
+}
@@ -0,0 +1,326 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+// Package routing maps the users of downstreams to upstreams, with tables of
+// rules matching the downstream user exactly, with glob patterns, with
+// regular expressions, or with the "user@target" syntax.
+//
+// Tables are made of Rule values, decoded from JSON by ParseJSON and
+// LoadFile. LoadFile reads YAML files as well, with the decoder given by
+// WithYAML, as the package has no YAML parser of its own. A Router holds the
+// table of a file and reloads it while connections are piped.
+package routing // import "golang.org/x/crypto/ssh/routing"
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNoRoute is returned when no rule matches the downstream user.
+var ErrNoRoute = errors.New("routing: no route for user")
+
+// Match kinds of a Rule.
+const (
+	// MatchExact matches the downstream user equal to Rule.User.
+	MatchExact = "exact"
+
+	// MatchGlob matches the downstream user with Rule.User as a pattern of
+	// path.Match, such as "dev-*".
+	MatchGlob = "glob"
+
+	// MatchRegexp matches the whole downstream user with Rule.User as a
+	// regular expression. Its captures, $1 or ${name}, may be used in
+	// Rule.Upstream and Rule.UpstreamUser.
+	MatchRegexp = "regex"
+
+	// MatchTarget matches downstream users of the form "user@target", split
+	// at the last "@", whose target matches Rule.User as a pattern of
+	// path.Match. ${user} and ${target} refer to both parts. Rule.User must
+	// not be empty, and targets carrying a port, "host:port", only match if
+	// Rule.AllowPort is set, so downstreams only reach the hosts and ports
+	// the table allows.
+	MatchTarget = "target"
+)
+
+// Rule maps the downstream users it matches to an upstream.
+//
+// Rule.Upstream and Rule.UpstreamUser are expanded like os.Expand: ${user}
+// is the downstream user, or its user part for MatchTarget, ${target} the
+// target of MatchTarget, and the captures of MatchRegexp are available by
+// number and name.
+type Rule struct {
+	// Match is the match kind, MatchExact if empty.
+	Match string `json:"match,omitempty" yaml:"match,omitempty"`
+
+	// User is the user, pattern or expression matched, see Match.
+	User string `json:"user" yaml:"user"`
+
+	// Upstream is the address of the upstream, host or host:port. Port 22
+	// is used if missing.
+	Upstream string `json:"upstream" yaml:"upstream"`
+
+	// UpstreamUser is the user on the upstream. If empty, ${user} is used.
+	UpstreamUser string `json:"upstream_user,omitempty" yaml:"upstream_user,omitempty"`
+
+	// AllowPort lets MatchTarget match targets carrying a port.
+	AllowPort bool `json:"allow_port,omitempty" yaml:"allow_port,omitempty"`
+}
+
+// Route is the upstream a downstream user is routed to.
+type Route struct {
+	// Address is the host:port of the upstream.
+	Address string
+
+	// User is the user on the upstream.
+	User string
+
+	// Rule is the rule that matched.
+	Rule *Rule
+}
+
+type compiledRule struct {
+	Rule
+	re *regexp.Regexp
+}
+
+// Table is an ordered list of rules. The first rule matching a downstream
+// user routes it. A Table is immutable and safe for concurrent use.
+type Table struct {
+	rules []compiledRule
+}
+
+// NewTable checks and compiles rules into a Table.
+func NewTable(rules []Rule) (*Table, error) {
+	t := &Table{rules: make([]compiledRule, len(rules))}
+
+	for i, r := range rules {
+		c := compiledRule{Rule: r}
+		if c.Match == "" {
+			c.Match = MatchExact
+		}
+
+		var err error
+		switch c.Match {
+		case MatchExact:
+			if c.User == "" {
+				err = errors.New("empty user")
+			}
+		case MatchTarget:
+			if c.User == "" {
+				err = errors.New("empty target pattern")
+				break
+			}
+			_, err = path.Match(c.User, "")
+		case MatchGlob:
+			_, err = path.Match(c.User, "")
+		case MatchRegexp:
+			c.re, err = regexp.Compile("^(?:" + c.User + ")$")
+		default:
+			err = fmt.Errorf("unknown match %q", c.Match)
+		}
+		if err == nil && c.Upstream == "" {
+			err = errors.New("empty upstream")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("routing: rule %d: %w", i, err)
+		}
+
+		t.rules[i] = c
+	}
+
+	return t, nil
+}
+
+type tableFile struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// ParseJSON parses a table from JSON, an object holding the list of rules:
+//
+//	{"rules": [
+//		{"user": "alice", "upstream": "10.0.0.1"},
+//		{"match": "target", "user": "*.internal", "upstream": "${target}"},
+//		{"match": "regex", "user": "(?P<team>[a-z]+)-(.+)", "upstream": "${team}.example.com", "upstream_user": "$2"}
+//	]}
+func ParseJSON(data []byte) (*Table, error) {
+	var f tableFile
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&f); err != nil {
+		return nil, fmt.Errorf("routing: %w", err)
+	}
+
+	return NewTable(f.Rules)
+}
+
+// Option is an option of LoadFile and NewRouter.
+type Option func(*options)
+
+type options struct {
+	yaml func(data []byte, v interface{}) error
+}
+
+// WithYAML decodes the files named *.yaml or *.yml with unmarshal, such as
+// the Unmarshal function of gopkg.in/yaml.v3. Their tables hold the same
+// rules as the JSON ones, under the yaml tags of Rule:
+//
+//	rules:
+//	  - user: alice
+//	    upstream: 10.0.0.1
+//	  - match: target
+//	    user: "*.internal"
+//	    upstream: ${target}
+func WithYAML(unmarshal func(data []byte, v interface{}) error) Option {
+	return func(o *options) {
+		o.yaml = unmarshal
+	}
+}
+
+// LoadFile parses the table in file. Files named *.yaml or *.yml are YAML,
+// which requires WithYAML, the others JSON, see ParseJSON.
+func LoadFile(file string, opts ...Option) (*Table, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		if o.yaml == nil {
+			return nil, fmt.Errorf("routing: no YAML decoder for %s, see WithYAML", file)
+		}
+
+		var f tableFile
+		if err := o.yaml(data, &f); err != nil {
+			return nil, fmt.Errorf("routing: %w", err)
+		}
+		return NewTable(f.Rules)
+	}
+
+	return ParseJSON(data)
+}
+
+// Rules returns a copy of the rules of the table.
+func (t *Table) Rules() []Rule {
+	rules := make([]Rule, len(t.rules))
+	for i, r := range t.rules {
+		rules[i] = r.Rule
+	}
+	return rules
+}
+
+// Match returns the route of the downstream user, or ErrNoRoute.
+func (t *Table) Match(user string) (*Route, error) {
+	for i := range t.rules {
+		r := &t.rules[i]
+
+		vars, ok := r.match(user)
+		if !ok {
+			continue
+		}
+
+		expand := func(s string) string {
+			return os.Expand(s, func(name string) string { return vars[name] })
+		}
+
+		upstreamUser := r.UpstreamUser
+		if upstreamUser == "" {
+			upstreamUser = "${user}"
+		}
+
+		return &Route{
+			Address: withPort(expand(r.Upstream)),
+			User:    expand(upstreamUser),
+			Rule:    &r.Rule,
+		}, nil
+	}
+
+	return nil, ErrNoRoute
+}
+
+// match reports whether r matches user, and returns the variables of the
+// expansion.
+func (r *compiledRule) match(user string) (map[string]string, bool) {
+	vars := map[string]string{"user": user}
+
+	switch r.Match {
+	case MatchExact:
+		return vars, user == r.User
+	case MatchGlob:
+		ok, _ := path.Match(r.User, user)
+		return vars, ok
+	case MatchTarget:
+		i := strings.LastIndex(user, "@")
+		if i <= 0 || i == len(user)-1 {
+			return nil, false
+		}
+		vars["user"], vars["target"] = user[:i], user[i+1:]
+
+		if _, _, err := net.SplitHostPort(vars["target"]); err == nil && !r.AllowPort {
+			return nil, false
+		}
+		ok, _ := path.Match(r.User, vars["target"])
+		return vars, ok
+	case MatchRegexp:
+		m := r.re.FindStringSubmatch(user)
+		if m == nil {
+			return nil, false
+		}
+		for i, name := range r.re.SubexpNames() {
+			if i == 0 {
+				continue
+			}
+			vars[strconv.Itoa(i)] = m[i]
+			if name != "" {
+				vars[name] = m[i]
+			}
+		}
+		return vars, true
+	}
+
+	return nil, false
+}
+
+func withPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), "22")
+}
+
+// Upstream returns a copy of base routed to the upstream of the user of
+// conn: its Address and ClientConfig.User are set by the route. base holds the
+// rest of the upstream configuration, such as its Auth and HostKeyCallback.
+func (t *Table) Upstream(conn ssh.ConnMetadata, base *ssh.Upstream) (*ssh.Upstream, error) {
+	route, err := t.Match(conn.User())
+	if err != nil {
+		return nil, err
+	}
+
+	u := &ssh.Upstream{}
+	if base != nil {
+		*u = *base
+	}
+	u.Address = route.Address
+	u.User = route.User
+	return u, nil
+}
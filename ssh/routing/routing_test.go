@@ -0,0 +1,251 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const testTable = `{"rules": [
+	{"user": "alice", "upstream": "10.0.0.1"},
+	{"match": "glob", "user": "dev-*", "upstream": "dev.example.com:2222", "upstream_user": "dev"},
+	{"match": "target", "user": "*.internal", "upstream": "${target}"},
+	{"match": "regex", "user": "(?P<team>[a-z]+)-(.+)", "upstream": "${team}.example.com", "upstream_user": "$2"},
+	{"match": "target", "user": "*.example.com", "upstream": "bastion.example.com", "upstream_user": "${user}@${target}"}
+]}`
+
+func TestTableMatch(t *testing.T) {
+	table, err := ParseJSON([]byte(testTable))
+	if err != nil {
+		t.Fatalf("ParseJSON: %v", err)
+	}
+
+	for _, tt := range []struct {
+		user, address, upstreamUser string
+	}{
+		{"alice", "10.0.0.1:22", "alice"},
+		{"dev-bob", "dev.example.com:2222", "dev"},
+		{"bob@db.internal", "db.internal:22", "bob"},
+		{"ops-carol", "ops.example.com:22", "carol"},
+		{"bob@db.example.com", "bastion.example.com:22", "bob@db.example.com"},
+	} {
+		route, err := table.Match(tt.user)
+		if err != nil {
+			t.Errorf("Match(%q): %v", tt.user, err)
+			continue
+		}
+		if route.Address != tt.address || route.User != tt.upstreamUser {
+			t.Errorf("Match(%q): got %s@%s, want %s@%s", tt.user, route.User, route.Address, tt.upstreamUser, tt.address)
+		}
+	}
+
+	for _, user := range []string{"bob", "alice2", "Ops-carol", "@host", "bob@"} {
+		if route, err := table.Match(user); !errors.Is(err, ErrNoRoute) {
+			t.Errorf("Match(%q): got %+v, %v, want ErrNoRoute", user, route, err)
+		}
+	}
+}
+
+func TestNewTableErrors(t *testing.T) {
+	for _, rule := range []Rule{
+		{User: "", Upstream: "host"},
+		{User: "alice"},
+		{Match: "glob", User: "[", Upstream: "host"},
+		{Match: "regex", User: "(", Upstream: "host"},
+		{Match: "target", User: "", Upstream: "${target}"},
+		{Match: "prefix", User: "a", Upstream: "host"},
+	} {
+		if _, err := NewTable([]Rule{rule}); err == nil {
+			t.Errorf("NewTable(%+v) succeeded", rule)
+		}
+	}
+
+	if _, err := ParseJSON([]byte(`{"rules": [{"user": "alice", "host": "10.0.0.1"}]}`)); err == nil {
+		t.Error("ParseJSON accepted an unknown field")
+	}
+}
+
+func TestLoadFileYAML(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "routes.yml")
+	if err := os.WriteFile(file, []byte(testTable), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadFile(file); err == nil {
+		t.Error("LoadFile read a YAML file without a decoder")
+	}
+
+	// JSON is YAML as well
+	decoded := false
+	table, err := LoadFile(file, WithYAML(func(data []byte, v interface{}) error {
+		decoded = true
+		return json.Unmarshal(data, v)
+	}))
+	if err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	if !decoded || len(table.Rules()) != 5 {
+		t.Errorf("got %d rules, decoded with the YAML decoder: %v", len(table.Rules()), decoded)
+	}
+}
+
+func TestTableMatchTargetPort(t *testing.T) {
+	for _, tt := range []struct {
+		allowPort bool
+		address   string
+	}{
+		{false, ""},
+		{true, "db.internal:2222"},
+	} {
+		table, err := NewTable([]Rule{{Match: MatchTarget, User: "*", Upstream: "${target}", AllowPort: tt.allowPort}})
+		if err != nil {
+			t.Fatalf("NewTable: %v", err)
+		}
+
+		if route, err := table.Match("bob@db.internal"); err != nil || route.Address != "db.internal:22" {
+			t.Errorf("AllowPort %v: Match without a port: got %+v, %v", tt.allowPort, route, err)
+		}
+
+		route, err := table.Match("bob@db.internal:2222")
+		if tt.address == "" {
+			if !errors.Is(err, ErrNoRoute) {
+				t.Errorf("AllowPort %v: got %+v, %v, want ErrNoRoute", tt.allowPort, route, err)
+			}
+		} else if err != nil || route.Address != tt.address {
+			t.Errorf("AllowPort %v: got %+v, %v, want %s", tt.allowPort, route, err, tt.address)
+		}
+	}
+}
+
+type connMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c connMetadata) User() string { return c.user }
+
+func TestRouter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(file, []byte(testTable), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRouter(file)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+
+	base := &ssh.Upstream{ClientConfig: ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}}
+	u, err := r.Upstream(connMetadata{user: "alice"}, base)
+	if err != nil {
+		t.Fatalf("Upstream: %v", err)
+	}
+	if u.Address != "10.0.0.1:22" || u.User != "alice" || u.HostKeyCallback == nil || base.Address != "" {
+		t.Errorf("got upstream %s@%s from %+v", u.User, u.Address, base)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 10)
+	go r.Watch(ctx, 10*time.Millisecond, func(err error) { errs <- err })
+
+	// a broken table keeps the current one
+	future := time.Now().Add(time.Hour)
+	if err := os.WriteFile(file, []byte(`{"rules": [`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, future, future)
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broken table not reported")
+	}
+	if _, err := r.Table().Match("alice"); err != nil {
+		t.Errorf("Match after a failed reload: %v", err)
+	}
+
+	if err := os.WriteFile(file, []byte(`{"rules": [{"user": "bob", "upstream": "10.0.0.2"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, future.Add(time.Hour), future.Add(time.Hour))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := r.Table().Match("bob"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("table not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := r.Table().Match("alice"); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("Match(alice) after reload: got %v, want ErrNoRoute", err)
+	}
+}
+
+func TestRouterWatchRemoved(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(file, []byte(testTable), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRouter(file)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 100)
+	go r.Watch(ctx, 10*time.Millisecond, func(err error) { errs <- err })
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("got %v, want os.ErrNotExist", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("removed file not reported")
+	}
+
+	// the file stays missing for several checks, but is reported once
+	time.Sleep(100 * time.Millisecond)
+	if n := len(errs); n != 0 {
+		t.Errorf("removed file reported %d more times", n)
+	}
+	if _, err := r.Table().Match("alice"); err != nil {
+		t.Errorf("Match with the file removed: %v", err)
+	}
+
+	// once back, the file is reloaded
+	if err := os.WriteFile(file, []byte(`{"rules": [{"user": "bob", "upstream": "10.0.0.2"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(file, future, future)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := r.Table().Match("bob"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("table not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
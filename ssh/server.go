@@ -114,6 +114,15 @@ type ServerConfig struct {
 	// unknown.
 	KeyboardInteractiveCallback func(conn ConnMetadata, client KeyboardInteractiveChallenge) (*Permissions, error)
 
+	// HostbasedCallback, if non-nil, is called when a client authenticates
+	// with "hostbased" (RFC 4252 section 9), once the signature made with
+	// the host key of the client host was verified. clientHost is the name
+	// the client claims for its host, OpenSSH clients send it with a
+	// trailing dot, and clientUser the user on the client host. It must
+	// return a nil error if key is the host key of clientHost and clientUser
+	// may log in as the given user.
+	HostbasedCallback func(conn ConnMetadata, clientHost, clientUser string, key PublicKey) (*Permissions, error)
+
 	// AuthLogCallback, if non-nil, is called to log all authentication
 	// attempts.
 	AuthLogCallback func(conn ConnMetadata, method string, err error)
@@ -125,6 +134,12 @@ type ServerConfig struct {
 	// "SSH-2.0-".
 	ServerVersion string
 
+	// ProxyProtocol, if true, requires the connections to start with a PROXY
+	// protocol header, version 1 or 2, sent by a trusted proxy or load
+	// balancer. RemoteAddr and LocalAddr of the ConnMetadata then return the
+	// addresses of the header.
+	ProxyProtocol bool
+
 	// BannerCallback, if present, is called and the return string is sent to
 	// the client after key exchange completed but before authentication.
 	BannerCallback func(conn ConnMetadata) string
@@ -132,6 +147,17 @@ type ServerConfig struct {
 	// GSSAPIWithMICConfig includes gssapi server and callback, which if both non-nil, is used
 	// when gssapi-with-mic authentication is selected (RFC 4462 section 3).
 	GSSAPIWithMICConfig *GSSAPIWithMICConfig
+
+	// partialSuccessCallback, if non-nil, is called when a callback returned
+	// ErrPartialSuccess and, for publickey, the signature was verified. key
+	// is nil for the other methods. The callbacks may be replaced for the
+	// next steps before the methods that can continue are sent.
+	partialSuccessCallback func(conn ConnMetadata, method string, key PublicKey)
+
+	// hostKeysCallback, if non-nil, is called after the version exchange and
+	// returns the host keys of the connection, instead of hostKeys if
+	// non-empty.
+	hostKeysCallback func(conn ConnMetadata) ([]Signer, error)
 }
 
 // AddHostKey adds a private key as a host key. If an existing host
@@ -256,7 +282,7 @@ func (s *connection) serverHandshake(config *ServerConfig) (*Permissions, error)
 	}
 
 	if !config.NoClientAuth && config.PasswordCallback == nil && config.PublicKeyCallback == nil &&
-		config.KeyboardInteractiveCallback == nil && (config.GSSAPIWithMICConfig == nil ||
+		config.KeyboardInteractiveCallback == nil && config.HostbasedCallback == nil && (config.GSSAPIWithMICConfig == nil ||
 		config.GSSAPIWithMICConfig.AllowLogin == nil || config.GSSAPIWithMICConfig.Server == nil) {
 		return nil, errors.New("ssh: no authentication methods configured but NoClientAuth is also false")
 	}
@@ -267,6 +293,12 @@ func (s *connection) serverHandshake(config *ServerConfig) (*Permissions, error)
 		s.serverVersion = []byte(packageVersion)
 	}
 	var err error
+	if config.ProxyProtocol {
+		if s.sshConn.conn, err = readProxyHeader(s.sshConn.conn); err != nil {
+			return nil, err
+		}
+	}
+
 	s.clientVersion, err = exchangeVersions(s.sshConn.conn, s.serverVersion)
 	if err != nil {
 		return nil, err
@@ -433,6 +465,13 @@ func (l ServerAuthError) Error() string {
 // It is returned in ServerAuthError.Errors from NewServerConn.
 var ErrNoAuth = errors.New("ssh: no auth passed yet")
 
+// ErrPartialSuccess, returned by an authentication callback of a ServerConfig
+// or a PiperConfig, accepts the attempt as one step of a multi-step
+// authentication. The client is told the attempt succeeded partially, RFC 4252
+// section 5.1, and must continue with the next methods. A publickey is only
+// accepted once its signature was verified.
+var ErrPartialSuccess = errors.New("ssh: authenticated with partial success")
+
 func (s *connection) serverAuthenticate(config *ServerConfig) (*Permissions, error) {
 	sessionID := s.transport.getSessionID()
 	var cache pubKeyCache
@@ -488,6 +527,7 @@ userAuthLoop:
 
 		perms = nil
 		authErr := ErrNoAuth
+		var partialKey PublicKey
 
 		switch userAuthReq.Method {
 		case "none":
@@ -579,7 +619,7 @@ userAuthLoop:
 					return nil, parseError(msgUserAuthRequest)
 				}
 
-				if candidate.result == nil {
+				if candidate.result == nil || errors.Is(candidate.result, ErrPartialSuccess) {
 					okMsg := userAuthPubKeyOkMsg{
 						Algo:   algo,
 						PubKey: pubKeyData,
@@ -627,7 +667,67 @@ userAuthLoop:
 
 				authErr = candidate.result
 				perms = candidate.perms
+				partialKey = pubKey
+			}
+		case "hostbased":
+			if config.HostbasedCallback == nil {
+				authErr = errors.New("ssh: hostbased auth not configured")
+				break
+			}
+			payload := userAuthReq.Payload
+			algoBytes, payload, ok := parseString(payload)
+			if !ok {
+				return nil, parseError(msgUserAuthRequest)
+			}
+			hostKeyData, payload, ok := parseString(payload)
+			if !ok {
+				return nil, parseError(msgUserAuthRequest)
+			}
+			clientHost, payload, ok := parseString(payload)
+			if !ok {
+				return nil, parseError(msgUserAuthRequest)
+			}
+			clientUser, payload, ok := parseString(payload)
+			if !ok {
+				return nil, parseError(msgUserAuthRequest)
+			}
+			sig, payload, ok := parseSignature(payload)
+			if !ok || len(payload) > 0 {
+				return nil, parseError(msgUserAuthRequest)
 			}
+
+			algo := string(algoBytes)
+			if !contains(config.PublicKeyAuthAlgorithms, underlyingAlgo(algo)) {
+				authErr = fmt.Errorf("ssh: algorithm %q not accepted", algo)
+				break
+			}
+
+			hostKey, err := ParsePublicKey(hostKeyData)
+			if err != nil {
+				return nil, err
+			}
+			// The same checks as for publickey, see there.
+			if !contains(algorithmsForKeyFormat(hostKey.Type()), algo) {
+				authErr = fmt.Errorf("ssh: public key type %q not compatible with selected algorithm %q",
+					hostKey.Type(), algo)
+				break
+			}
+			if !contains(config.PublicKeyAuthAlgorithms, sig.Format) {
+				authErr = fmt.Errorf("ssh: algorithm %q not accepted", sig.Format)
+				break
+			}
+			if !isAlgoCompatible(algo, sig.Format) {
+				authErr = fmt.Errorf("ssh: signature %q not compatible with selected algorithm %q", sig.Format, algo)
+				break
+			}
+
+			signedData := buildDataSignedForHostbased(sessionID, userAuthReq, algo, hostKeyData,
+				string(clientHost), string(clientUser))
+			if err := hostKey.Verify(signedData, sig); err != nil {
+				return nil, err
+			}
+
+			perms, authErr = config.HostbasedCallback(s, string(clientHost), string(clientUser), hostKey)
 		case "gssapi-with-mic":
 			if config.GSSAPIWithMICConfig == nil {
 				authErr = errors.New("ssh: gssapi-with-mic auth not configured")
@@ -689,7 +789,19 @@ userAuthLoop:
 			break userAuthLoop
 		}
 
-		authFailures++
+		var failureMsg userAuthFailureMsg
+		if errors.Is(authErr, ErrPartialSuccess) {
+			failureMsg.PartialSuccess = true
+			// The keys are checked again by the callbacks of the next steps.
+			cache = pubKeyCache{}
+
+			if config.partialSuccessCallback != nil {
+				config.partialSuccessCallback(s, userAuthReq.Method, partialKey)
+			}
+		} else {
+			authFailures++
+		}
+
 		if config.MaxAuthTries > 0 && authFailures >= config.MaxAuthTries {
 			// If we have hit the max attempts, don't bother sending the
 			// final SSH_MSG_USERAUTH_FAILURE message, since there are
@@ -715,7 +827,6 @@ userAuthLoop:
 			continue
 		}
 
-		var failureMsg userAuthFailureMsg
 		if config.PasswordCallback != nil {
 			failureMsg.Methods = append(failureMsg.Methods, "password")
 		}
@@ -725,6 +836,9 @@ userAuthLoop:
 		if config.KeyboardInteractiveCallback != nil {
 			failureMsg.Methods = append(failureMsg.Methods, "keyboard-interactive")
 		}
+		if config.HostbasedCallback != nil {
+			failureMsg.Methods = append(failureMsg.Methods, "hostbased")
+		}
 		if config.GSSAPIWithMICConfig != nil && config.GSSAPIWithMICConfig.Server != nil &&
 			config.GSSAPIWithMICConfig.AllowLogin != nil {
 			failureMsg.Methods = append(failureMsg.Methods, "gssapi-with-mic")
@@ -0,0 +1,239 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package sftpaudit
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// SFTP v3 packet types.
+const (
+	fxpInit     = 1
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpSetstat  = 9
+	fxpFsetstat = 10
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpReadlink = 19
+	fxpSymlink  = 20
+
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpExtended = 200
+)
+
+// Open flags of SSH_FXP_OPEN that modify the file.
+const (
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+)
+
+// maxHeadLen bounds the bytes held while waiting for the end of a packet
+// head, as OpenSSH bounds the length of SFTP messages.
+const maxHeadLen = 256 << 10
+
+var errBadPacket = errors.New("sftpaudit: malformed SFTP packet")
+
+type initPacket struct {
+	Version    uint32 `sshtype:"1"`
+	Extensions []byte `ssh:"rest"`
+}
+
+type openPacket struct {
+	ID     uint32 `sshtype:"3"`
+	Path   string
+	Pflags uint32
+	Attrs  []byte `ssh:"rest"`
+}
+
+type handlePacket struct {
+	ID     uint32 `sshtype:"4|8|10|12"`
+	Handle string
+	Rest   []byte `ssh:"rest"`
+}
+
+type readPacket struct {
+	ID     uint32 `sshtype:"5"`
+	Handle string
+	Offset uint64
+	Length uint32
+}
+
+// writeHead is the head of a SSH_FXP_WRITE, up to the length of its data.
+type writeHead struct {
+	ID     uint32 `sshtype:"6"`
+	Handle string
+	Offset uint64
+	Length uint32
+}
+
+type pathPacket struct {
+	ID   uint32 `sshtype:"7|9|11|13|14|15|16|17|19"`
+	Path string
+	Rest []byte `ssh:"rest"`
+}
+
+type twoPathPacket struct {
+	ID      uint32 `sshtype:"18|20"`
+	Path    string
+	NewPath string
+}
+
+type extendedPacket struct {
+	ID   uint32 `sshtype:"200"`
+	Name string
+	Data []byte `ssh:"rest"`
+}
+
+type statusHead struct {
+	ID   uint32 `sshtype:"101"`
+	Code uint32
+}
+
+type handleReply struct {
+	ID     uint32 `sshtype:"102"`
+	Handle string
+}
+
+type dataHead struct {
+	ID     uint32 `sshtype:"103"`
+	Length uint32
+}
+
+// stream splits one direction of a sftp channel into packets. The head of
+// each packet, the part inspected, is held until complete, and the rest is
+// forwarded as it comes.
+type stream struct {
+	head []byte
+	body int
+}
+
+// feed consumes data, calling handle with each complete head, which it may
+// rewrite in place. It returns the data to forward and the change in the
+// number of bytes held, see ssh.PipedChannelData.Held.
+func (s *stream) feed(data []byte, headLen func(head []byte) int, handle func(head []byte) error) ([]byte, int, error) {
+	held := len(s.head)
+	out := make([]byte, 0, held+len(data))
+
+	for len(data) > 0 {
+		if s.body > 0 {
+			n := min(s.body, len(data))
+			out = append(out, data[:n]...)
+			s.body -= n
+			data = data[n:]
+			continue
+		}
+
+		want := 5
+		if len(s.head) >= 5 {
+			if want = s.want(headLen); want < 0 {
+				return nil, 0, errBadPacket
+			}
+		}
+
+		n := min(want-len(s.head), len(data))
+		s.head = append(s.head, data[:n]...)
+		data = data[n:]
+
+		if len(s.head) < 5 {
+			continue
+		}
+
+		// the length and type tell how much of the packet is needed
+		want = s.want(headLen)
+		if want < 0 {
+			return nil, 0, errBadPacket
+		}
+		if len(s.head) < want {
+			continue
+		}
+
+		if err := handle(s.head); err != nil {
+			return nil, 0, err
+		}
+
+		out = append(out, s.head...)
+		s.body = 4 + int(binary.BigEndian.Uint32(s.head)) - len(s.head)
+		s.head = s.head[:0]
+	}
+
+	return out, len(s.head) - held, nil
+}
+
+// want returns the length of the head of the packet, or -1 if the packet is
+// malformed.
+func (s *stream) want(headLen func(head []byte) int) int {
+	length := binary.BigEndian.Uint32(s.head)
+	if length == 0 {
+		return -1
+	}
+
+	n := headLen(s.head)
+	if total := 4 + int64(length); total < int64(n) {
+		n = int(total)
+	}
+	if n > maxHeadLen {
+		return -1
+	}
+
+	return max(n, len(s.head))
+}
+
+// requestHeadLen returns the length of the head of a request: the whole
+// packet, but the data of writes.
+func requestHeadLen(head []byte) int {
+	if head[4] != fxpWrite {
+		return math.MaxInt
+	}
+	if len(head) < 13 {
+		return 13
+	}
+	// id, handle, offset and the length of the data
+	return 13 + int(binary.BigEndian.Uint32(head[9:13])) + 12
+}
+
+// responseHeadLen returns the length of the head of a response, up to the
+// status code or the length of the data.
+func responseHeadLen(head []byte) int {
+	switch head[4] {
+	case fxpStatus, fxpData:
+		return 13
+	case fxpHandle:
+		return math.MaxInt
+	}
+	return 9
+}
+
+// deniedExtension is the name of the extended request denied requests are
+// rewritten to. Servers answer unknown extended requests with
+// SSH_FX_OP_UNSUPPORTED.
+const deniedExtension = "denied@sshpiper"
+
+// deny rewrites the request in head, keeping its length and id, into an
+// extended request unknown to the server.
+func deny(head []byte) {
+	head[4] = fxpExtended
+
+	// every request has at least one string after its id
+	n := min(len(head)-13, len(deniedExtension))
+	binary.BigEndian.PutUint32(head[9:13], uint32(n))
+	copy(head[13:], deniedExtension[:n])
+}
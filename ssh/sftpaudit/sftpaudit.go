@@ -0,0 +1,508 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+
+// Package sftpaudit inspects the SFTP sessions going through a ssh.PiperConn.
+// It decodes the SFTP v3 packets (draft-ietf-secsh-filexfer-02, and the
+// extensions of OpenSSH) of the channels running the "sftp" subsystem,
+// reports the operations as they complete, and denies the ones forbidden by
+// a policy.
+//
+// Only the "sftp" subsystem is inspected: a sftp server started with an exec
+// request is not, and should be refused by other means.
+package sftpaudit // import "golang.org/x/crypto/ssh/sftpaudit"
+
+import (
+	"encoding/binary"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Op is a SFTP operation.
+type Op string
+
+// Operations reported in events. Requests of the same kind share an
+// operation: OpStat covers SSH_FXP_STAT, SSH_FXP_LSTAT and SSH_FXP_FSTAT.
+const (
+	OpOpen     Op = "open"
+	OpClose    Op = "close"
+	OpRead     Op = "read"
+	OpWrite    Op = "write"
+	OpRemove   Op = "remove"
+	OpRename   Op = "rename"
+	OpMkdir    Op = "mkdir"
+	OpRmdir    Op = "rmdir"
+	OpOpendir  Op = "opendir"
+	OpReaddir  Op = "readdir"
+	OpStat     Op = "stat"
+	OpSetstat  Op = "setstat"
+	OpRealpath Op = "realpath"
+	OpReadlink Op = "readlink"
+	OpSymlink  Op = "symlink"
+	OpLink     Op = "link"
+
+	// OpExtended is an extended request not mapped to another operation.
+	OpExtended Op = "extended"
+)
+
+// Status codes of SSH_FXP_STATUS.
+const (
+	StatusOK               = 0
+	StatusEOF              = 1
+	StatusNoSuchFile       = 2
+	StatusPermissionDenied = 3
+	StatusFailure          = 4
+	StatusBadMessage       = 5
+	StatusNoConnection     = 6
+	StatusConnectionLost   = 7
+	StatusOpUnsupported    = 8
+)
+
+// Event is a SFTP operation, reported once answered.
+type Event struct {
+	// Channel is the session channel running the sftp subsystem.
+	Channel *ssh.PipedChannel
+
+	Op Op
+
+	// Extension is the name of an extended request, such as
+	// "posix-rename@openssh.com" for an OpRename.
+	Extension string
+
+	// Path is the path operated on, as sent by the client. For operations
+	// on a handle, it is the path the handle was opened with.
+	Path string
+
+	// NewPath is the second path of OpRename, OpLink and OpSymlink. Note
+	// that OpenSSH sends the paths of SSH_FXP_SYMLINK in reverse order.
+	NewPath string
+
+	// Flags holds the SSH_FXF_* flags of OpOpen.
+	Flags uint32
+
+	// Offset is the offset of OpRead and OpWrite.
+	Offset uint64
+
+	// Bytes is the number of bytes read by OpRead or written by OpWrite.
+	Bytes int
+
+	// Status is the status code answered, StatusOK for answers other than
+	// SSH_FXP_STATUS.
+	Status uint32
+
+	// Denied is set if the policy denied the operation.
+	Denied bool
+
+	handle string
+}
+
+// Config holds the callbacks and the policy of an Auditor.
+type Config struct {
+	// OnEvent, if non-nil, is called for each operation, once the server
+	// answered it or once it was denied. It is called from the piping
+	// goroutines and must not block.
+	OnEvent func(e *Event)
+
+	// DenyOps lists the operations answered with SSH_FX_PERMISSION_DENIED.
+	// Denying OpWrite also denies opening files for writing, appending,
+	// creating or truncating them.
+	DenyOps []Op
+
+	// DenyPaths lists the path prefixes whose operations are answered with
+	// SSH_FX_PERMISSION_DENIED. A prefix matches whole path elements: "/etc"
+	// matches "/etc" and "/etc/passwd", not "/etcetera". Symbolic links are
+	// not followed, so OpSymlink and OpLink are better denied as well.
+	// Extended requests whose paths are unknown are denied if DenyPaths is
+	// not empty.
+	DenyPaths []string
+
+	// Home is the directory relative paths are resolved against before
+	// matching DenyPaths, usually the home directory of the upstream user.
+	// If empty, "/" is used.
+	Home string
+}
+
+// extension describes the arguments of an extended request: its operation
+// and whether it is followed by a path, two paths or a handle.
+type extension struct {
+	op   Op
+	args string
+}
+
+var extensions = map[string]extension{
+	"posix-rename@openssh.com": {OpRename, "pp"},
+	"hardlink@openssh.com":     {OpLink, "pp"},
+	"statvfs@openssh.com":      {OpStat, "p"},
+	"fstatvfs@openssh.com":     {OpStat, "h"},
+	"lsetstat@openssh.com":     {OpSetstat, "p"},
+	"expand-path@openssh.com":  {OpRealpath, "p"},
+	"fsync@openssh.com":        {OpExtended, "h"},
+	"limits@openssh.com":       {OpExtended, ""},
+}
+
+// channel is the state of a sftp channel.
+type channel struct {
+	requests  stream
+	responses stream
+
+	// pending holds the requests awaiting their answer, by id, and handles
+	// the path of the open handles.
+	pending map[uint32]*Event
+	handles map[string]string
+}
+
+// Auditor inspects the sftp channels of piped connections. Install its hooks
+// with PiperConn.WaitWithMessageHooks. An Auditor may be shared by many
+// piped connections.
+type Auditor struct {
+	config Config
+
+	mu       sync.Mutex
+	channels map[*ssh.PipedChannel]*channel
+}
+
+// New returns an Auditor.
+func New(config Config) *Auditor {
+	prefixes := make([]string, len(config.DenyPaths))
+	for i, p := range config.DenyPaths {
+		prefixes[i] = path.Clean("/" + p)
+	}
+	config.DenyPaths = prefixes
+
+	return &Auditor{
+		config:   config,
+		channels: make(map[*ssh.PipedChannel]*channel),
+	}
+}
+
+// Hooks returns the message hooks feeding the auditor.
+func (a *Auditor) Hooks() *ssh.MessageHooks {
+	return &ssh.MessageHooks{
+		OnChannelRequest: a.onChannelRequest,
+		OnChannelData:    a.onChannelData,
+		OnChannelClose:   a.onChannelClose,
+	}
+}
+
+type subsystemRequest struct {
+	Name string
+}
+
+func (a *Auditor) onChannelRequest(dir ssh.PipeDirection, msg *ssh.PipedChannelRequest) (ssh.PipeVerdict, error) {
+	if dir != ssh.FromDownstream || msg.Type != "subsystem" || msg.Channel.ChanType != "session" {
+		return ssh.PipeForward, nil
+	}
+
+	var req subsystemRequest
+	if ssh.Unmarshal(msg.Payload, &req) != nil || req.Name != "sftp" {
+		return ssh.PipeForward, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.channels[msg.Channel] == nil {
+		a.channels[msg.Channel] = &channel{
+			pending: make(map[uint32]*Event),
+			handles: make(map[string]string),
+		}
+	}
+
+	return ssh.PipeForward, nil
+}
+
+func (a *Auditor) onChannelData(dir ssh.PipeDirection, msg *ssh.PipedChannelData) (ssh.PipeVerdict, error) {
+	if msg.DataType != 0 {
+		return ssh.PipeForward, nil
+	}
+
+	var events []*Event
+
+	a.mu.Lock()
+	c := a.channels[msg.Channel]
+	if c == nil {
+		a.mu.Unlock()
+		return ssh.PipeForward, nil
+	}
+
+	var out []byte
+	var held int
+	var err error
+	if dir == ssh.FromDownstream {
+		out, held, err = c.requests.feed(msg.Data, requestHeadLen, func(head []byte) error {
+			e, err := a.request(c, head)
+			if e != nil {
+				events = append(events, e)
+			}
+			return err
+		})
+	} else {
+		out, held, err = c.responses.feed(msg.Data, responseHeadLen, func(head []byte) error {
+			if e := c.response(head); e != nil {
+				events = append(events, e)
+			}
+			return nil
+		})
+	}
+	a.mu.Unlock()
+
+	if err != nil {
+		return ssh.PipeReject, err
+	}
+
+	msg.Data = out
+	msg.Held += held
+
+	if a.config.OnEvent != nil {
+		for _, e := range events {
+			e.Channel = msg.Channel
+			a.config.OnEvent(e)
+		}
+	}
+
+	return ssh.PipeForward, nil
+}
+
+func (a *Auditor) onChannelClose(ch *ssh.PipedChannel) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.channels, ch)
+}
+
+// request decodes the request in head and applies the policy. It returns
+// the event of a denied request, the others are reported once answered.
+func (a *Auditor) request(c *channel, head []byte) (*Event, error) {
+	e, err := c.decode(head)
+	if err != nil || e == nil {
+		return nil, err
+	}
+
+	id := binary.BigEndian.Uint32(head[5:9])
+	if !a.denied(e) {
+		c.pending[id] = e
+		return nil, nil
+	}
+
+	deny(head)
+	e.Denied = true
+	e.Status = StatusPermissionDenied
+
+	// the answer of the server is rewritten, but not reported
+	c.pending[id] = &Event{Denied: true}
+	return e, nil
+}
+
+// decode returns the event of the request in head, or nil if the request is
+// not an operation.
+func (c *channel) decode(head []byte) (*Event, error) {
+	var err error
+	var e *Event
+
+	switch head[4] {
+	case fxpInit:
+		var msg initPacket
+		if err = ssh.Unmarshal(head[4:], &msg); err == nil && msg.Version > 3 {
+			// only version 3 is understood
+			binary.BigEndian.PutUint32(head[5:9], 3)
+		}
+	case fxpOpen:
+		var msg openPacket
+		if err = ssh.Unmarshal(head[4:], &msg); err == nil {
+			e = &Event{Op: OpOpen, Path: msg.Path, Flags: msg.Pflags}
+		}
+	case fxpClose, fxpFstat, fxpFsetstat, fxpReaddir:
+		var msg handlePacket
+		if err = ssh.Unmarshal(head[4:], &msg); err == nil {
+			e = &Event{Op: handleOps[head[4]], Path: c.handles[msg.Handle], handle: msg.Handle}
+		}
+	case fxpRead:
+		var msg readPacket
+		if err = ssh.Unmarshal(head[4:], &msg); err == nil {
+			e = &Event{Op: OpRead, Path: c.handles[msg.Handle], Offset: msg.Offset}
+		}
+	case fxpWrite:
+		var msg writeHead
+		if err = ssh.Unmarshal(head[4:], &msg); err == nil {
+			e = &Event{Op: OpWrite, Path: c.handles[msg.Handle], Offset: msg.Offset, Bytes: int(msg.Length)}
+		}
+	case fxpLstat, fxpSetstat, fxpOpendir, fxpRemove, fxpMkdir, fxpRmdir, fxpRealpath, fxpStat, fxpReadlink:
+		var msg pathPacket
+		if err = ssh.Unmarshal(head[4:], &msg); err == nil {
+			e = &Event{Op: pathOps[head[4]], Path: msg.Path}
+		}
+	case fxpRename, fxpSymlink:
+		var msg twoPathPacket
+		if err = ssh.Unmarshal(head[4:], &msg); err == nil {
+			e = &Event{Op: OpRename, Path: msg.Path, NewPath: msg.NewPath}
+			if head[4] == fxpSymlink {
+				e.Op = OpSymlink
+			}
+		}
+	case fxpExtended:
+		var msg extendedPacket
+		if err = ssh.Unmarshal(head[4:], &msg); err == nil {
+			e, err = c.decodeExtended(msg.Name, msg.Data)
+		}
+	}
+
+	if err != nil {
+		return nil, errBadPacket
+	}
+	return e, nil
+}
+
+var handleOps = map[byte]Op{
+	fxpClose:    OpClose,
+	fxpFstat:    OpStat,
+	fxpFsetstat: OpSetstat,
+	fxpReaddir:  OpReaddir,
+}
+
+var pathOps = map[byte]Op{
+	fxpLstat:    OpStat,
+	fxpSetstat:  OpSetstat,
+	fxpOpendir:  OpOpendir,
+	fxpRemove:   OpRemove,
+	fxpMkdir:    OpMkdir,
+	fxpRmdir:    OpRmdir,
+	fxpRealpath: OpRealpath,
+	fxpStat:     OpStat,
+	fxpReadlink: OpReadlink,
+}
+
+func (c *channel) decodeExtended(name string, data []byte) (*Event, error) {
+	ext, ok := extensions[name]
+	if !ok {
+		return &Event{Op: OpExtended, Extension: name}, nil
+	}
+
+	e := &Event{Op: ext.op, Extension: name}
+	for _, arg := range ext.args {
+		s, rest, ok := parseString(data)
+		if !ok {
+			return nil, errBadPacket
+		}
+		data = rest
+
+		switch {
+		case arg == 'h':
+			e.Path = c.handles[string(s)]
+		case e.Path == "":
+			e.Path = string(s)
+		default:
+			e.NewPath = string(s)
+		}
+	}
+
+	return e, nil
+}
+
+func parseString(data []byte) (s, rest []byte, ok bool) {
+	if len(data) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(len(data)-4) < uint64(n) {
+		return nil, nil, false
+	}
+	return data[4 : 4+n], data[4+n:], true
+}
+
+// denied reports whether the policy denies e.
+func (a *Auditor) denied(e *Event) bool {
+	for _, op := range a.config.DenyOps {
+		if e.Op == op {
+			return true
+		}
+		if op == OpWrite && e.Op == OpOpen && e.Flags&(fxfWrite|fxfAppend|fxfCreat|fxfTrunc) != 0 {
+			return true
+		}
+	}
+
+	if len(a.config.DenyPaths) == 0 {
+		return false
+	}
+
+	if e.Op == OpExtended {
+		if _, ok := extensions[e.Extension]; !ok {
+			return true
+		}
+	}
+
+	for _, p := range []string{e.Path, e.NewPath} {
+		if p != "" && a.deniedPath(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *Auditor) deniedPath(p string) bool {
+	if !path.IsAbs(p) {
+		home := a.config.Home
+		if home == "" {
+			home = "/"
+		}
+		p = path.Join(home, p)
+	}
+	p = path.Clean("/" + p)
+
+	for _, prefix := range a.config.DenyPaths {
+		if prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// response decodes the answer in head, and returns the event of the request
+// it completes.
+func (c *channel) response(head []byte) *Event {
+	if len(head) < 9 || head[4] < fxpStatus {
+		return nil
+	}
+
+	id := binary.BigEndian.Uint32(head[5:9])
+	e := c.pending[id]
+	if e == nil {
+		return nil
+	}
+	delete(c.pending, id)
+
+	switch head[4] {
+	case fxpStatus:
+		var msg statusHead
+		if ssh.Unmarshal(head[4:], &msg) != nil {
+			break
+		}
+		if e.Denied {
+			binary.BigEndian.PutUint32(head[9:13], StatusPermissionDenied)
+			return nil
+		}
+		e.Status = msg.Code
+		if e.Op == OpClose {
+			delete(c.handles, e.handle)
+		}
+	case fxpHandle:
+		var msg handleReply
+		if ssh.Unmarshal(head[4:], &msg) == nil {
+			c.handles[msg.Handle] = e.Path
+		}
+	case fxpData:
+		var msg dataHead
+		if ssh.Unmarshal(head[4:], &msg) == nil {
+			e.Bytes = int(msg.Length)
+		}
+	}
+
+	if e.Denied {
+		return nil
+	}
+	return e
+}
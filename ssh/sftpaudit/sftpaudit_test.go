@@ -0,0 +1,295 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package sftpaudit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/testdata"
+)
+
+func netPipe(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	s, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+
+	return c, s
+}
+
+func hostKey(t *testing.T) ssh.Signer {
+	signer, err := ssh.ParsePrivateKey(testdata.PEMBytes["rsa"])
+	if err != nil {
+		t.Fatalf("ParsePrivateKey: %v", err)
+	}
+	return signer
+}
+
+// packet marshals a SFTP packet of the given type and fields.
+func packet(typ byte, fields ...interface{}) []byte {
+	b := []byte{0, 0, 0, 0, typ}
+	for _, f := range fields {
+		switch f := f.(type) {
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, f)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, f)
+		case string:
+			b = binary.BigEndian.AppendUint32(b, uint32(len(f)))
+			b = append(b, f...)
+		}
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+func readSFTPPacket(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeSlowly writes b one byte at a time, one channel data packet each.
+func writeSlowly(w io.Writer, b []byte) error {
+	for i := range b {
+		if _, err := w.Write(b[i : i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sftpServer runs an upstream answering the requests of its sftp subsystem,
+// and sends the type of each request it received on seen.
+func sftpServer(conn net.Conn, seen chan<- byte, t *testing.T) {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey(t))
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		t.Errorf("NewServerConn: %v", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newCh := range chans {
+		ch, in, err := newCh.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			return
+		}
+		go func() {
+			for req := range in {
+				req.Reply(req.Type == "subsystem", nil)
+			}
+		}()
+
+		go func() {
+			defer ch.Close()
+			for {
+				p, err := readSFTPPacket(ch)
+				if err != nil {
+					return
+				}
+				seen <- p[0]
+
+				id := binary.BigEndian.Uint32(p[1:5])
+				var reply []byte
+				switch p[0] {
+				case fxpInit:
+					reply = packet(2, id)
+				case fxpOpen:
+					reply = packet(fxpHandle, id, "h1")
+				case fxpRead:
+					reply = packet(fxpData, id, "hello")
+				case fxpWrite, fxpClose, fxpRemove:
+					reply = packet(fxpStatus, id, uint32(StatusOK), "", "")
+				default:
+					reply = packet(fxpStatus, id, uint32(StatusOpUnsupported), "unsupported", "")
+				}
+				if err := writeSlowly(ch, reply); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestAuditor(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+
+	auditor := New(Config{
+		OnEvent: func(e *Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, fmt.Sprintf("%s %s %s %d %d %v", e.Op, e.Path, e.NewPath, e.Bytes, e.Status, e.Denied))
+		},
+		DenyOps:   []Op{OpRemove},
+		DenyPaths: []string{"/secret"},
+		Home:      "/home/user",
+	})
+
+	seen := make(chan byte, 16)
+	piper := &ssh.PiperConfig{
+		NoClientAuthCallback: func(conn ssh.ConnMetadata, challengeCtx ssh.ChallengeContext) (*ssh.Upstream, error) {
+			c, s := netPipe(t)
+			go sftpServer(s, seen, t)
+			return &ssh.Upstream{
+				Conn: c,
+				ClientConfig: ssh.ClientConfig{
+					HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+				},
+			}, nil
+		},
+	}
+	piper.AddHostKey(hostKey(t))
+
+	c, s := netPipe(t)
+	go func() {
+		p, err := ssh.NewSSHPiperConn(s, piper)
+		if err != nil {
+			t.Errorf("NewSSHPiperConn: %v", err)
+			return
+		}
+		p.WaitWithMessageHooks(auditor.Hooks())
+	}()
+
+	sshc, chans, reqs, err := ssh.NewClientConn(c, "", &ssh.ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := ssh.NewClient(sshc, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		t.Fatalf("RequestSubsystem: %v", err)
+	}
+
+	for i, tt := range []struct {
+		request  []byte
+		want     []byte
+		upstream byte
+	}{
+		{packet(fxpInit, uint32(6)), packet(2, uint32(3)), fxpInit},
+		{packet(fxpOpen, uint32(1), "/data/f", uint32(fxfWrite|fxfCreat), uint32(0)), packet(fxpHandle, uint32(1), "h1"), fxpOpen},
+		{packet(fxpWrite, uint32(2), "h1", uint64(0), "payload"), packet(fxpStatus, uint32(2), uint32(StatusOK), "", ""), fxpWrite},
+		{packet(fxpRead, uint32(3), "h1", uint64(0), uint32(100)), packet(fxpData, uint32(3), "hello"), fxpRead},
+		{packet(fxpClose, uint32(4), "h1"), packet(fxpStatus, uint32(4), uint32(StatusOK), "", ""), fxpClose},
+		{packet(fxpRemove, uint32(5), "/data/f"), packet(fxpStatus, uint32(5), uint32(StatusPermissionDenied), "unsupported", ""), fxpExtended},
+		{packet(fxpOpen, uint32(6), "../../secret/f", uint32(1), uint32(0)), packet(fxpStatus, uint32(6), uint32(StatusPermissionDenied), "unsupported", ""), fxpExtended},
+		{packet(fxpRename, uint32(7), "/data/a", "/secret/b"), packet(fxpStatus, uint32(7), uint32(StatusPermissionDenied), "unsupported", ""), fxpExtended},
+		{packet(fxpExtended, uint32(8), "unknown@example.com"), packet(fxpStatus, uint32(8), uint32(StatusPermissionDenied), "unsupported", ""), fxpExtended},
+	} {
+		if err := writeSlowly(stdin, tt.request); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+
+		got, err := readSFTPPacket(stdout)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if !bytes.Equal(got, tt.want[4:]) {
+			t.Errorf("request %d: got answer %q, want %q", i, got, tt.want[4:])
+		}
+		if typ := <-seen; typ != tt.upstream {
+			t.Errorf("request %d: upstream got packet type %d, want %d", i, typ, tt.upstream)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{
+		"open /data/f  0 0 false",
+		"write /data/f  7 0 false",
+		"read /data/f  5 0 false",
+		"close /data/f  0 0 false",
+		"remove /data/f  0 3 true",
+		"open ../../secret/f  0 3 true",
+		"rename /data/a /secret/b 0 3 true",
+		"extended   0 3 true",
+	}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("got events\n%q\nwant\n%q", events, want)
+	}
+}
+
+func TestStreamFeed(t *testing.T) {
+	data := append(packet(fxpWrite, uint32(1), "handle", uint64(0), "some data"), packet(fxpStat, uint32(2), "/path")...)
+
+	for split := 1; split < len(data); split++ {
+		var s stream
+		var heads [][]byte
+		var out []byte
+		held := 0
+
+		for start := 0; start < len(data); start += split {
+			b, n, err := s.feed(data[start:min(start+split, len(data))], requestHeadLen, func(head []byte) error {
+				heads = append(heads, append([]byte(nil), head...))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("split %d: %v", split, err)
+			}
+			out = append(out, b...)
+			held += n
+		}
+
+		if !bytes.Equal(out, data) || held != 0 {
+			t.Fatalf("split %d: got %q holding %d, want the data back", split, out, held)
+		}
+		// the data of the write is not part of its head
+		if len(heads) != 2 || len(heads[0]) != 4+1+4+10+8+4 || !bytes.Equal(heads[1], data[len(data)-len(heads[1]):]) {
+			t.Fatalf("split %d: got heads %q", split, heads)
+		}
+	}
+
+	var s stream
+	if _, _, err := s.feed([]byte{0, 0, 0, 0, fxpStat}, requestHeadLen, nil); err == nil {
+		t.Error("accepted an empty packet")
+	}
+}
@@ -5,9 +5,14 @@
 package ssh
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Upstream struct {
@@ -16,6 +21,45 @@ type Upstream struct {
 	Address string
 
 	ClientConfig
+
+	// DialFunc, if non-nil, is called to connect to the upstream when Conn is nil.
+	// If both are nil, Address is dialed over tcp, bounded by ClientConfig.Timeout.
+	DialFunc func(ctx context.Context) (net.Conn, error)
+
+	// HandshakeTimeout, if non-zero, bounds the handshake and the authentication with the upstream.
+	HandshakeTimeout time.Duration
+
+	// Fallbacks are the upstreams tried in order when this upstream cannot be connected,
+	// its handshake fails or it rejects the authentication.
+	Fallbacks []*Upstream
+
+	// DownstreamAgentAuth, if non-nil, defers the upstream authentication until the downstream is
+	// authenticated with the piper and requested agent forwarding on its first session, which the
+	// piper confirms itself. The piper then opens an auth-agent@openssh.com channel to the downstream
+	// and authenticates with the upstream using the AuthMethods returned for that channel, see
+	// agent.UpstreamAuth. The downstream must request forwarding before any request of the session
+	// waiting for a reply, as OpenSSH does. If it does not, or the upstream authentication fails, the
+	// downstream is disconnected.
+	DownstreamAgentAuth func(agent io.ReadWriter) ([]AuthMethod, error)
+
+	// Certificate, if non-nil, authenticates with the upstream with a user certificate issued for
+	// the downstream, which must authenticate with a publickey. Like DownstreamAgentAuth, it defers
+	// the upstream authentication until the downstream is authenticated.
+	Certificate *UpstreamCertificate
+
+	// Pool, if non-nil, shares the connection to the upstream with the other downstreams mapped to
+	// the same Address, User and PoolIdentity, see UpstreamPool.
+	Pool *UpstreamPool
+
+	// PoolIdentity names the credentials the upstream is authenticated with. Downstreams given the same
+	// PoolIdentity share a connection without authenticating with the upstream again, so it must only be
+	// set once the downstream was verified to be entitled to these credentials. If empty, the upstream
+	// is not pooled.
+	PoolIdentity string
+
+	// ProxyProtocol, if 1 or 2, sends a PROXY protocol header of that version to the upstream, carrying
+	// the addresses of the downstream, before the SSH version. Such upstreams are never pooled.
+	ProxyProtocol int
 }
 
 type ChallengeContext interface {
@@ -27,6 +71,8 @@ type ChallengeContext interface {
 // PiperConfig holds SSHPiper specific configuration data.
 // PiperConfig represents the configuration for the SSH piper.
 type PiperConfig struct {
+	// Config configures the connection with the downstream, e.g. its RekeyThreshold. The connections
+	// with the upstreams are configured by the Config of Upstream.ClientConfig.
 	Config
 
 	// PublicKeyAuthAlgorithms specifies the supported client public key
@@ -38,11 +84,23 @@ type PiperConfig struct {
 
 	hostKeys []Signer
 
+	// HostKeysCallback, if non-nil, is called once the downstream sent its version, before the key
+	// exchange, and returns the host keys of its connection, such as the ones of the tenant the
+	// downstream reached by its address or PROXY header. Only the version and addresses of conn are
+	// known. If it returns no keys, the keys added with AddHostKey are used. An error closes the
+	// connection.
+	HostKeysCallback func(conn ConnMetadata) ([]Signer, error)
+
 	// CreateChallengeContext, if non-nil, that creates a challenge context for the connection metadata.
 	CreateChallengeContext func(conn ConnMetadata) (ChallengeContext, error)
 
 	// NextAuthMethods, if non-nil, that returns the next authentication methods to be used.
-	NextAuthMethods func(conn ConnMetadata, challengeCtx ChallengeContext) ([]string, error)
+	// satisfied holds the methods accepted so far with ErrPartialSuccess, in order.
+	NextAuthMethods func(conn ConnMetadata, satisfied []string, challengeCtx ChallengeContext) ([]string, error)
+
+	// The authentication callbacks below return the upstream of the downstream, or ErrPartialSuccess
+	// to accept the attempt as one step of a multi-step authentication. The downstream then continues
+	// with the methods returned by NextAuthMethods.
 
 	// NoClientAuthCallback, if non-nil, that is called when the downstream requests a none auth.
 	NoClientAuthCallback func(conn ConnMetadata, challengeCtx ChallengeContext) (*Upstream, error)
@@ -59,6 +117,20 @@ type PiperConfig struct {
 	// It returns the upstream connection and an error.
 	KeyboardInteractiveCallback func(conn ConnMetadata, client KeyboardInteractiveChallenge, challengeCtx ChallengeContext) (*Upstream, error)
 
+	// HostbasedCallback, if non-nil, that is called when the downstream requests a hostbased auth, once the
+	// signature made with the host key of the client host was verified. clientHost is the name the client
+	// claims for its host and clientUser the user on the client host, see ServerConfig.HostbasedCallback.
+	HostbasedCallback func(conn ConnMetadata, clientHost, clientUser string, key PublicKey, challengeCtx ChallengeContext) (*Upstream, error)
+
+	// GSSAPIWithMICCallback, if non-nil together with GSSAPIServer, that is called when the downstream
+	// authenticated with gssapi-with-mic (RFC 4462 section 3). srcName is the name established by
+	// GSS-API, username@DOMAIN for Kerberos V5, which the callback maps to conn.User() and an upstream.
+	GSSAPIWithMICCallback func(conn ConnMetadata, srcName string, challengeCtx ChallengeContext) (*Upstream, error)
+
+	// GSSAPIServer returns the GSS-API acceptor of a downstream, such as a Kerberos keytab. It is called
+	// once per downstream, as a GSSAPIServer holds the security context being established.
+	GSSAPIServer func(conn ConnMetadata) GSSAPIServer
+
 	// UpstreamAuthFailureCallback, if non-nil, that is called when the upstream authentication fails.
 	UpstreamAuthFailureCallback func(conn ConnMetadata, method string, err error, challengeCtx ChallengeContext)
 
@@ -67,9 +139,89 @@ type PiperConfig struct {
 	// Note that RFC 4253 section 4.2 requires that this string start with "SSH-2.0-".
 	ServerVersion string
 
+	// ProxyProtocol, if true, requires the downstreams to start with a PROXY protocol header, version 1
+	// or 2, sent by a trusted proxy or load balancer. RemoteAddr and LocalAddr of the ConnMetadata of the
+	// downstream then return the addresses of the header.
+	ProxyProtocol bool
+
 	// BannerCallback, if non-nil, that is called after key exchange completed but before authentication.
 	// It returns the banner string to be sent to the client.
 	BannerCallback func(conn ConnMetadata, challengeCtx ChallengeContext) string
+
+	// HandshakeTimeout, if non-zero, bounds the version exchange and the first key exchange with the downstream.
+	// NewSSHPiperConn fails with ErrHandshakeTimeout once it is exceeded.
+	HandshakeTimeout time.Duration
+
+	// AuthTimeout, if non-zero, bounds the authentication of the downstream, including connecting to
+	// and authenticating with the upstream. NewSSHPiperConn fails with ErrAuthTimeout once it is exceeded.
+	AuthTimeout time.Duration
+
+	// ChannelOpenPolicyCallback, if non-nil, is called for each channel opened on the piped connection.
+	// Returning an error rejects the channel open on behalf of the other side, which never sees it.
+	// An *OpenChannelError sets the rejection reason and message, other errors reject with Prohibited.
+	ChannelOpenPolicyCallback func(conn ConnMetadata, dir PipeDirection, chanType string, extraData []byte, challengeCtx ChallengeContext) error
+
+	// RequestPolicyCallback, if non-nil, is called for each global and channel request on the piped connection.
+	// ch is nil for global requests. Returning an error rejects the request on behalf of the other side,
+	// which never sees it.
+	RequestPolicyCallback func(conn ConnMetadata, dir PipeDirection, ch *PipedChannel, reqType string, payload []byte, challengeCtx ChallengeContext) error
+
+	// CommandPolicyCallback, if non-nil, is called once the downstream is authenticated, and returns the
+	// restrictions on the programs it runs in session channels. A nil policy leaves the downstream
+	// unrestricted. See CommandPolicy.
+	CommandPolicyCallback func(conn ConnMetadata, challengeCtx ChallengeContext) *CommandPolicy
+
+	// Observer, if non-nil, receives the lifecycle events of the piped connections, see PiperEvent.
+	Observer PiperObserver
+
+	// TrafficInterval is how often the TrafficEvents of a piped connection are emitted while piping,
+	// besides when it ends. If zero, 10 seconds is used.
+	TrafficInterval time.Duration
+
+	// RekeyCallback, if non-nil, is called after each key exchange following the first one, on either
+	// side, with the newly negotiated algorithms. It is called from the goroutine of the key exchange
+	// and must not block.
+	RekeyCallback func(conn ConnMetadata, side PipeDirection, algs NegotiatedAlgorithms, challengeCtx ChallengeContext)
+
+	// IdleTimeout, if non-zero, ends the piped connection once no channel data was piped in either direction
+	// for that long. Wait then returns ErrIdleTimeout.
+	IdleTimeout time.Duration
+
+	// MaxSessionDuration, if non-zero, ends the piped connection that long after piping started, whatever
+	// its activity. Wait then returns ErrMaxSessionDuration.
+	MaxSessionDuration time.Duration
+
+	// KeepaliveInterval, if non-zero, probes both sides that often with keepalive@openssh.com global
+	// requests, like the ServerAliveInterval of OpenSSH. Once a side left KeepaliveCountMax probes
+	// unanswered, the piped connection ends and Wait returns a *PipeError of ErrKeepaliveTimeout.
+	KeepaliveInterval time.Duration
+
+	// KeepaliveCountMax is the number of unanswered probes ending the piped connection. If zero, 3 is used.
+	KeepaliveCountMax int
+
+	// KeepalivePing, if true, probes with ping@openssh.com, answered by the transport, instead of global
+	// requests. Only the upstreams advertising ping@openssh.com in their SSH_MSG_EXT_INFO are probed
+	// with it; the downstreams, which are not offered to send one, and the pooled upstreams are still
+	// probed with global requests.
+	KeepalivePing bool
+
+	// RateLimits limits the channel data piped in each direction by all the connections of this config
+	// together. Its limiters may be shared with other configs, and changed while connections are piped.
+	RateLimits RateLimits
+
+	// ConnRateLimitsCallback, if non-nil, is called once the downstream is authenticated, and returns the
+	// limits of its connection, applied on top of RateLimits. See PiperConn.SetRateLimits.
+	ConnRateLimitsCallback func(conn ConnMetadata, challengeCtx ChallengeContext) RateLimits
+
+	// ShutdownWarning, if non-empty, is written by PiperConn.Shutdown to the stderr of the open sessions
+	// of the downstream before draining them. It is skipped on the sessions whose window is too small to
+	// hold it. The data the upstream then sends is held back until the downstream grants the window again.
+	ShutdownWarning string
+
+	// ShutdownReason and ShutdownMessage are sent in the SSH_MSG_DISCONNECT of PiperConn.Shutdown.
+	// If zero, ShutdownReason is 11, SSH_DISCONNECT_BY_APPLICATION.
+	ShutdownReason  uint32
+	ShutdownMessage string
 }
 
 // AddHostKey adds a private key as a SSHPiper host key. If an existing host
@@ -86,7 +238,76 @@ func (s *PiperConfig) AddHostKey(key Signer) {
 	s.hostKeys = append(s.hostKeys, key)
 }
 
-type upstream struct{ *connection }
+// timeoutError is a timeout of the piper. It satisfies net.Error.
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+var (
+	// ErrHandshakeTimeout is returned when the downstream handshake exceeds PiperConfig.HandshakeTimeout.
+	ErrHandshakeTimeout error = &timeoutError{"ssh: downstream handshake timed out"}
+
+	// ErrAuthTimeout is returned when the authentication exceeds PiperConfig.AuthTimeout.
+	ErrAuthTimeout error = &timeoutError{"ssh: authentication timed out"}
+
+	// ErrUpstreamHandshakeTimeout is returned when connecting to an upstream exceeds Upstream.HandshakeTimeout.
+	ErrUpstreamHandshakeTimeout error = &timeoutError{"ssh: upstream handshake timed out"}
+
+	// ErrIdleTimeout is returned by Wait when no channel data was piped for PiperConfig.IdleTimeout.
+	ErrIdleTimeout error = &timeoutError{"ssh: piped connection idle"}
+
+	// ErrMaxSessionDuration is returned by Wait when the piped connection lasted PiperConfig.MaxSessionDuration.
+	ErrMaxSessionDuration error = &timeoutError{"ssh: piped connection reached its maximum duration"}
+
+	// ErrKeepaliveTimeout is returned by Wait, in a *PipeError, when a side left PiperConfig.KeepaliveCountMax
+	// keepalive probes unanswered.
+	ErrKeepaliveTimeout error = &timeoutError{"ssh: keepalive timed out"}
+)
+
+// withTimeoutCause is like context.WithTimeoutCause, but a zero timeout
+// leaves the deadline of ctx alone.
+func withTimeoutCause(ctx context.Context, timeout time.Duration, cause error) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, cause)
+}
+
+// aLongTimeAgo is a deadline in the past, used to interrupt blocked I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// interruptOnDone interrupts the reads and writes of conn once ctx is done.
+// The returned stop function reports false if conn was interrupted,
+// otherwise it clears the deadline of conn again.
+func interruptOnDone(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return true }
+	}
+
+	stopInterrupt := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+
+	return func() bool {
+		if !stopInterrupt() {
+			return false
+		}
+		conn.SetDeadline(time.Time{})
+		return true
+	}
+}
+
+type upstream struct {
+	*connection
+
+	// extensions are those the upstream sent in its SSH_MSG_EXT_INFO.
+	extensions map[string][]byte
+}
+
 type downstream struct{ *connection }
 
 // PiperConn is a piped SSH connection, linking upstream ssh server and
@@ -97,50 +318,288 @@ type PiperConn struct {
 	upstream   *upstream
 	downstream *downstream
 
+	// upstreamConn carries the packets of the upstream, the transport of
+	// upstream or, if it is pooled, the share of the downstream.
+	upstreamConn packetConn
+
 	config         *PiperConfig
 	authOnlyConfig *ServerConfig
 	challengeCtx   ChallengeContext
+
+	// authCtx bounds connecting to upstreams during the authentication.
+	authCtx context.Context
+
+	events *piperEvents
+
+	// mu guards pipe, set once Wait started piping, and ended.
+	mu   sync.Mutex
+	pipe *messagePipe
+
+	// ended is the error ending the piped connection on behalf of the
+	// piper, such as ErrIdleTimeout, returned by Wait.
+	ended error
+
+	shutdown atomic.Bool
+
+	// deferred is the upstream authentication run once the downstream is
+	// authenticated, as it needs the agent or the verified key of the downstream.
+	deferred *upstreamAuth
+
+	// deferredKeys maps the permissions returned for a publickey to its
+	// deferred authentication, as the server only calls back once per key.
+	deferredKeys map[*Permissions]*upstreamAuth
+
+	// satisfied holds the methods accepted with ErrPartialSuccess.
+	satisfied []string
+
+	// gssapiServer is the acceptor of the downstream, created once
+	// gssapi-with-mic is offered.
+	gssapiServer GSSAPIServer
+
+	// pendingDownstream holds the packets the downstream sent while the
+	// deferred upstream was authenticated, to be piped first.
+	pendingDownstream packetQueue
+
+	// heldSession, if non-nil, is the downstream connection piped once the
+	// piper confirmed the first session itself, see waitAgentForwarding.
+	heldSession *heldSessionConn
+
+	// rateLimits holds the limiters of this connection, see SetRateLimits.
+	rateLimits [2]atomic.Pointer[RateLimiter]
+
+	// commandPolicy is the policy returned by CommandPolicyCallback.
+	commandPolicy *CommandPolicy
+}
+
+// ErrShutdown is returned by Wait once Shutdown ended the piped connection.
+var ErrShutdown = errors.New("ssh: piped connection shut down")
+
+// PipeError is returned by Wait when a side ended the piped connection.
+type PipeError struct {
+	// Side is the side whose packets could no longer be read or piped first.
+	Side PipeDirection
+	Err  error
+}
+
+func (e *PipeError) Error() string {
+	return fmt.Sprintf("ssh: %v ended the piped connection: %v", e.Side, e.Err)
+}
+
+func (e *PipeError) Unwrap() error {
+	return e.Err
 }
 
 // Wait blocks until the piped connection has shut down, and returns the
-// error causing the shutdown.
+// error causing the shutdown, a *PipeError or ErrShutdown.
 func (p *PiperConn) Wait() error {
 	return p.WaitWithHook(nil, nil)
 }
 
 func (p *PiperConn) WaitWithHook(uphook, downhook func(msg []byte) ([]byte, error)) error {
-	c := make(chan error, 2)
+	return p.wait(uphook, downhook, nil)
+}
 
-	if downhook != nil {
-		go func() {
-			c <- pipingWithHook(p.upstream.transport, p.downstream.transport, downhook)
-		}()
-	} else {
-		go func() {
-			c <- piping(p.upstream.transport, p.downstream.transport)
-		}()
+// WaitWithMessageHooks is like Wait, but runs the connection layer messages
+// through the given typed hooks in order.
+func (p *PiperConn) WaitWithMessageHooks(hooks ...*MessageHooks) error {
+	return p.wait(nil, nil, hooks)
+}
+
+func (p *PiperConn) wait(uphook, downhook func(msg []byte) ([]byte, error), hooks []*MessageHooks) error {
+	type result struct {
+		side PipeDirection
+		err  error
 	}
+	c := make(chan result, 2)
 
-	if uphook != nil {
-		go func() {
-			c <- pipingWithHook(p.downstream.transport, p.upstream.transport, uphook)
-		}()
-	} else {
-		go func() {
-			c <- piping(p.downstream.transport, p.upstream.transport)
-		}()
+	hooks = append([]*MessageHooks{p.policyHooks(), p.commandPolicyHooks()}, hooks...)
+
+	var downstream packetConn = p.downstream.transport
+	switch {
+	case p.heldSession != nil:
+		downstream = p.heldSession
+	case len(p.pendingDownstream.packets) > 0:
+		downstream = &queuedPacketConn{downstream, p.pendingDownstream.packets}
+		p.pendingDownstream = packetQueue{}
 	}
 
-	defer p.Close()
+	m := newMessagePipe(downstream, p.upstreamConn, hooks)
+	m.throttle = p.throttle
+	m.trackIdle = p.config.IdleTimeout > 0
+	m.trackWindow = p.config.ShutdownWarning != ""
+	// probes with global requests need their replies told apart
+	m.hasGlobal = m.hasGlobal || (p.config.KeepaliveInterval > 0 && (!p.probeWithPing(FromDownstream) || !p.probeWithPing(FromUpstream)))
+
+	p.mu.Lock()
+	p.pipe = m
+	p.mu.Unlock()
+
+	go func() {
+		err := piping(FromDownstream, p.events.observe(FromDownstream, downstream), downhook, m)
+		c <- result{FromDownstream, err}
+	}()
+
+	go func() {
+		err := piping(FromUpstream, p.events.observe(FromUpstream, p.upstreamConn), uphook, m)
+		c <- result{FromUpstream, err}
+	}()
+
+	if p.config.IdleTimeout > 0 || p.config.MaxSessionDuration > 0 || p.config.KeepaliveInterval > 0 {
+		go p.watchdog(m)
+	}
+
+	if p.events.observer != nil {
+		interval := p.config.TrafficInterval
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		go p.events.reportTraffic(interval, m.done)
+	}
 
 	// wait until either connection closed
-	return <-c
+	r := <-c
+	close(m.done)
+	p.Close()
+
+	err := error(&PipeError{r.side, r.err})
+	p.mu.Lock()
+	if p.ended != nil {
+		err = p.ended
+	}
+	p.mu.Unlock()
+	if p.shutdown.Load() {
+		err = ErrShutdown
+	}
+	// transports return the SSH_MSG_DISCONNECT they read as an error
+	var disconnect *disconnectMsg
+	errors.As(r.err, &disconnect)
+	p.events.closed(r.side, err, disconnect)
+
+	return err
+}
+
+// policyHooks returns the hooks enforcing the policy callbacks of the config,
+// or nil if there is nothing to enforce.
+func (p *PiperConn) policyHooks() *MessageHooks {
+	if p.config.ChannelOpenPolicyCallback == nil && p.config.RequestPolicyCallback == nil {
+		return nil
+	}
+
+	hooks := &MessageHooks{}
+
+	if p.config.ChannelOpenPolicyCallback != nil {
+		hooks.OnChannelOpen = func(dir PipeDirection, msg *PipedChannelOpen) (PipeVerdict, error) {
+			err := p.config.ChannelOpenPolicyCallback(p.downstream, dir, msg.ChanType, msg.ExtraData, p.challengeCtx)
+			if err == nil {
+				return PipeForward, nil
+			}
+
+			msg.Reason = Prohibited
+			msg.Message = err.Error()
+
+			var openErr *OpenChannelError
+			if errors.As(err, &openErr) {
+				msg.Reason = openErr.Reason
+				msg.Message = openErr.Message
+			}
+
+			return PipeReject, nil
+		}
+	}
+
+	if p.config.RequestPolicyCallback != nil {
+		hooks.OnChannelRequest = func(dir PipeDirection, msg *PipedChannelRequest) (PipeVerdict, error) {
+			if err := p.config.RequestPolicyCallback(p.downstream, dir, msg.Channel, msg.Type, msg.Payload, p.challengeCtx); err != nil {
+				return PipeReject, nil
+			}
+			return PipeForward, nil
+		}
+
+		hooks.OnGlobalRequest = func(dir PipeDirection, msg *PipedGlobalRequest) (PipeVerdict, error) {
+			if err := p.config.RequestPolicyCallback(p.downstream, dir, nil, msg.Type, msg.Payload, p.challengeCtx); err != nil {
+				return PipeReject, nil
+			}
+			return PipeForward, nil
+		}
+	}
+
+	return hooks
 }
 
 // Close the piped connection create by SSHPiper
 func (p *PiperConn) Close() {
-	p.upstream.transport.Close()
-	p.downstream.transport.Close()
+	p.upstreamConn.Close()
+	if p.heldSession != nil {
+		p.heldSession.Close()
+	} else {
+		p.downstream.transport.Close()
+	}
+}
+
+// Shutdown gracefully ends the piped connection. It writes ShutdownWarning of the
+// PiperConfig to the open sessions of the downstream, refuses new channels and waits
+// for the open channels to be closed, or ctx to be done. It then sends SSH_MSG_DISCONNECT
+// to both sides and closes them. Wait returns ErrShutdown.
+//
+// Shutdown returns the error of ctx if channels were still open.
+func (p *PiperConn) Shutdown(ctx context.Context) error {
+	p.shutdown.Store(true)
+
+	p.mu.Lock()
+	m := p.pipe
+	p.mu.Unlock()
+
+	var err error
+	if m != nil {
+		// the channels left once piping ended are never closed
+		select {
+		case <-m.drain(p.config.ShutdownWarning):
+		case <-m.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	reason := p.config.ShutdownReason
+	if reason == 0 {
+		reason = 11 // SSH_DISCONNECT_BY_APPLICATION
+	}
+
+	p.downstream.transport.writePacket(Marshal(&disconnectMsg{
+		Reason:  reason,
+		Message: p.config.ShutdownMessage,
+	}))
+	p.upstreamConn.writePacket(Marshal(&disconnectMsg{
+		Reason:  11, // SSH_DISCONNECT_BY_APPLICATION
+		Message: "piper shutting down",
+	}))
+	p.Close()
+
+	return err
+}
+
+// RequestRekey starts a key exchange with side, independently of the other side. It does not wait
+// for the key exchange to complete, which RekeyCallback of the PiperConfig reports. The upstream of a
+// pooled connection is shared with other downstreams and cannot be rekeyed by one of them; its rekeys
+// are reported to all the downstreams sharing it.
+func (p *PiperConn) RequestRekey(side PipeDirection) error {
+	t := p.downstream.transport
+	if side == FromUpstream {
+		if _, ok := p.upstreamConn.(*pooledConn); ok {
+			return errors.New("ssh: the upstream of a pooled connection cannot be rekeyed")
+		}
+		t = p.upstream.transport
+	}
+
+	t.mu.Lock()
+	err := t.writeError
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	t.requestKeyExchange()
+	return nil
 }
 
 // UpstreamConnMeta returns the ConnMetadata of the piper and upstream
@@ -163,43 +622,293 @@ func (p *PiperConn) mapToUpstreamViaDownstreamAuth() error {
 		return err
 	}
 
-	if _, err := p.downstream.serverAuthenticate(p.authOnlyConfig); err != nil {
+	perms, err := p.downstream.serverAuthenticate(p.authOnlyConfig)
+	if err != nil {
 		return err
 	}
 
+	if a, ok := p.deferredKeys[perms]; ok {
+		p.deferred = a
+	}
+
 	return nil
 }
 
-func (p *PiperConn) authUpstream(downstream ConnMetadata, method string, upstream *Upstream) error {
+// upstreamAuth is an authentication with an upstream on behalf of the downstream.
+type upstreamAuth struct {
+	upstream *Upstream
+	method   string
+
+	// key is the publickey the downstream authenticated with.
+	key PublicKey
+
+	// agent is the agent forwarded by the downstream.
+	agent io.ReadWriter
+}
+
+func (p *PiperConn) authUpstream(downstream ConnMetadata, method string, key PublicKey, upstream *Upstream) error {
 	if upstream == nil {
 		p.updateAuthMethods()
 		return fmt.Errorf("empty upstream") // here mean ignore this auth method, and the authmedthod may write something to chanllage context
 	}
 
-	if upstream.User == "" {
-		upstream.User = downstream.User()
+	p.events.emit(&UpstreamSelectedEvent{
+		Method:   method,
+		Upstream: upstream,
+	})
+
+	a := &upstreamAuth{
+		upstream: upstream,
+		method:   method,
+		key:      key,
 	}
 
-	config := &upstream.ClientConfig
-	addr := upstream.Address
+	p.deferred = nil
+	if needsDeferredAuth(upstream) {
+		// authenticated once the downstream is, see authDeferredUpstream
+		if p.upstream != nil {
+			p.upstreamConn.Close()
+			p.upstream = nil
+			p.upstreamConn = nil
+		}
+		p.deferred = a
+		return nil
+	}
 
-	u, err := newUpstream(upstream.Conn, addr, config)
-	if err != nil {
+	if err := p.connectUpstreams(downstream, a); err != nil {
+		p.updateAuthMethods()
 		return err
 	}
 
-	if err := u.clientAuthenticateReturnAllowed(config); err != nil {
+	return nil
+}
+
+// needsDeferredAuth reports whether any candidate of upstream can only be
+// authenticated with once the downstream is authenticated.
+func needsDeferredAuth(upstream *Upstream) bool {
+	for _, u := range append([]*Upstream{upstream}, upstream.Fallbacks...) {
+		if u.DownstreamAgentAuth != nil || u.Certificate != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authDeferredUpstream authenticates with the deferred upstream, over the
+// agent forwarded by the downstream if needed. On failure the downstream is
+// disconnected, as it was already told it is authenticated.
+func (p *PiperConn) authDeferredUpstream() error {
+	a := p.deferred
+
+	var err error
+	if needsDownstreamAgent(a.upstream) {
+		var held *heldSessionConn
+		var agent *downstreamChannel
+		held, err = waitAgentForwarding(p.downstream.transport, &p.pendingDownstream)
+		if err == nil {
+			agent, err = openDownstreamChannel(p.downstream.transport, agentChannelType, &p.pendingDownstream)
+		}
+		if err == nil {
+			a.agent = agent
+			err = p.connectUpstreams(p.downstream, a)
+			if cerr := agent.Close(); err == nil {
+				err = cerr
+			}
+		} else if p.config.UpstreamAuthFailureCallback != nil {
+			p.config.UpstreamAuthFailureCallback(p.downstream, a.method, err, p.challengeCtx)
+		}
+
+		if err == nil {
+			held.packetConn = &queuedPacketConn{p.downstream.transport, p.pendingDownstream.packets}
+			p.pendingDownstream = packetQueue{}
+			p.heldSession = held
+		}
+	} else {
+		err = p.connectUpstreams(p.downstream, a)
+	}
+
+	if err != nil {
+		p.downstream.transport.writePacket(Marshal(&disconnectMsg{
+			Reason:  11, // SSH_DISCONNECT_BY_APPLICATION
+			Message: "upstream authentication failed",
+		}))
+		p.downstream.transport.Close()
+
+		if p.upstream != nil {
+			p.upstreamConn.Close()
+		}
+	}
+
+	return err
+}
+
+// connectUpstreams connects to the first candidate of the upstream and its fallbacks which accepts the authentication.
+func (p *PiperConn) connectUpstreams(downstream ConnMetadata, a *upstreamAuth) error {
+	var errs []error
+	for _, candidate := range append([]*Upstream{a.upstream}, a.upstream.Fallbacks...) {
+		var algs NegotiatedAlgorithms
+		start := time.Now()
+		u, conn, err := p.connectUpstream(downstream, candidate, a, &algs)
+
+		event := &UpstreamHandshakeEvent{
+			Upstream:   candidate,
+			Algorithms: p.events.algorithms(&algs),
+			Duration:   time.Since(start),
+			Err:        err,
+		}
+		if u != nil {
+			event.ServerVersion = string(u.serverVersion)
+		}
+		p.events.emit(event)
+
+		if err == nil {
+			if p.upstream != nil {
+				p.upstreamConn.Close()
+			}
+			p.upstream = u
+			p.upstreamConn = conn
+			return nil
+		}
+
 		if p.config.UpstreamAuthFailureCallback != nil {
-			p.config.UpstreamAuthFailureCallback(downstream, method, err, p.challengeCtx)
+			p.config.UpstreamAuthFailureCallback(downstream, a.method, err, p.challengeCtx)
 		}
-		p.updateAuthMethods()
-		return err
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return errors.Join(errs...)
+}
+
+// connectUpstream connects, handshakes and authenticates with a single upstream candidate,
+// or joins its pooled connection. The algorithms of the first key exchange are stored in algs.
+func (p *PiperConn) connectUpstream(downstream ConnMetadata, upstream *Upstream, a *upstreamAuth, algs *NegotiatedAlgorithms) (*upstream, packetConn, error) {
+	// the user of the downstream is set on a copy, as the Upstream, such as
+	// a fallback, may be shared with other connections
+	if upstream.User == "" {
+		copied := *upstream
+		copied.User = downstream.User()
+		upstream = &copied
+	}
+
+	kex := p.events.kexCallback(FromUpstream, algs)
+	dialKex := kex
+
+	key, pooled := upstream.poolKey()
+	var shared *pooledUpstream
+	if pooled {
+		if u, conn := upstream.Pool.join(key, kex); conn != nil {
+			return u, conn, nil
+		}
+
+		// the connection outlives the downstream dialing it
+		shared = upstream.Pool.newUpstream(key)
+		dialKex = shared.kexCallback(kex)
+	}
+
+	u, err := p.dialUpstream(downstream, upstream, a, dialKex)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if pooled {
+		return u, upstream.Pool.add(shared, u, kex), nil
+	}
+
+	return u, u.transport, nil
+}
+
+// dialUpstream connects, handshakes and authenticates with a single upstream candidate, reporting
+// its key exchanges to kex.
+func (p *PiperConn) dialUpstream(downstream ConnMetadata, upstream *Upstream, a *upstreamAuth, kex func(NegotiatedAlgorithms, bool)) (*upstream, error) {
+	// the credentials of the downstream are added to a copy, as the Upstream
+	// may be shared with other connections
+	if upstream.DownstreamAgentAuth != nil || upstream.Certificate != nil {
+		copied := *upstream
+		upstream = &copied
+	}
+
+	if upstream.DownstreamAgentAuth != nil {
+		if a.agent == nil {
+			return nil, errNoDownstreamAgent
+		}
+
+		auth, err := upstream.DownstreamAgentAuth(a.agent)
+		if err != nil {
+			return nil, err
+		}
+		upstream.Auth = auth
+	}
+
+	if upstream.Certificate != nil {
+		signer, err := upstream.Certificate.newSigner(downstream, a.key, upstream.User)
+		if err != nil {
+			return nil, err
+		}
+		upstream.Auth = append([]AuthMethod{PublicKeys(signer)}, upstream.Auth...)
+	}
+
+	ctx, cancel := withTimeoutCause(p.authCtx, upstream.HandshakeTimeout, ErrUpstreamHandshakeTimeout)
+	defer cancel()
+
+	c := upstream.Conn
+	if c == nil {
+		var err error
+		switch {
+		case upstream.DialFunc != nil:
+			c, err = upstream.DialFunc(ctx)
+		case upstream.Address != "":
+			d := net.Dialer{Timeout: upstream.Timeout}
+			c, err = d.DialContext(ctx, "tcp", upstream.Address)
+		default:
+			err = errors.New("ssh: upstream has neither a connection nor an address")
+		}
+		if ctx.Err() != nil {
+			if c != nil {
+				c.Close()
+			}
+			return nil, context.Cause(ctx)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stop := interruptOnDone(ctx, c)
+	config := upstream.ClientConfig
+	config.kexCallback = kex
+
+	if upstream.ProxyProtocol != 0 {
+		if err := writeProxyHeader(c, upstream.ProxyProtocol, downstream); err != nil {
+			if !stop() {
+				return nil, context.Cause(ctx)
+			}
+			return nil, err
+		}
+	}
+
+	u, err := newUpstream(c, upstream.Address, &config)
+	if err == nil {
+		if err = u.clientAuthenticateReturnAllowed(&config); err != nil {
+			u.transport.Close()
+		}
+	}
+
+	if !stop() {
+		c.Close()
+		return nil, context.Cause(ctx)
+	}
+
+	if err != nil {
+		return nil, err
 	}
 
 	u.user = config.User
-	p.upstream = u
 
-	return nil
+	return u, nil
 }
 
 func (p *PiperConn) noClientAuthCallback(conn ConnMetadata) (*Permissions, error) {
@@ -209,7 +918,7 @@ func (p *PiperConn) noClientAuthCallback(conn ConnMetadata) (*Permissions, error
 		return nil, err
 	}
 
-	return nil, p.authUpstream(conn, "none", u)
+	return nil, p.authUpstream(conn, "none", nil, u)
 }
 
 func (p *PiperConn) passwordCallback(conn ConnMetadata, password []byte) (*Permissions, error) {
@@ -219,7 +928,7 @@ func (p *PiperConn) passwordCallback(conn ConnMetadata, password []byte) (*Permi
 		return nil, err
 	}
 
-	return nil, p.authUpstream(conn, "password", u)
+	return nil, p.authUpstream(conn, "password", nil, u)
 }
 
 func (p *PiperConn) publicKeyCallback(conn ConnMetadata, key PublicKey) (*Permissions, error) {
@@ -229,7 +938,19 @@ func (p *PiperConn) publicKeyCallback(conn ConnMetadata, key PublicKey) (*Permis
 		return nil, err
 	}
 
-	return nil, p.authUpstream(conn, "publickey", u)
+	if err := p.authUpstream(conn, "publickey", key, u); err != nil {
+		return nil, err
+	}
+
+	if p.deferred == nil {
+		return nil, nil
+	}
+
+	// the server calls back once per key, so the deferred authentication
+	// is looked up by the permissions of the key it eventually verifies
+	perms := &Permissions{}
+	p.deferredKeys[perms] = p.deferred
+	return perms, nil
 }
 
 func (p *PiperConn) keyboardInteractiveCallback(conn ConnMetadata, client KeyboardInteractiveChallenge) (*Permissions, error) {
@@ -239,7 +960,39 @@ func (p *PiperConn) keyboardInteractiveCallback(conn ConnMetadata, client Keyboa
 		return nil, err
 	}
 
-	return nil, p.authUpstream(conn, "keyboard-interactive", u)
+	return nil, p.authUpstream(conn, "keyboard-interactive", nil, u)
+}
+
+func (p *PiperConn) hostbasedCallback(conn ConnMetadata, clientHost, clientUser string, key PublicKey) (*Permissions, error) {
+	u, err := p.config.HostbasedCallback(conn, clientHost, clientUser, key, p.challengeCtx)
+	if err != nil {
+		p.updateAuthMethods()
+		return nil, err
+	}
+
+	return nil, p.authUpstream(conn, "hostbased", nil, u)
+}
+
+func (p *PiperConn) gssapiWithMICCallback(conn ConnMetadata, srcName string) (*Permissions, error) {
+	u, err := p.config.GSSAPIWithMICCallback(conn, srcName, p.challengeCtx)
+	if err != nil {
+		p.updateAuthMethods()
+		return nil, err
+	}
+
+	return nil, p.authUpstream(conn, "gssapi-with-mic", nil, u)
+}
+
+// partialSuccess records a step of a multi-step authentication accepted by a
+// callback, and updates the methods for the next step.
+func (p *PiperConn) partialSuccess(conn ConnMetadata, method string, key PublicKey) {
+	p.satisfied = append(p.satisfied, method)
+
+	if progress, ok := p.challengeCtx.(authProgress); ok {
+		progress.satisfied(conn, method, key)
+	}
+
+	p.updateAuthMethods()
 }
 
 func (p *PiperConn) bannerCallback(conn ConnMetadata) string {
@@ -247,19 +1000,22 @@ func (p *PiperConn) bannerCallback(conn ConnMetadata) string {
 }
 
 func (p *PiperConn) updateAuthMethods() error {
-	authMethods := []string{"none", "password", "publickey", "keyboard-interactive"}
+	authMethods := []string{"none", "password", "publickey", "keyboard-interactive", "hostbased", "gssapi-with-mic"}
 	if p.config.NextAuthMethods != nil {
 		var err error
-		authMethods, err = p.config.NextAuthMethods(p.downstream, p.challengeCtx)
+		authMethods, err = p.config.NextAuthMethods(p.downstream, p.satisfied, p.challengeCtx)
 		if err != nil {
 			return err
 		}
 	}
 
+	p.authOnlyConfig.NoClientAuth = false
 	p.authOnlyConfig.NoClientAuthCallback = nil
 	p.authOnlyConfig.PasswordCallback = nil
 	p.authOnlyConfig.PublicKeyCallback = nil
 	p.authOnlyConfig.KeyboardInteractiveCallback = nil
+	p.authOnlyConfig.HostbasedCallback = nil
+	p.authOnlyConfig.GSSAPIWithMICConfig = nil
 
 	for _, authMethod := range authMethods {
 		switch authMethod {
@@ -280,6 +1036,22 @@ func (p *PiperConn) updateAuthMethods() error {
 			if p.config.KeyboardInteractiveCallback != nil {
 				p.authOnlyConfig.KeyboardInteractiveCallback = p.keyboardInteractiveCallback
 			}
+		case "hostbased":
+			if p.config.HostbasedCallback != nil {
+				p.authOnlyConfig.HostbasedCallback = p.hostbasedCallback
+			}
+		case "gssapi-with-mic":
+			if p.config.GSSAPIWithMICCallback != nil && p.config.GSSAPIServer != nil {
+				if p.gssapiServer == nil {
+					p.gssapiServer = p.config.GSSAPIServer(p.downstream)
+				}
+				if p.gssapiServer != nil {
+					p.authOnlyConfig.GSSAPIWithMICConfig = &GSSAPIWithMICConfig{
+						AllowLogin: p.gssapiWithMICCallback,
+						Server:     p.gssapiServer,
+					}
+				}
+			}
 		}
 	}
 
@@ -290,16 +1062,55 @@ func (p *PiperConn) updateAuthMethods() error {
 // It handshake with downstream ssh client and upstream ssh server provicde by FindUpstream.
 // If either handshake is unsuccessful, the whole piped connection will be closed.
 func NewSSHPiperConn(conn net.Conn, config *PiperConfig) (*PiperConn, error) {
-	d, err := newDownstream(conn, &ServerConfig{
+	return NewSSHPiperConnContext(context.Background(), conn, config)
+}
+
+// NewSSHPiperConnContext is like NewSSHPiperConn, but gives up once ctx is done. Reads and writes
+// blocked on the downstream or on an upstream are interrupted, and context.Cause(ctx) is returned.
+// Once the piped connection is established, ctx has no effect.
+func NewSSHPiperConnContext(ctx context.Context, conn net.Conn, config *PiperConfig) (*PiperConn, error) {
+	events := &piperEvents{
+		observer:      config.Observer,
+		start:         time.Now(),
+		rekeyCallback: config.RekeyCallback,
+	}
+
+	handshakeCtx, cancel := withTimeoutCause(ctx, config.HandshakeTimeout, ErrHandshakeTimeout)
+	defer cancel()
+
+	var algs NegotiatedAlgorithms
+	serverConfig := &ServerConfig{
 		Config:                  config.Config,
 		hostKeys:                config.hostKeys,
 		ServerVersion:           config.ServerVersion,
 		PublicKeyAuthAlgorithms: config.PublicKeyAuthAlgorithms,
-	})
+		ProxyProtocol:           config.ProxyProtocol,
+		hostKeysCallback:        config.HostKeysCallback,
+	}
+	serverConfig.kexCallback = events.kexCallback(FromDownstream, &algs)
+
+	stop := interruptOnDone(handshakeCtx, conn)
+	d, err := newDownstream(conn, serverConfig)
+	if !stop() {
+		conn.Close()
+		return nil, context.Cause(handshakeCtx)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	events.mu.Lock()
+	events.conn = d
+	events.mu.Unlock()
+
+	events.emit(&DownstreamHandshakeEvent{
+		ClientVersion: string(d.clientVersion),
+		Algorithms:    events.algorithms(&algs),
+	})
+
+	authCtx, cancel := withTimeoutCause(ctx, config.AuthTimeout, ErrAuthTimeout)
+	defer cancel()
+
 	p := &PiperConn{
 		downstream: d,
 		config:     config,
@@ -307,6 +1118,19 @@ func NewSSHPiperConn(conn net.Conn, config *PiperConfig) (*PiperConn, error) {
 			MaxAuthTries:            -1,
 			PublicKeyAuthAlgorithms: supportedPubKeyAuthAlgos,
 		},
+		authCtx:      authCtx,
+		events:       events,
+		deferredKeys: make(map[*Permissions]*upstreamAuth),
+	}
+	p.authOnlyConfig.partialSuccessCallback = p.partialSuccess
+
+	if config.Observer != nil {
+		p.authOnlyConfig.AuthLogCallback = func(conn ConnMetadata, method string, err error) {
+			events.emit(&AuthAttemptEvent{
+				Method: method,
+				Err:    err,
+			})
+		}
 	}
 
 	if config.CreateChallengeContext != nil {
@@ -315,51 +1139,65 @@ func NewSSHPiperConn(conn net.Conn, config *PiperConfig) (*PiperConn, error) {
 			return nil, err
 		}
 		p.challengeCtx = ctx
+
+		events.mu.Lock()
+		events.challengeCtx = ctx
+		events.mu.Unlock()
 	}
 
 	if config.BannerCallback != nil {
 		p.authOnlyConfig.BannerCallback = p.bannerCallback
 	}
 
-	if err := p.mapToUpstreamViaDownstreamAuth(); err != nil {
+	stop = interruptOnDone(authCtx, conn)
+	err = p.mapToUpstreamViaDownstreamAuth()
+	if err == nil && p.deferred != nil {
+		err = p.authDeferredUpstream()
+	}
+	if !stop() {
+		conn.Close()
+		if p.upstream != nil {
+			p.upstreamConn.Close()
+		}
+		return nil, context.Cause(authCtx)
+	}
+	if err != nil {
 		return nil, err
 	}
 
-	return p, nil
-}
-
-func piping(dst, src packetConn) error {
-	for {
-		p, err := src.readPacket()
-		if err != nil {
-			return err
-		}
+	if config.ConnRateLimitsCallback != nil {
+		p.SetRateLimits(config.ConnRateLimitsCallback(d, p.challengeCtx))
+	}
 
-		err = dst.writePacket(p)
-		if err != nil {
-			return err
-		}
+	if config.CommandPolicyCallback != nil {
+		p.commandPolicy = config.CommandPolicyCallback(d, p.challengeCtx)
 	}
+
+	return p, nil
 }
 
-func pipingWithHook(dst, src packetConn, hook func(msg []byte) ([]byte, error)) error {
+// piping reads the packets of dir from src, runs them through hook and m, which
+// forwards them to the other side.
+func piping(dir PipeDirection, src packetConn, hook func(msg []byte) ([]byte, error), m *messagePipe) error {
 	for {
 		p, err := src.readPacket()
 		if err != nil {
 			return err
 		}
 
-		p, err = hook(p)
-		if err != nil {
-			return err
+		if hook != nil {
+			p, err = hook(p)
+			if err != nil {
+				return err
+			}
 		}
 
-		if p == nil {
+		// dropped by the hook
+		if len(p) == 0 {
 			continue
 		}
 
-		err = dst.writePacket(p)
-		if err != nil {
+		if err := m.handle(dir, p); err != nil {
 			return err
 		}
 	}
@@ -420,10 +1258,10 @@ func newUpstream(c net.Conn, addr string, config *ClientConfig) (*upstream, erro
 
 	if err := conn.clientHandshakeNoAuth(addr, &fullConf); err != nil {
 		c.Close()
-		return nil, fmt.Errorf("ssh: handshake failed: %v", err)
+		return nil, fmt.Errorf("ssh: handshake failed: %w", err)
 	}
 
-	return &upstream{conn}, nil
+	return &upstream{connection: conn}, nil
 }
 
 func (c *connection) clientHandshakeNoAuth(dialAddress string, config *ClientConfig) error {
@@ -451,7 +1289,7 @@ func (c *connection) clientHandshakeNoAuth(dialAddress string, config *ClientCon
 }
 
 func (c *connection) serverHandshakeNoAuth(config *ServerConfig) (*Permissions, error) {
-	if len(config.hostKeys) == 0 {
+	if len(config.hostKeys) == 0 && config.hostKeysCallback == nil {
 		return nil, errors.New("ssh: server has no host keys")
 	}
 
@@ -461,11 +1299,33 @@ func (c *connection) serverHandshakeNoAuth(config *ServerConfig) (*Permissions,
 	} else {
 		c.serverVersion = []byte("SSH-2.0-SSHPiper")
 	}
+
+	if config.ProxyProtocol {
+		if c.sshConn.conn, err = readProxyHeader(c.sshConn.conn); err != nil {
+			return nil, err
+		}
+	}
+
 	c.clientVersion, err = exchangeVersions(c.sshConn.conn, c.serverVersion)
 	if err != nil {
 		return nil, err
 	}
 
+	if config.hostKeysCallback != nil {
+		keys, err := config.hostKeysCallback(c)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(keys) > 0 {
+			perConn := *config
+			perConn.hostKeys = keys
+			config = &perConn
+		} else if len(config.hostKeys) == 0 {
+			return nil, errors.New("ssh: server has no host keys")
+		}
+	}
+
 	tr := newTransport(c.sshConn.conn, config.Rand, false /* not client */)
 	c.transport = newServerTransport(tr, c.clientVersion, c.serverVersion, config)
 
@@ -506,7 +1366,7 @@ func (e NoMoreMethodsErr) Error() string {
 	return fmt.Sprintf("ssh: unable to authenticate, attempted methods %v, no supported methods remain, allowed methods %v", e.Tried, e.Allowed)
 }
 
-func (c *connection) clientAuthenticateReturnAllowed(config *ClientConfig) error {
+func (c *upstream) clientAuthenticateReturnAllowed(config *ClientConfig) error {
 	// initiate user auth session
 	if err := c.transport.writePacket(Marshal(&serviceRequestMsg{serviceUserAuth})); err != nil {
 		return err
@@ -542,6 +1402,8 @@ func (c *connection) clientAuthenticateReturnAllowed(config *ClientConfig) error
 			return err
 		}
 	}
+	c.extensions = extensions
+
 	var serviceAccept serviceAcceptMsg
 	if err := Unmarshal(packet, &serviceAccept); err != nil {
 		return err
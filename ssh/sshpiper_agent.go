@@ -0,0 +1,500 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	agentChannelType = "auth-agent@openssh.com"
+	agentRequestType = "auth-agent-req@openssh.com"
+)
+
+// downstreamChannel is a minimal channel opened by the piper to the
+// downstream once it is authenticated, but before the connection is piped.
+// Packets unrelated to the channel are queued, to be piped to the upstream
+// later. The channel must be closed before piping starts, so its number can
+// never collide with the channel numbers of the upstream.
+type downstreamChannel struct {
+	t     packetConn
+	queue *packetQueue
+
+	localID  uint32
+	remoteID uint32
+
+	remoteWindow uint32
+	maxPacket    uint32
+
+	// window is what the downstream may still send, buf what it sent and
+	// was not read yet. The window is only granted back as buf is read.
+	window uint32
+
+	confirmed bool
+	eof       bool
+	closed    bool
+	buf       []byte
+}
+
+func openDownstreamChannel(t packetConn, chanType string, queue *packetQueue) (*downstreamChannel, error) {
+	ch := &downstreamChannel{
+		t:      t,
+		queue:  queue,
+		window: channelWindowSize,
+	}
+
+	if err := t.writePacket(Marshal(&channelOpenMsg{
+		ChanType:      chanType,
+		PeersID:       ch.localID,
+		PeersWindow:   channelWindowSize,
+		MaxPacketSize: channelMaxPacket,
+	})); err != nil {
+		return nil, err
+	}
+
+	for !ch.confirmed {
+		if err := ch.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	return ch, nil
+}
+
+// next reads and handles one packet from the downstream.
+func (ch *downstreamChannel) next() error {
+	packet, err := ch.t.readPacket()
+	if err != nil {
+		return err
+	}
+
+	switch packet[0] {
+	case msgChannelOpenConfirm, msgChannelOpenFailure, msgChannelData, msgChannelExtendedData,
+		msgChannelWindowAdjust, msgChannelRequest, msgChannelEOF, msgChannelClose:
+		if len(packet) >= 5 && binary.BigEndian.Uint32(packet[1:5]) == ch.localID {
+			return ch.handle(packet)
+		}
+	}
+
+	return ch.queue.push(packet)
+}
+
+func (ch *downstreamChannel) handle(packet []byte) error {
+	msg, err := decode(packet)
+	if err != nil {
+		return err
+	}
+
+	switch msg := msg.(type) {
+	case *channelOpenConfirmMsg:
+		ch.confirmed = true
+		ch.remoteID = msg.MyID
+		ch.remoteWindow = msg.MyWindow
+		ch.maxPacket = msg.MaxPacketSize
+		if ch.maxPacket == 0 {
+			ch.maxPacket = channelMaxPacket
+		}
+	case *channelOpenFailureMsg:
+		return &OpenChannelError{msg.Reason, msg.Message}
+	case *channelDataMsg:
+		if len(msg.Rest) > int(ch.window) {
+			return errors.New("ssh: downstream exceeded the window of the agent channel")
+		}
+		ch.window -= uint32(len(msg.Rest))
+		ch.buf = append(ch.buf, msg.Rest...)
+	case *windowAdjustMsg:
+		ch.remoteWindow += msg.AdditionalBytes
+	case *channelRequestMsg:
+		if msg.WantReply {
+			return ch.t.writePacket(Marshal(&channelRequestFailureMsg{
+				PeersID: ch.remoteID,
+			}))
+		}
+	case *channelEOFMsg:
+		ch.eof = true
+	case *channelCloseMsg:
+		ch.eof = true
+		ch.closed = true
+	}
+
+	return nil
+}
+
+func (ch *downstreamChannel) Read(b []byte) (int, error) {
+	for len(ch.buf) == 0 {
+		if ch.eof {
+			return 0, io.EOF
+		}
+
+		if err := ch.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, ch.buf)
+	ch.buf = ch.buf[n:]
+
+	ch.window += uint32(n)
+	if err := ch.t.writePacket(Marshal(&windowAdjustMsg{
+		PeersID:         ch.remoteID,
+		AdditionalBytes: uint32(n),
+	})); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
+
+func (ch *downstreamChannel) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		for ch.remoteWindow == 0 {
+			if ch.closed {
+				return written, io.EOF
+			}
+
+			if err := ch.next(); err != nil {
+				return written, err
+			}
+		}
+
+		n := len(b)
+		if n > int(ch.remoteWindow) {
+			n = int(ch.remoteWindow)
+		}
+		if n > int(ch.maxPacket) {
+			n = int(ch.maxPacket)
+		}
+
+		var peersID [4]byte
+		binary.BigEndian.PutUint32(peersID[:], ch.remoteID)
+		if err := ch.t.writePacket(marshalChannelData(peersID[:], 0, b[:n])); err != nil {
+			return written, err
+		}
+
+		ch.remoteWindow -= uint32(n)
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// Close closes the channel and waits for the downstream to do the same.
+func (ch *downstreamChannel) Close() error {
+	if err := ch.t.writePacket(Marshal(&channelCloseMsg{
+		PeersID: ch.remoteID,
+	})); err != nil {
+		return err
+	}
+
+	for !ch.closed {
+		if err := ch.next(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const (
+	// maxQueuedPackets and maxQueuedBytes bound the packets a downstream
+	// may send before its upstream is connected.
+	maxQueuedPackets = 1024
+	maxQueuedBytes   = 1 << 20
+)
+
+// errQueueFull is returned if a downstream sent too many packets before its
+// upstream is connected.
+var errQueueFull = errors.New("ssh: too many packets queued for the upstream")
+
+// packetQueue holds the packets read from the downstream before the
+// upstream is connected.
+type packetQueue struct {
+	packets [][]byte
+	size    int
+}
+
+func (q *packetQueue) push(packet []byte) error {
+	if len(q.packets) >= maxQueuedPackets || q.size+len(packet) > maxQueuedBytes {
+		return errQueueFull
+	}
+
+	q.packets = append(q.packets, packet)
+	q.size += len(packet)
+	return nil
+}
+
+// queuedPacketConn reads the queued packets before the ones of the wrapped
+// packetConn.
+type queuedPacketConn struct {
+	packetConn
+	queue [][]byte
+}
+
+func (q *queuedPacketConn) readPacket() ([]byte, error) {
+	if len(q.queue) > 0 {
+		p := q.queue[0]
+		q.queue = q.queue[1:]
+		return p, nil
+	}
+
+	return q.packetConn.readPacket()
+}
+
+// heldChannelID is the channel number the piper gives to the session it
+// confirms itself, see waitAgentForwarding. Upstreams allocate small channel
+// numbers, which are never expected to reach it.
+const heldChannelID = math.MaxUint32
+
+// errHeldChannelID is returned if the upstream uses heldChannelID as well.
+var errHeldChannelID = errors.New("ssh: upstream channel number collides with the held session")
+
+// waitAgentForwarding reads the packets of the downstream, queueing them,
+// until it requests agent forwarding on its first session channel. As
+// requests are only sent on confirmed channels, the piper confirms that
+// session itself, with an empty window, before the upstream is connected. The
+// returned heldSessionConn hands the session over to the upstream once piped.
+//
+// Forwarding was not requested if the session starts a program first, or the
+// downstream sends data or closes the session. Other requests, such as
+// x11-req, are queued too, and answered by the upstream once piped.
+func waitAgentForwarding(t packetConn, queue *packetQueue) (*heldSessionConn, error) {
+	var held *heldSessionConn
+
+	for {
+		packet, err := t.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if err := queue.push(packet); err != nil {
+			return nil, err
+		}
+
+		switch packet[0] {
+		case msgChannelOpen:
+			var msg channelOpenMsg
+			if err := Unmarshal(packet, &msg); err != nil {
+				return nil, err
+			}
+			if held != nil || msg.ChanType != "session" {
+				continue
+			}
+
+			held = &heldSessionConn{
+				packetConn: t,
+				downID:     msg.PeersID,
+			}
+			held.cond = sync.NewCond(&held.mu)
+
+			if err := t.writePacket(Marshal(&channelOpenConfirmMsg{
+				PeersID:       msg.PeersID,
+				MyID:          heldChannelID,
+				MyWindow:      0,
+				MaxPacketSize: channelMaxPacket,
+			})); err != nil {
+				return nil, err
+			}
+
+		case msgChannelRequest:
+			var msg channelRequestMsg
+			if err := Unmarshal(packet, &msg); err != nil {
+				return nil, err
+			}
+			if held == nil || msg.PeersID != heldChannelID {
+				continue
+			}
+
+			switch {
+			case msg.Request == agentRequestType:
+				return held, nil
+			case msg.Request == "exec", msg.Request == "shell", msg.Request == "subsystem":
+				return nil, errNoDownstreamAgent
+			}
+
+		case msgChannelData, msgChannelExtendedData, msgChannelEOF, msgChannelClose:
+			if held != nil && len(packet) >= 5 && binary.BigEndian.Uint32(packet[1:5]) == heldChannelID {
+				return nil, errNoDownstreamAgent
+			}
+		}
+	}
+}
+
+// heldSessionConn is the downstream packetConn of a piped connection whose
+// first session was confirmed by the piper, see waitAgentForwarding. The
+// queued open of the session is piped to the upstream like any other: the
+// confirmation of the upstream is then replaced by a window adjust granting
+// its window, and the packets of the downstream to the session are addressed
+// to the channel number of the upstream, and split to its packet size.
+type heldSessionConn struct {
+	packetConn
+
+	// downID is the channel number of the session on the downstream.
+	downID uint32
+
+	// mu guards the answer of the upstream to the open of the session.
+	mu        sync.Mutex
+	cond      *sync.Cond
+	opened    bool
+	failed    bool
+	upID      uint32
+	maxPacket uint32
+
+	// split holds the rest of a data packet of the downstream split to the
+	// packet size of the upstream.
+	split [][]byte
+}
+
+func (c *heldSessionConn) readPacket() ([]byte, error) {
+	for {
+		if len(c.split) > 0 {
+			p := c.split[0]
+			c.split = c.split[1:]
+			return p, nil
+		}
+
+		packet, err := c.packetConn.readPacket()
+		if err != nil {
+			return nil, err
+		}
+
+		switch packet[0] {
+		case msgChannelWindowAdjust, msgChannelData, msgChannelExtendedData,
+			msgChannelEOF, msgChannelClose, msgChannelRequest, msgChannelSuccess, msgChannelFailure:
+			if len(packet) < 5 || binary.BigEndian.Uint32(packet[1:5]) != heldChannelID {
+				return packet, nil
+			}
+		default:
+			return packet, nil
+		}
+
+		c.mu.Lock()
+		for !c.opened && !c.failed {
+			c.cond.Wait()
+		}
+		opened, upID, maxPacket := c.opened, c.upID, c.maxPacket
+		c.mu.Unlock()
+
+		if !opened {
+			// the piper closed the session, see writePacket
+			continue
+		}
+
+		binary.BigEndian.PutUint32(packet[1:5], upID)
+		if packet[0] != msgChannelData && packet[0] != msgChannelExtendedData {
+			return packet, nil
+		}
+
+		headerLen := 9
+		var dataType uint32
+		if packet[0] == msgChannelExtendedData {
+			headerLen = 13
+			if len(packet) >= 9 {
+				dataType = binary.BigEndian.Uint32(packet[5:9])
+			}
+		}
+		if maxPacket == 0 || len(packet) <= headerLen || len(packet)-headerLen <= int(maxPacket) {
+			return packet, nil
+		}
+
+		for data := packet[headerLen:]; len(data) > 0; {
+			n := int(min(maxPacket, len(data)))
+			c.split = append(c.split, marshalChannelData(packet[1:5], dataType, data[:n]))
+			data = data[n:]
+		}
+	}
+}
+
+func (c *heldSessionConn) writePacket(packet []byte) error {
+	switch packet[0] {
+	case msgChannelOpen:
+		var msg channelOpenMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return err
+		}
+		if msg.PeersID == heldChannelID {
+			return errHeldChannelID
+		}
+
+	case msgChannelOpenConfirm:
+		var msg channelOpenConfirmMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return err
+		}
+		if msg.MyID == heldChannelID {
+			return errHeldChannelID
+		}
+
+		c.mu.Lock()
+		answer := msg.PeersID == c.downID && !c.opened && !c.failed
+		if answer {
+			c.opened = true
+			c.upID = msg.MyID
+			c.maxPacket = msg.MaxPacketSize
+		}
+		c.mu.Unlock()
+
+		if answer {
+			c.cond.Broadcast()
+			if msg.MyWindow == 0 {
+				return nil
+			}
+			return c.packetConn.writePacket(Marshal(&windowAdjustMsg{
+				PeersID:         c.downID,
+				AdditionalBytes: msg.MyWindow,
+			}))
+		}
+
+	case msgChannelOpenFailure:
+		var msg channelOpenFailureMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		answer := msg.PeersID == c.downID && !c.opened && !c.failed
+		c.failed = c.failed || answer
+		c.mu.Unlock()
+
+		if answer {
+			// the downstream was told the session is open
+			c.cond.Broadcast()
+			return c.packetConn.writePacket(Marshal(&channelCloseMsg{
+				PeersID: c.downID,
+			}))
+		}
+	}
+
+	return c.packetConn.writePacket(packet)
+}
+
+// Close closes the connection, and releases the reads waiting for the
+// upstream to answer the open of the session.
+func (c *heldSessionConn) Close() error {
+	c.mu.Lock()
+	c.failed = !c.opened
+	c.mu.Unlock()
+	c.cond.Broadcast()
+
+	return c.packetConn.Close()
+}
+
+// needsDownstreamAgent reports whether any candidate of upstream
+// authenticates with the agent of the downstream.
+func needsDownstreamAgent(upstream *Upstream) bool {
+	for _, u := range append([]*Upstream{upstream}, upstream.Fallbacks...) {
+		if u.DownstreamAgentAuth != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+var errNoDownstreamAgent = errors.New("ssh: downstream agent not available")
@@ -0,0 +1,131 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// UpstreamCertificate issues OpenSSH user certificates, one per downstream
+// authenticated with a publickey, to authenticate with the upstream.
+//
+// The piper cannot sign with the key of the downstream, so the certificate
+// certifies a key generated for the connection instead. It is bound to the
+// downstream by its principal, the upstream user, and by its key ID, which
+// holds the downstream user, address and the SHA256 fingerprint of the key the
+// downstream authenticated with. sshd logs the key ID of accepted certificates.
+type UpstreamCertificate struct {
+	// Authority signs the certificates. The upstream must trust it, e.g.
+	// with TrustedUserCAKeys in sshd_config.
+	Authority Signer
+
+	// Lifetime is how long the certificates are valid. If zero, 5 minutes
+	// is used.
+	Lifetime time.Duration
+
+	// Permissions holds the critical options and extensions of the
+	// certificates. If nil, the extensions granted by ssh-keygen by default
+	// are used.
+	Permissions *Permissions
+}
+
+// clockSkew backdates the certificates, so upstreams with a clock slightly
+// behind still accept them.
+const clockSkew = time.Minute
+
+var errNoVerifiedKey = errors.New("ssh: upstream certificate requires a downstream publickey authentication")
+
+// newSigner generates a key and certifies it for principal on behalf of
+// the downstream authenticated with key.
+func (c *UpstreamCertificate) newSigner(downstream ConnMetadata, key PublicKey, principal string) (Signer, error) {
+	if key == nil {
+		return nil, errNoVerifiedKey
+	}
+
+	if c.Authority == nil {
+		return nil, errors.New("ssh: upstream certificate has no authority")
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	certKey, err := NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+
+	lifetime := c.Lifetime
+	if lifetime == 0 {
+		lifetime = 5 * time.Minute
+	}
+
+	perms := Permissions{
+		Extensions: map[string]string{
+			"permit-X11-forwarding":   "",
+			"permit-agent-forwarding": "",
+			"permit-port-forwarding":  "",
+			"permit-pty":              "",
+			"permit-user-rc":          "",
+		},
+	}
+	if c.Permissions != nil {
+		perms = *c.Permissions
+	}
+
+	now := time.Now()
+	cert := &Certificate{
+		Key:             certKey,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        UserCert,
+		KeyId:           fmt.Sprintf("%s@%s %s", downstream.User(), downstream.RemoteAddr(), FingerprintSHA256(key)),
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(now.Add(-clockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(lifetime).Unix()),
+		Permissions:     perms,
+	}
+
+	if err := cert.SignCert(rand.Reader, c.Authority); err != nil {
+		return nil, err
+	}
+
+	return NewCertSigner(cert, signer)
+}
+
+// AddHostCertificate adds a host certificate and its private key as SSHPiper
+// host keys, so the downstreams trusting the authority of cert, e.g. with a
+// @cert-authority line in known_hosts, can verify the piper. The plain key is
+// added as well, for the downstreams which do not use certificates. As with
+// AddHostKey, keys of the same algorithm are overwritten.
+func (s *PiperConfig) AddHostCertificate(cert *Certificate, key Signer) error {
+	if cert.CertType != HostCert {
+		return fmt.Errorf("ssh: certificate has type %d, want a host certificate", cert.CertType)
+	}
+
+	signer, err := NewCertSigner(cert, key)
+	if err != nil {
+		return err
+	}
+
+	s.AddHostKey(signer)
+	s.AddHostKey(key)
+	return nil
+}
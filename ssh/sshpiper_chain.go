@@ -0,0 +1,248 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"errors"
+	"fmt"
+)
+
+// AuthStep is one step of an AuthChain. It is satisfied by any of the methods
+// whose validator is non-nil. A validator accepts the attempt by returning nil.
+type AuthStep struct {
+	None                func(conn ConnMetadata, chainCtx *AuthChainContext) error
+	Password            func(conn ConnMetadata, password []byte, chainCtx *AuthChainContext) error
+	PublicKey           func(conn ConnMetadata, key PublicKey, chainCtx *AuthChainContext) error
+	KeyboardInteractive func(conn ConnMetadata, client KeyboardInteractiveChallenge, chainCtx *AuthChainContext) error
+}
+
+func (s *AuthStep) methods() []string {
+	var methods []string
+	if s.None != nil {
+		methods = append(methods, "none")
+	}
+	if s.Password != nil {
+		methods = append(methods, "password")
+	}
+	if s.PublicKey != nil {
+		methods = append(methods, "publickey")
+	}
+	if s.KeyboardInteractive != nil {
+		methods = append(methods, "keyboard-interactive")
+	}
+	return methods
+}
+
+// AuthChain authenticates the downstream in steps, e.g. with a publickey, then
+// with a one-time password asked over keyboard-interactive, before resolving
+// its upstream. The steps but the last one end with a partial success, RFC 4252
+// section 5.1, telling the downstream to continue with the methods of the next
+// step. A publickey satisfies a step only once its signature was verified.
+//
+// The progress of a connection is stored in its ChallengeContext, an
+// *AuthChainContext.
+type AuthChain struct {
+	// Steps are the steps the downstream must satisfy in order.
+	Steps []AuthStep
+
+	// Upstream is called once the last step was accepted, and returns the
+	// upstream of the downstream.
+	Upstream func(conn ConnMetadata, chainCtx *AuthChainContext) (*Upstream, error)
+
+	// Meta, if non-nil, is called when the context of a connection is created.
+	// Its result is returned by the Meta method of the context.
+	Meta func(conn ConnMetadata) (interface{}, error)
+}
+
+// Apply sets the CreateChallengeContext, NextAuthMethods and authentication
+// callbacks of config to run the chain.
+func (c *AuthChain) Apply(config *PiperConfig) {
+	config.CreateChallengeContext = c.createChallengeContext
+	config.NextAuthMethods = c.nextAuthMethods
+	config.NoClientAuthCallback = c.noClientAuthCallback
+	config.PasswordCallback = c.passwordCallback
+	config.PublicKeyCallback = c.publicKeyCallback
+	config.KeyboardInteractiveCallback = c.keyboardInteractiveCallback
+}
+
+// AuthChainContext is the ChallengeContext of the connections authenticated
+// by an AuthChain.
+type AuthChainContext struct {
+	meta interface{}
+	user string
+
+	// step is the index of the step to satisfy next, methods are the methods
+	// which satisfied the previous steps and key the last verified publickey.
+	step    int
+	methods []string
+	key     PublicKey
+}
+
+// authProgress is implemented by the challenge contexts tracking the steps of
+// a multi-step authentication.
+type authProgress interface {
+	satisfied(conn ConnMetadata, method string, key PublicKey)
+}
+
+// Meta returns the result of the Meta function of the AuthChain.
+func (c *AuthChainContext) Meta() interface{} {
+	return c.meta
+}
+
+// ChallengedUsername returns the user which satisfied the first step, if any.
+// The following steps must be satisfied by the same user.
+func (c *AuthChainContext) ChallengedUsername() string {
+	return c.user
+}
+
+// Step returns the index of the step to satisfy next.
+func (c *AuthChainContext) Step() int {
+	return c.step
+}
+
+// Satisfied returns the methods which satisfied the steps so far, in order.
+func (c *AuthChainContext) Satisfied() []string {
+	return c.methods
+}
+
+// PublicKey returns the last verified publickey which satisfied a step, or nil.
+func (c *AuthChainContext) PublicKey() PublicKey {
+	return c.key
+}
+
+func (c *AuthChainContext) satisfied(conn ConnMetadata, method string, key PublicKey) {
+	if c.step == 0 {
+		c.user = conn.User()
+	}
+
+	c.step++
+	c.methods = append(c.methods, method)
+	if key != nil {
+		c.key = key
+	}
+}
+
+func (c *AuthChain) createChallengeContext(conn ConnMetadata) (ChallengeContext, error) {
+	chainCtx := &AuthChainContext{}
+
+	if c.Meta != nil {
+		meta, err := c.Meta(conn)
+		if err != nil {
+			return nil, err
+		}
+		chainCtx.meta = meta
+	}
+
+	return chainCtx, nil
+}
+
+func (c *AuthChain) nextAuthMethods(conn ConnMetadata, satisfied []string, challengeCtx ChallengeContext) ([]string, error) {
+	chainCtx, ok := challengeCtx.(*AuthChainContext)
+	if !ok || chainCtx.step >= len(c.Steps) {
+		return nil, nil
+	}
+
+	return c.Steps[chainCtx.step].methods(), nil
+}
+
+// step returns the step the attempt of the downstream must satisfy.
+func (c *AuthChain) step(conn ConnMetadata, challengeCtx ChallengeContext) (*AuthStep, *AuthChainContext, error) {
+	chainCtx, ok := challengeCtx.(*AuthChainContext)
+	if !ok {
+		return nil, nil, errors.New("ssh: challenge context not created by the auth chain")
+	}
+
+	if chainCtx.step >= len(c.Steps) {
+		return nil, nil, errors.New("ssh: auth chain has no step left")
+	}
+
+	if chainCtx.user != "" && conn.User() != chainCtx.user {
+		return nil, nil, fmt.Errorf("ssh: user changed from %q to %q during the authentication", chainCtx.user, conn.User())
+	}
+
+	return &c.Steps[chainCtx.step], chainCtx, nil
+}
+
+// accept continues with the next step after an accepted attempt, or resolves
+// the upstream after the last one.
+func (c *AuthChain) accept(conn ConnMetadata, chainCtx *AuthChainContext) (*Upstream, error) {
+	if chainCtx.step < len(c.Steps)-1 {
+		return nil, ErrPartialSuccess
+	}
+
+	if c.Upstream == nil {
+		return nil, errors.New("ssh: auth chain has no upstream")
+	}
+
+	return c.Upstream(conn, chainCtx)
+}
+
+func (c *AuthChain) noClientAuthCallback(conn ConnMetadata, challengeCtx ChallengeContext) (*Upstream, error) {
+	step, chainCtx, err := c.step(conn, challengeCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	if step.None == nil {
+		return nil, ErrNoAuth
+	}
+
+	if err := step.None(conn, chainCtx); err != nil {
+		return nil, err
+	}
+
+	return c.accept(conn, chainCtx)
+}
+
+func (c *AuthChain) passwordCallback(conn ConnMetadata, password []byte, challengeCtx ChallengeContext) (*Upstream, error) {
+	step, chainCtx, err := c.step(conn, challengeCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	if step.Password == nil {
+		return nil, errors.New("ssh: password not accepted at this step")
+	}
+
+	if err := step.Password(conn, password, chainCtx); err != nil {
+		return nil, err
+	}
+
+	return c.accept(conn, chainCtx)
+}
+
+func (c *AuthChain) publicKeyCallback(conn ConnMetadata, key PublicKey, challengeCtx ChallengeContext) (*Upstream, error) {
+	step, chainCtx, err := c.step(conn, challengeCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	if step.PublicKey == nil {
+		return nil, errors.New("ssh: publickey not accepted at this step")
+	}
+
+	if err := step.PublicKey(conn, key, chainCtx); err != nil {
+		return nil, err
+	}
+
+	return c.accept(conn, chainCtx)
+}
+
+func (c *AuthChain) keyboardInteractiveCallback(conn ConnMetadata, client KeyboardInteractiveChallenge, challengeCtx ChallengeContext) (*Upstream, error) {
+	step, chainCtx, err := c.step(conn, challengeCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	if step.KeyboardInteractive == nil {
+		return nil, errors.New("ssh: keyboard-interactive not accepted at this step")
+	}
+
+	if err := step.KeyboardInteractive(conn, client, chainCtx); err != nil {
+		return nil, err
+	}
+
+	return c.accept(conn, chainCtx)
+}
@@ -0,0 +1,151 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// recordedAuth records the results of an AuthMethod.
+type recordedAuth struct {
+	AuthMethod
+	results *[]authResult
+}
+
+func (r recordedAuth) auth(session []byte, user string, p packetConn, rand io.Reader, extensions map[string][]byte) (authResult, []string, error) {
+	ok, methods, err := r.AuthMethod.auth(session, user, p, rand, extensions)
+	*r.results = append(*r.results, ok)
+	return ok, methods, err
+}
+
+func otpChain(t *testing.T) *AuthChain {
+	return &AuthChain{
+		Steps: []AuthStep{
+			{
+				PublicKey: func(conn ConnMetadata, key PublicKey, chainCtx *AuthChainContext) error {
+					if !bytes.Equal(key.Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+						return errors.New("unknown key")
+					}
+					return nil
+				},
+			},
+			{
+				KeyboardInteractive: func(conn ConnMetadata, client KeyboardInteractiveChallenge, chainCtx *AuthChainContext) error {
+					ans, err := client("", "", []string{"otp: "}, []bool{false})
+					if err != nil {
+						return err
+					}
+					if len(ans) != 1 || ans[0] != "123456" {
+						return errors.New("wrong otp")
+					}
+					return nil
+				},
+			},
+		},
+		Upstream: func(conn ConnMetadata, chainCtx *AuthChainContext) (*Upstream, error) {
+			if got, want := chainCtx.Satisfied(), []string{"publickey"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got satisfied methods %v, want %v", got, want)
+			}
+			if key := chainCtx.PublicKey(); key == nil || !bytes.Equal(key.Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+				t.Errorf("got verified key %v, want the ecdsa test key", key)
+			}
+			if chainCtx.ChallengedUsername() != "testuser" {
+				t.Errorf("got challenged user %q, want testuser", chainCtx.ChallengedUsername())
+			}
+
+			return noneAuthUpstream(simpleEchoHandler, t)(conn, chainCtx)
+		},
+	}
+}
+
+func TestPiperAuthChain(t *testing.T) {
+	piper := &PiperConfig{}
+	otpChain(t).Apply(piper)
+
+	c, err := dialPiper(piper, nil, nil, t)
+	if err != nil {
+		t.Fatalf("connect dial to piper: %v", err)
+	}
+
+	var pubkeyResults, otpResults []authResult
+	sshc, chans, reqs, err := NewClientConn(c, "", &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			recordedAuth{PublicKeys(testSigners["ecdsa"]), &pubkeyResults},
+			recordedAuth{KeyboardInteractive(keyboardInteractive{"otp: ": "123456"}.Challenge), &otpResults},
+		},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("can connect to piper %v", err)
+	}
+	client := NewClient(sshc, chans, reqs)
+	defer client.Close()
+
+	if want := []authResult{authPartialSuccess}; !reflect.DeepEqual(pubkeyResults, want) {
+		t.Errorf("got publickey results %v, want %v", pubkeyResults, want)
+	}
+	if want := []authResult{authSuccess}; !reflect.DeepEqual(otpResults, want) {
+		t.Errorf("got keyboard-interactive results %v, want %v", otpResults, want)
+	}
+
+	if got := echoThroughSession(client, []byte("chained"), t); string(got) != "chained" {
+		t.Errorf("got %q through the session, want %q", got, "chained")
+	}
+}
+
+func TestPiperAuthChainRejected(t *testing.T) {
+	for name, auth := range map[string][]AuthMethod{
+		"wrong otp": {
+			PublicKeys(testSigners["ecdsa"]),
+			KeyboardInteractive(keyboardInteractive{"otp: ": "654321"}.Challenge),
+		},
+		"otp only": {
+			KeyboardInteractive(keyboardInteractive{"otp: ": "123456"}.Challenge),
+		},
+		"unknown key": {
+			PublicKeys(testSigners["rsa"]),
+			KeyboardInteractive(keyboardInteractive{"otp: ": "123456"}.Challenge),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			piper := &PiperConfig{}
+			otpChain(t).Apply(piper)
+			piper.AddHostKey(testSigners["rsa"])
+
+			c, s, err := netPipe()
+			if err != nil {
+				t.Fatalf("netPipe: %v", err)
+			}
+			defer c.Close()
+			defer s.Close()
+
+			piperErr := make(chan error, 1)
+			go func() {
+				_, err := NewSSHPiperConn(s, piper)
+				s.Close()
+				piperErr <- err
+			}()
+
+			_, _, _, err = NewClientConn(c, "", &ClientConfig{
+				User:            "testuser",
+				Auth:            auth,
+				HostKeyCallback: InsecureIgnoreHostKey(),
+			})
+			if err == nil {
+				t.Fatal("client authenticated through the chain")
+			}
+			c.Close()
+
+			if err := <-piperErr; err == nil {
+				t.Fatal("piper authenticated the client")
+			}
+		})
+	}
+}
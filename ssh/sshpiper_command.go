@@ -0,0 +1,131 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"path"
+	"regexp"
+)
+
+// CommandPolicy restricts the programs a downstream runs in its session
+// channels, through exec, shell and subsystem requests, and the environment
+// variables it passes with env requests. The zero CommandPolicy denies every
+// program.
+//
+// A denied exec, shell or subsystem request never reaches the upstream: the
+// downstream gets a SSH_MSG_CHANNEL_FAILURE, if it asked for a reply, and an
+// exit-status.
+type CommandPolicy struct {
+	// AllowCommands lists the commands of the exec requests allowed. A
+	// command is allowed if one of the expressions matches it, so anchor
+	// them, such as ^git-upload-pack '[^']*'$, to match whole commands.
+	AllowCommands []*regexp.Regexp
+
+	// AllowShell allows shell requests.
+	AllowShell bool
+
+	// AllowSubsystems lists the subsystems allowed, such as "sftp".
+	AllowSubsystems []string
+
+	// ForceCommand, if non-empty, replaces the exec, shell and subsystem
+	// requests with an exec request of ForceCommand, like the force-command
+	// option of certificates. The rules above are not checked then. Unlike
+	// sshd, the original command is not passed in SSH_ORIGINAL_COMMAND.
+	ForceCommand string
+
+	// AllowEnv lists the names of the environment variables the env
+	// requests may set, as patterns of path.Match, such as "LC_*". The
+	// other env requests are rejected.
+	AllowEnv []string
+
+	// ExitStatus is the exit status sent for denied programs. If zero, 1
+	// is used.
+	ExitStatus uint32
+}
+
+// allowed reports whether the session request of type reqType with payload
+// may be forwarded as it is.
+func (c *CommandPolicy) allowed(reqType string, payload []byte) bool {
+	switch reqType {
+	case "exec":
+		var msg execMsg
+		if err := Unmarshal(payload, &msg); err != nil {
+			return false
+		}
+		for _, re := range c.AllowCommands {
+			if re.MatchString(msg.Command) {
+				return true
+			}
+		}
+	case "shell":
+		return c.AllowShell
+	case "subsystem":
+		var msg subsystemRequestMsg
+		if err := Unmarshal(payload, &msg); err != nil {
+			return false
+		}
+		for _, name := range c.AllowSubsystems {
+			if msg.Subsystem == name {
+				return true
+			}
+		}
+	case "env":
+		var msg setenvRequest
+		if err := Unmarshal(payload, &msg); err != nil {
+			return false
+		}
+		for _, pattern := range c.AllowEnv {
+			if ok, _ := path.Match(pattern, msg.Name); ok {
+				return true
+			}
+		}
+	default:
+		return true
+	}
+
+	return false
+}
+
+// commandPolicyHooks returns the hooks enforcing the command policy of the
+// connection, or nil if there is none.
+func (p *PiperConn) commandPolicyHooks() *MessageHooks {
+	policy := p.commandPolicy
+	if policy == nil {
+		return nil
+	}
+
+	exitStatus := policy.ExitStatus
+	if exitStatus == 0 {
+		exitStatus = 1
+	}
+
+	return &MessageHooks{
+		OnChannelRequest: func(dir PipeDirection, msg *PipedChannelRequest) (PipeVerdict, error) {
+			if dir != FromDownstream || msg.Channel.ChanType != "session" {
+				return PipeForward, nil
+			}
+
+			switch msg.Type {
+			case "exec", "shell", "subsystem":
+				if policy.ForceCommand != "" {
+					msg.Type = "exec"
+					msg.Payload = Marshal(&execMsg{Command: policy.ForceCommand})
+					return PipeForward, nil
+				}
+
+				if !policy.allowed(msg.Type, msg.Payload) {
+					msg.ExitStatus = &exitStatus
+					return PipeReject, nil
+				}
+			case "env":
+				if !policy.allowed(msg.Type, msg.Payload) {
+					return PipeReject, nil
+				}
+			}
+
+			return PipeForward, nil
+		},
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// programHandler answers the session requests, and prints the program it
+// was asked to run and the environment variables it was given.
+func programHandler(ch Channel, in <-chan *Request, t *testing.T) {
+	defer ch.Close()
+
+	var env []string
+	for req := range in {
+		switch req.Type {
+		case "env":
+			var msg setenvRequest
+			Unmarshal(req.Payload, &msg)
+			env = append(env, msg.Name)
+			req.Reply(true, nil)
+		case "exec", "shell", "subsystem":
+			req.Reply(true, nil)
+			fmt.Fprintf(ch, "%s %q env=%s", req.Type, req.Payload, strings.Join(env, ","))
+			ch.SendRequest("exit-status", false, Marshal(&struct{ Status uint32 }{0}))
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func TestPiperCommandPolicy(t *testing.T) {
+	policies := map[string]*CommandPolicy{
+		"restricted": {
+			AllowCommands:   []*regexp.Regexp{regexp.MustCompile(`^git-upload-pack '[^']*'$`)},
+			AllowSubsystems: []string{"sftp"},
+			AllowEnv:        []string{"LC_*"},
+			ExitStatus:      126,
+		},
+		"forced": {
+			ForceCommand: "/usr/bin/backup",
+		},
+	}
+
+	allowedEnv := map[string]string{
+		"restricted":   "LC_ALL",
+		"unrestricted": "LC_ALL,SECRET",
+	}
+
+	for _, tt := range []struct {
+		user, reqType, arg string
+		want               string
+	}{
+		{"restricted", "exec", "git-upload-pack 'repo'", "exec \"\\x00\\x00\\x00\\x16git-upload-pack 'repo'\" env=LC_ALL"},
+		{"restricted", "exec", "git-upload-pack 'repo'; rm -rf /", ""},
+		{"restricted", "shell", "", ""},
+		{"restricted", "subsystem", "sftp", "subsystem \"\\x00\\x00\\x00\\x04sftp\" env=LC_ALL"},
+		{"restricted", "subsystem", "netconf", ""},
+		{"forced", "shell", "", "exec \"\\x00\\x00\\x00\\x0f/usr/bin/backup\" env="},
+		{"forced", "subsystem", "sftp", "exec \"\\x00\\x00\\x00\\x0f/usr/bin/backup\" env="},
+		{"unrestricted", "shell", "", "shell \"\" env=LC_ALL,SECRET"},
+	} {
+		conn := dialPiperClient(&PiperConfig{
+			NoClientAuthCallback: noneAuthUpstream(programHandler, t),
+			CommandPolicyCallback: func(conn ConnMetadata, challengeCtx ChallengeContext) *CommandPolicy {
+				return policies[tt.user]
+			},
+		}, nil, t)
+
+		ch, reqs, err := conn.OpenChannel("session", nil)
+		if err != nil {
+			t.Fatalf("OpenChannel: %v", err)
+		}
+
+		for _, name := range []string{"LC_ALL", "SECRET"} {
+			ok, err := ch.SendRequest("env", true, Marshal(&setenvRequest{Name: name}))
+			if err != nil {
+				t.Fatalf("env: %v", err)
+			}
+			if want := strings.Contains(allowedEnv[tt.user], name); ok != want {
+				t.Errorf("%s: env %s: got %v, want %v", tt.user, name, ok, want)
+			}
+		}
+
+		var payload []byte
+		if tt.arg != "" {
+			payload = Marshal(&execMsg{Command: tt.arg})
+		}
+		ok, err := ch.SendRequest(tt.reqType, true, payload)
+		if err != nil {
+			t.Fatalf("%s: %s: %v", tt.user, tt.reqType, err)
+		}
+		if ok != (tt.want != "") {
+			t.Errorf("%s: %s %q: got reply %v", tt.user, tt.reqType, tt.arg, ok)
+		}
+
+		if tt.want == "" {
+			req := <-reqs
+			var status struct{ Status uint32 }
+			if req == nil || req.Type != "exit-status" || Unmarshal(req.Payload, &status) != nil || status.Status != 126 {
+				t.Errorf("%s: %s %q: got request %+v, want exit-status 126", tt.user, tt.reqType, tt.arg, req)
+			}
+
+			// the piper ends the session, rather than leaving the client
+			// waiting for it to close
+			if n, err := ch.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Errorf("%s: %s %q: got %d bytes, %v after exit-status, want EOF", tt.user, tt.reqType, tt.arg, n, err)
+			}
+			select {
+			case req, ok := <-reqs:
+				if ok {
+					t.Errorf("%s: %s %q: got request %+v after exit-status, want the channel closed", tt.user, tt.reqType, tt.arg, req)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: %s %q: channel not closed after exit-status", tt.user, tt.reqType, tt.arg)
+			}
+		} else {
+			buf := make([]byte, 256)
+			n, _ := ch.Read(buf)
+			if got := string(buf[:n]); got != tt.want {
+				t.Errorf("%s: %s %q: upstream got %s, want %s", tt.user, tt.reqType, tt.arg, got, tt.want)
+			}
+		}
+
+		ch.Close()
+		conn.Close()
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PiperObserver receives the lifecycle events of piped connections. Observe
+// may be called concurrently from the goroutines of a connection and must not
+// block.
+type PiperObserver interface {
+	Observe(conn ConnMetadata, event PiperEvent)
+}
+
+// PiperEvent is a lifecycle event of a piped connection: one of
+// *DownstreamHandshakeEvent, *AuthAttemptEvent, *UpstreamSelectedEvent,
+// *UpstreamHandshakeEvent, *RekeyEvent, *TrafficEvent and *DisconnectEvent.
+type PiperEvent interface {
+	piperEvent()
+}
+
+// DownstreamHandshakeEvent is emitted once the first key exchange with the
+// downstream completed.
+type DownstreamHandshakeEvent struct {
+	ClientVersion string
+	Algorithms    NegotiatedAlgorithms
+}
+
+// AuthAttemptEvent is emitted for each authentication attempt of the
+// downstream. Err is nil if the attempt succeeded.
+type AuthAttemptEvent struct {
+	Method string
+	Err    error
+}
+
+// UpstreamSelectedEvent is emitted when an authentication callback mapped
+// the downstream to an upstream.
+type UpstreamSelectedEvent struct {
+	Method   string
+	Upstream *Upstream
+}
+
+// UpstreamHandshakeEvent is emitted after connecting, handshaking and
+// authenticating with an upstream or one of its fallbacks. Err is nil if the
+// upstream was connected, Algorithms is zero if the key exchange failed.
+type UpstreamHandshakeEvent struct {
+	Upstream      *Upstream
+	ServerVersion string
+	Algorithms    NegotiatedAlgorithms
+	Duration      time.Duration
+	Err           error
+}
+
+// RekeyEvent is emitted after each key exchange following the first one,
+// on either side.
+type RekeyEvent struct {
+	Side       PipeDirection
+	Algorithms NegotiatedAlgorithms
+}
+
+// TrafficEvent is emitted for each direction every
+// PiperConfig.TrafficInterval while piping, if anything was piped, and when
+// the piped connection ends. It holds the number of packets piped in that
+// direction since the previous TrafficEvent of the direction, and the bytes
+// of channel data they carried.
+type TrafficEvent struct {
+	Direction PipeDirection
+	Packets   uint64
+	Bytes     uint64
+}
+
+// DisconnectEvent is emitted when Wait returns.
+type DisconnectEvent struct {
+	// Side is the side whose connection ended first.
+	Side PipeDirection
+
+	// Err is the error returned by Wait.
+	Err error
+
+	// Reason and Message are those of the SSH_MSG_DISCONNECT sent by Side,
+	// if its connection ended with one.
+	Reason  uint32
+	Message string
+
+	// Duration is how long the connection lasted, since the downstream
+	// connected.
+	Duration time.Duration
+}
+
+func (*DownstreamHandshakeEvent) piperEvent() {}
+func (*AuthAttemptEvent) piperEvent()         {}
+func (*UpstreamSelectedEvent) piperEvent()    {}
+func (*UpstreamHandshakeEvent) piperEvent()   {}
+func (*RekeyEvent) piperEvent()               {}
+func (*TrafficEvent) piperEvent()             {}
+func (*DisconnectEvent) piperEvent()          {}
+
+// piperEvents emits the events of one piped connection.
+type piperEvents struct {
+	observer PiperObserver
+	start    time.Time
+
+	// rekeyCallback, if non-nil, is PiperConfig.RekeyCallback.
+	rekeyCallback func(conn ConnMetadata, side PipeDirection, algs NegotiatedAlgorithms, challengeCtx ChallengeContext)
+
+	// mu guards conn, set once the downstream handshake completed, the
+	// challenge context and the results of first key exchanges, as key
+	// exchanges run on their own goroutines.
+	mu           sync.Mutex
+	conn         ConnMetadata
+	challengeCtx ChallengeContext
+
+	packets [2]atomic.Uint64
+	bytes   [2]atomic.Uint64
+
+	// trafficMu serializes the TrafficEvents, none of which follows the
+	// last one, once trafficEnded is set.
+	trafficMu    sync.Mutex
+	trafficEnded bool
+}
+
+func (e *piperEvents) emit(event PiperEvent) {
+	if e.observer == nil {
+		return
+	}
+
+	e.mu.Lock()
+	conn := e.conn
+	e.mu.Unlock()
+
+	e.observer.Observe(conn, event)
+}
+
+// kexCallback returns the Config.kexCallback of side, storing the result of
+// the first key exchange in first, to be read with algorithms, and reporting
+// the others as rekeys.
+func (e *piperEvents) kexCallback(side PipeDirection, first *NegotiatedAlgorithms) func(NegotiatedAlgorithms, bool) {
+	if e.observer == nil && e.rekeyCallback == nil {
+		return nil
+	}
+
+	return func(algs NegotiatedAlgorithms, isFirst bool) {
+		if isFirst {
+			e.mu.Lock()
+			*first = algs
+			e.mu.Unlock()
+			return
+		}
+
+		e.emit(&RekeyEvent{
+			Side:       side,
+			Algorithms: algs,
+		})
+
+		if e.rekeyCallback != nil {
+			e.mu.Lock()
+			conn, challengeCtx := e.conn, e.challengeCtx
+			e.mu.Unlock()
+
+			e.rekeyCallback(conn, side, algs, challengeCtx)
+		}
+	}
+}
+
+// algorithms reads the result of a first key exchange stored by kexCallback.
+func (e *piperEvents) algorithms(first *NegotiatedAlgorithms) NegotiatedAlgorithms {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return *first
+}
+
+// observe wraps src, the source of the packets piped in dir, to account them.
+func (e *piperEvents) observe(dir PipeDirection, src packetConn) packetConn {
+	if e.observer == nil {
+		return src
+	}
+
+	return &observedPacketConn{
+		packetConn: src,
+		events:     e,
+		dir:        dir,
+	}
+}
+
+type observedPacketConn struct {
+	packetConn
+	events *piperEvents
+	dir    PipeDirection
+}
+
+func (o *observedPacketConn) readPacket() ([]byte, error) {
+	p, err := o.packetConn.readPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	o.events.packets[o.dir].Add(1)
+	if p[0] == msgChannelData || p[0] == msgChannelExtendedData {
+		o.events.bytes[o.dir].Add(uint64(channelDataLen(p)))
+	}
+
+	return p, nil
+}
+
+// reportTraffic emits the TrafficEvents every interval until done is closed.
+func (e *piperEvents) reportTraffic(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			e.traffic(false)
+		case <-done:
+			return
+		}
+	}
+}
+
+// traffic emits the TrafficEvents of what was piped since the previous ones,
+// skipping the idle directions unless last is set.
+func (e *piperEvents) traffic(last bool) {
+	e.trafficMu.Lock()
+	defer e.trafficMu.Unlock()
+
+	if e.trafficEnded {
+		return
+	}
+	e.trafficEnded = last
+
+	for _, dir := range []PipeDirection{FromDownstream, FromUpstream} {
+		packets := e.packets[dir].Swap(0)
+		bytes := e.bytes[dir].Swap(0)
+		if packets == 0 && !last {
+			continue
+		}
+
+		e.emit(&TrafficEvent{
+			Direction: dir,
+			Packets:   packets,
+			Bytes:     bytes,
+		})
+	}
+}
+
+// closed emits the events of the end of the connection. disconnect, if
+// non-nil, is the SSH_MSG_DISCONNECT that ended the connection of side.
+func (e *piperEvents) closed(side PipeDirection, err error, disconnect *disconnectMsg) {
+	if e.observer == nil {
+		return
+	}
+
+	e.traffic(true)
+
+	event := &DisconnectEvent{
+		Side:     side,
+		Err:      err,
+		Duration: time.Since(e.start),
+	}
+
+	if disconnect != nil {
+		event.Reason = disconnect.Reason
+		event.Message = disconnect.Message
+	}
+
+	e.emit(event)
+}
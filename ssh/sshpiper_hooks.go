@@ -0,0 +1,1125 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PipeDirection tells which side of a PiperConn sent a message. It also
+// names the sides themselves, as in PipeError and RekeyCallback.
+type PipeDirection int
+
+const (
+	// FromDownstream marks messages sent by the downstream client.
+	FromDownstream PipeDirection = iota
+
+	// FromUpstream marks messages sent by the upstream server.
+	FromUpstream
+)
+
+func (d PipeDirection) String() string {
+	if d == FromUpstream {
+		return "upstream"
+	}
+	return "downstream"
+}
+
+func (d PipeDirection) peer() PipeDirection {
+	return 1 - d
+}
+
+// PipeVerdict is returned by MessageHooks callbacks to decide what happens
+// to a message.
+type PipeVerdict int
+
+const (
+	// PipeForward sends the message, including any change the hook made to
+	// it, to the other side.
+	PipeForward PipeVerdict = iota
+
+	// PipeReject keeps the message away from the other side. If the sender
+	// expects an answer, the piper sends the matching failure message itself.
+	PipeReject
+)
+
+// PipedChannel is a channel tracked by the piper. The channel numbers of
+// both sides are kept, so hooks can tell which channel a message belongs to
+// regardless of its direction.
+type PipedChannel struct {
+	// ChanType is the channel type, such as "session" or "direct-tcpip".
+	ChanType string
+
+	// ExtraData is the type specific data sent along with the channel open.
+	ExtraData []byte
+
+	// OpenedBy is the side that opened the channel.
+	OpenedBy PipeDirection
+
+	// DownstreamID and UpstreamID are the channel numbers allocated by the
+	// downstream and the upstream. The number of the side that did not open
+	// the channel is only valid once the channel was confirmed.
+	DownstreamID uint32
+	UpstreamID   uint32
+
+	confirmed bool
+	eof       [2]bool
+	closed    [2]bool
+	pending   [2][]pendingReply
+
+	// ended marks a channel closed by the piper on both sides, see
+	// endChannel. The packets of either side to it are dropped, their
+	// closes only removing it once both arrived.
+	ended bool
+
+	// maxPacket is the largest data packet each side accepts, and held the
+	// bytes sent by each side that hooks kept to forward later.
+	maxPacket [2]uint32
+	held      [2]int
+
+	// window is what is left of the window the downstream granted for the
+	// data of the channel, debt the part of it the piper used for its own
+	// data and did not give back to the upstream yet, and queued the
+	// packets of the upstream waiting for the window, see drain. They are
+	// only tracked with trackWindow.
+	window uint32
+	debt   uint32
+	queued [][]byte
+}
+
+func (c *PipedChannel) id(side PipeDirection) uint32 {
+	if side == FromUpstream {
+		return c.UpstreamID
+	}
+	return c.DownstreamID
+}
+
+func (c *PipedChannel) setID(side PipeDirection, id uint32) {
+	if side == FromUpstream {
+		c.UpstreamID = id
+	} else {
+		c.DownstreamID = id
+	}
+}
+
+// PipedChannelOpen is a decoded SSH_MSG_CHANNEL_OPEN.
+type PipedChannelOpen struct {
+	ChanType  string
+	ExtraData []byte
+
+	// Reason and Message are sent to the opener if the open is rejected.
+	// Reason defaults to Prohibited.
+	Reason  RejectionReason
+	Message string
+}
+
+// PipedChannelRequest is a decoded SSH_MSG_CHANNEL_REQUEST.
+type PipedChannelRequest struct {
+	Channel   *PipedChannel
+	Type      string
+	WantReply bool
+	Payload   []byte
+
+	// ExitStatus, if non-nil when the request is rejected, is sent back to
+	// the sender in an "exit-status" request, after the failure, as if the
+	// program the request would have started had exited. The piper then
+	// closes the channel on both sides.
+	ExitStatus *uint32
+}
+
+// PipedChannelData is a decoded SSH_MSG_CHANNEL_DATA or
+// SSH_MSG_CHANNEL_EXTENDED_DATA.
+type PipedChannelData struct {
+	Channel *PipedChannel
+
+	// DataType is zero for regular data, and the data type code (1 for
+	// stderr) for extended data.
+	DataType uint32
+
+	// Data holds the payload. It is only valid during the callback.
+	Data []byte
+
+	// Held is the number of bytes a hook removed from Data to forward them
+	// with a later packet of the channel, such as the start of a message
+	// split across packets. It is negative when the hook adds back bytes it
+	// held before. Hooks add to it, as several of them may hold data.
+	Held int
+}
+
+// PipedGlobalRequest is a decoded SSH_MSG_GLOBAL_REQUEST.
+type PipedGlobalRequest struct {
+	Type      string
+	WantReply bool
+	Payload   []byte
+}
+
+// MessageHooks holds typed callbacks for the connection layer messages
+// piped by a PiperConn. A callback may rewrite the message it is given and
+// returns whether the message is forwarded or rejected. A non-nil error
+// closes the piped connection.
+//
+// A nil callback leaves the matching messages untouched, and they are copied
+// without being decoded. Callbacks for one direction are called from a single
+// goroutine, but both directions run concurrently.
+type MessageHooks struct {
+	// OnChannelOpen is called for each channel open. If rejected, the opener
+	// gets a SSH_MSG_CHANNEL_OPEN_FAILURE and the other side never learns
+	// about the channel.
+	OnChannelOpen func(dir PipeDirection, msg *PipedChannelOpen) (PipeVerdict, error)
+
+	// OnChannelRequest is called for each channel request. If rejected and
+	// a reply was wanted, the sender gets a SSH_MSG_CHANNEL_FAILURE.
+	OnChannelRequest func(dir PipeDirection, msg *PipedChannelRequest) (PipeVerdict, error)
+
+	// OnChannelData is called for each data packet. Rejected or shortened
+	// data is given back to the sender's window, unless held. The data
+	// must not grow beyond what was received and held, and is split to the
+	// packet size granted by the receiver.
+	OnChannelData func(dir PipeDirection, msg *PipedChannelData) (PipeVerdict, error)
+
+	// OnGlobalRequest is called for each global request. If rejected and a
+	// reply was wanted, the sender gets a SSH_MSG_REQUEST_FAILURE.
+	OnGlobalRequest func(dir PipeDirection, msg *PipedGlobalRequest) (PipeVerdict, error)
+
+	// OnChannelClose is called once both sides closed a channel.
+	OnChannelClose func(ch *PipedChannel)
+}
+
+// pendingReply is a request awaiting its answer. Replies must be sent in
+// request order, so answers to locally rejected requests wait until the
+// requests forwarded before them were answered by the other side.
+type pendingReply struct {
+	local bool
+
+	// probe marks a keepalive sent by the piper, whose reply is not
+	// forwarded.
+	probe bool
+
+	// after, if non-nil, is sent after the local answer, or alone if
+	// silent is set, as the request did not want a reply.
+	after  []byte
+	silent bool
+
+	// end, if non-nil, is the channel closed once the answer was sent.
+	end *PipedChannel
+}
+
+// messagePipe runs MessageHooks over both directions of a piped connection.
+type messagePipe struct {
+	hooks []*MessageHooks
+
+	// conns holds the transport of each side, indexed by PipeDirection.
+	conns [2]packetConn
+
+	hasOpen    bool
+	hasData    bool
+	hasRequest bool
+	hasGlobal  bool
+
+	// mu guards the channel table and the pending replies. It is also held
+	// while answering requests, to keep the replies in order.
+	mu            sync.Mutex
+	channels      [2]map[uint32]*PipedChannel
+	globalPending [2][]pendingReply
+
+	// drained, if non-nil, refuses new channels and is closed once all
+	// channels are closed, see drain.
+	drained     chan struct{}
+	drainClosed bool
+
+	// throttle, if non-nil, returns how long n bytes of channel data from
+	// dir are delayed, in the queue of dir, see send. done is closed once
+	// piping ended.
+	throttle func(dir PipeDirection, n int) time.Duration
+	delayed  [2]delayQueue
+	done     chan struct{}
+
+	// lastData is the time, in unix nanoseconds, channel data was last
+	// piped in either direction, if trackIdle is set.
+	lastData  atomic.Int64
+	trackIdle bool
+
+	// trackWindow tracks the windows of the downstream, so drain can write
+	// its warning.
+	trackWindow bool
+
+	// unanswered counts the keepalive probes sent to each side and not
+	// answered yet. It is guarded by mu.
+	unanswered [2]int
+
+	// ended counts the channels in the table closed by the piper, so their
+	// packets are only looked for while there are some.
+	ended atomic.Int32
+}
+
+func newMessagePipe(downstream, upstream packetConn, hooks []*MessageHooks) *messagePipe {
+	m := &messagePipe{
+		conns:    [2]packetConn{downstream, upstream},
+		channels: [2]map[uint32]*PipedChannel{{}, {}},
+		done:     make(chan struct{}),
+	}
+	m.lastData.Store(time.Now().UnixNano())
+
+	for _, h := range hooks {
+		if h == nil {
+			continue
+		}
+		m.hooks = append(m.hooks, h)
+		m.hasOpen = m.hasOpen || h.OnChannelOpen != nil
+		m.hasData = m.hasData || h.OnChannelData != nil
+		m.hasRequest = m.hasRequest || h.OnChannelRequest != nil
+		m.hasGlobal = m.hasGlobal || h.OnGlobalRequest != nil
+	}
+
+	return m
+}
+
+// lookup returns the channel a message from dir refers to. Messages carry
+// the channel number allocated by their recipient.
+func (m *messagePipe) lookup(dir PipeDirection, peersID uint32) *PipedChannel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.channels[dir.peer()][peersID]
+}
+
+// handle processes a packet read from dir and forwards it, or answers it,
+// as the hooks decide. Only the messages opening and closing channels are
+// always decoded, to track the channels; the others are forwarded as they
+// are unless a hook needs them.
+func (m *messagePipe) handle(dir PipeDirection, packet []byte) error {
+	if m.ended.Load() > 0 && m.dropEnded(dir, packet) {
+		return nil
+	}
+
+	var err error
+	switch packet[0] {
+	case msgChannelOpen:
+		packet, err = m.channelOpen(dir, packet)
+	case msgChannelOpenConfirm:
+		err = m.channelOpenConfirm(dir, packet)
+	case msgChannelOpenFailure:
+		err = m.channelOpenFailure(dir, packet)
+	case msgChannelEOF:
+		err = m.channelEOF(dir, packet)
+	case msgChannelClose:
+		err = m.channelClose(dir, packet)
+	case msgChannelData, msgChannelExtendedData:
+		if m.hasData {
+			packet, err = m.channelData(dir, packet)
+		}
+	case msgChannelRequest:
+		if m.hasRequest {
+			packet, err = m.channelRequest(dir, packet)
+		}
+	case msgChannelSuccess, msgChannelFailure:
+		if m.hasRequest {
+			return m.channelReply(dir, packet)
+		}
+	case msgGlobalRequest:
+		if m.hasGlobal {
+			packet, err = m.globalRequest(dir, packet)
+		}
+	case msgRequestSuccess, msgRequestFailure:
+		if m.hasGlobal {
+			return m.globalReply(dir, packet)
+		}
+	case msgChannelWindowAdjust:
+		if m.trackWindow && dir == FromDownstream {
+			packet, err = m.windowAdjust(packet)
+		}
+	case msgPong:
+		if m.pong(dir, packet) {
+			return nil
+		}
+	}
+
+	if err != nil || packet == nil {
+		return err
+	}
+
+	if m.trackIdle && (packet[0] == msgChannelData || packet[0] == msgChannelExtendedData) {
+		m.lastData.Store(time.Now().UnixNano())
+	}
+
+	return m.send(dir, packet)
+}
+
+// forward writes packet from dir to the other side. With trackWindow, the
+// data of the upstream is charged to the window of the downstream. Once
+// draining, it waits in the queue of its channel if the window is too small,
+// and the messages following it on the channel wait as well, to keep their
+// order. Before, the upstream keeps to the window of the downstream, so the
+// packets are only counted.
+func (m *messagePipe) forward(dir PipeDirection, packet []byte) error {
+	if !m.windowed(dir, packet) {
+		return m.conns[dir.peer()].writePacket(packet)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.forwardLocked(dir, packet)
+}
+
+// forwardLocked is forward for the callers holding m.mu.
+func (m *messagePipe) forwardLocked(dir PipeDirection, packet []byte) error {
+	if !m.windowed(dir, packet) {
+		return m.conns[dir.peer()].writePacket(packet)
+	}
+
+	ch := m.channels[FromDownstream][binary.BigEndian.Uint32(packet[1:5])]
+	if ch == nil || m.drained == nil {
+		if ch != nil && (packet[0] == msgChannelData || packet[0] == msgChannelExtendedData) {
+			ch.window -= min(ch.window, channelDataLen(packet))
+		}
+		return m.conns[dir.peer()].writePacket(packet)
+	}
+
+	ch.queued = append(ch.queued, append([]byte(nil), packet...))
+	return m.flush(ch)
+}
+
+// windowed reports whether packet from dir is charged to, or waits for, the
+// window of the downstream, see forward.
+func (m *messagePipe) windowed(dir PipeDirection, packet []byte) bool {
+	if !m.trackWindow || dir != FromUpstream || len(packet) < 5 {
+		return false
+	}
+
+	switch packet[0] {
+	case msgChannelData, msgChannelExtendedData, msgChannelEOF, msgChannelClose, msgChannelRequest:
+		return true
+	}
+	return false
+}
+
+// flush writes the queued packets of ch to the downstream, as far as its
+// window allows. m.mu must be held.
+func (m *messagePipe) flush(ch *PipedChannel) error {
+	for len(ch.queued) > 0 {
+		packet := ch.queued[0]
+		if packet[0] == msgChannelData || packet[0] == msgChannelExtendedData {
+			n := uint32(channelDataLen(packet))
+			if n > ch.window {
+				return nil
+			}
+			ch.window -= n
+		}
+
+		if err := m.conns[FromDownstream].writePacket(packet); err != nil {
+			return err
+		}
+		ch.queued[0] = nil
+		ch.queued = ch.queued[1:]
+	}
+
+	return nil
+}
+
+// windowAdjust grows the tracked window of the downstream, and forwards to the
+// upstream what is left once the debt of the channel is paid.
+func (m *messagePipe) windowAdjust(packet []byte) ([]byte, error) {
+	var msg windowAdjustMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ch := m.channels[FromUpstream][msg.PeersID]
+	if ch == nil {
+		return packet, nil
+	}
+
+	if ch.window+msg.AdditionalBytes < ch.window {
+		return nil, errors.New("ssh: invalid window update")
+	}
+	ch.window += msg.AdditionalBytes
+	if err := m.flush(ch); err != nil {
+		return nil, err
+	}
+
+	paid := msg.AdditionalBytes
+	if paid > ch.debt {
+		paid = ch.debt
+	}
+	if paid == 0 {
+		return packet, nil
+	}
+	ch.debt -= paid
+	msg.AdditionalBytes -= paid
+	if msg.AdditionalBytes == 0 {
+		return nil, nil
+	}
+
+	return Marshal(&msg), nil
+}
+
+func (m *messagePipe) channelOpen(dir PipeDirection, packet []byte) ([]byte, error) {
+	var msg channelOpenMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	draining := m.drained != nil
+	m.mu.Unlock()
+
+	if draining {
+		return nil, m.conns[dir].writePacket(Marshal(&channelOpenFailureMsg{
+			PeersID: msg.PeersID,
+			Reason:  ConnectionFailed,
+			Message: "shutting down",
+		}))
+	}
+
+	open := &PipedChannelOpen{
+		ChanType:  msg.ChanType,
+		ExtraData: msg.TypeSpecificData,
+	}
+
+	for _, h := range m.hooks {
+		if h.OnChannelOpen == nil {
+			continue
+		}
+
+		verdict, err := h.OnChannelOpen(dir, open)
+		if err != nil {
+			return nil, err
+		}
+
+		if verdict == PipeReject {
+			if open.Reason == 0 {
+				open.Reason = Prohibited
+			}
+
+			return nil, m.conns[dir].writePacket(Marshal(&channelOpenFailureMsg{
+				PeersID: msg.PeersID,
+				Reason:  open.Reason,
+				Message: open.Message,
+			}))
+		}
+	}
+
+	ch := &PipedChannel{
+		ChanType:  open.ChanType,
+		ExtraData: open.ExtraData,
+		OpenedBy:  dir,
+	}
+	ch.setID(dir, msg.PeersID)
+	ch.maxPacket[dir] = msg.MaxPacketSize
+	if dir == FromDownstream {
+		ch.window = msg.PeersWindow
+	}
+
+	m.mu.Lock()
+	m.channels[dir][msg.PeersID] = ch
+	m.mu.Unlock()
+
+	if !m.hasOpen {
+		return packet, nil
+	}
+
+	msg.ChanType = open.ChanType
+	msg.TypeSpecificData = open.ExtraData
+	return Marshal(&msg), nil
+}
+
+func (m *messagePipe) channelOpenConfirm(dir PipeDirection, packet []byte) error {
+	var msg channelOpenConfirmMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if ch := m.channels[dir.peer()][msg.PeersID]; ch != nil && ch.OpenedBy != dir {
+		ch.setID(dir, msg.MyID)
+		ch.maxPacket[dir] = msg.MaxPacketSize
+		if dir == FromDownstream {
+			ch.window = msg.MyWindow
+		}
+		ch.confirmed = true
+		m.channels[dir][msg.MyID] = ch
+	}
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *messagePipe) channelOpenFailure(dir PipeDirection, packet []byte) error {
+	var msg channelOpenFailureMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if ch := m.channels[dir.peer()][msg.PeersID]; ch != nil && ch.OpenedBy != dir {
+		delete(m.channels[dir.peer()], msg.PeersID)
+		m.checkDrained()
+	}
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *messagePipe) channelEOF(dir PipeDirection, packet []byte) error {
+	var msg channelEOFMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if ch := m.channels[dir.peer()][msg.PeersID]; ch != nil {
+		ch.eof[dir] = true
+	}
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *messagePipe) channelClose(dir PipeDirection, packet []byte) error {
+	var msg channelCloseMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	ch := m.channels[dir.peer()][msg.PeersID]
+	if ch == nil {
+		m.mu.Unlock()
+		return nil
+	}
+
+	ch.closed[dir] = true
+	if dir == FromDownstream {
+		// the data is not read anymore, but the close of the upstream is
+		// still expected
+		queued := ch.queued
+		ch.queued = nil
+		for _, p := range queued {
+			if p[0] == msgChannelData || p[0] == msgChannelExtendedData {
+				continue
+			}
+			if err := m.conns[FromDownstream].writePacket(p); err != nil {
+				m.mu.Unlock()
+				return err
+			}
+		}
+	}
+	done := m.removeClosed(ch)
+	m.mu.Unlock()
+
+	if done {
+		m.channelClosed(ch)
+	}
+
+	return nil
+}
+
+// removeClosed removes ch from the channel table once both sides closed it,
+// and reports whether it did. m.mu must be held.
+func (m *messagePipe) removeClosed(ch *PipedChannel) bool {
+	if !ch.closed[FromDownstream] || !ch.closed[FromUpstream] {
+		return false
+	}
+
+	delete(m.channels[FromDownstream], ch.DownstreamID)
+	delete(m.channels[FromUpstream], ch.UpstreamID)
+	if ch.ended {
+		m.ended.Add(-1)
+	}
+	m.checkDrained()
+	return true
+}
+
+// channelClosed runs the OnChannelClose hooks of ch, removed from the table.
+func (m *messagePipe) channelClosed(ch *PipedChannel) {
+	for _, h := range m.hooks {
+		if h.OnChannelClose != nil {
+			h.OnChannelClose(ch)
+		}
+	}
+}
+
+// endChannel closes ch on behalf of both sides, once dir was told the program
+// its request would have started exited: dir gets an EOF and a close from the
+// other side, which gets a close from dir. m.mu must be held.
+func (m *messagePipe) endChannel(dir PipeDirection, ch *PipedChannel) error {
+	// a close is already on its way
+	if ch.ended || ch.closed[FromDownstream] || ch.closed[FromUpstream] {
+		return nil
+	}
+
+	ch.ended = true
+	m.ended.Add(1)
+
+	if !ch.eof[dir.peer()] {
+		ch.eof[dir.peer()] = true
+		if err := m.sendLocked(dir.peer(), Marshal(&channelEOFMsg{PeersID: ch.id(dir)})); err != nil {
+			return err
+		}
+	}
+	if err := m.sendLocked(dir.peer(), Marshal(&channelCloseMsg{PeersID: ch.id(dir)})); err != nil {
+		return err
+	}
+	return m.sendLocked(dir, Marshal(&channelCloseMsg{PeersID: ch.id(dir.peer())}))
+}
+
+// dropEnded reports whether packet from dir is for a channel closed by the
+// piper, and is dropped.
+func (m *messagePipe) dropEnded(dir PipeDirection, packet []byte) bool {
+	switch packet[0] {
+	case msgChannelData, msgChannelExtendedData, msgChannelWindowAdjust, msgChannelEOF,
+		msgChannelClose, msgChannelRequest, msgChannelSuccess, msgChannelFailure:
+	default:
+		return false
+	}
+	if len(packet) < 5 {
+		return false
+	}
+
+	m.mu.Lock()
+	ch := m.channels[dir.peer()][binary.BigEndian.Uint32(packet[1:5])]
+	if ch == nil || !ch.ended {
+		m.mu.Unlock()
+		return false
+	}
+
+	done := false
+	if packet[0] == msgChannelClose {
+		ch.closed[dir] = true
+		done = m.removeClosed(ch)
+	}
+	m.mu.Unlock()
+
+	if done {
+		m.channelClosed(ch)
+	}
+	return true
+}
+
+// drain refuses new channels and writes warning, if non-empty, to the stderr
+// of the open session channels of the downstream. The returned channel is
+// closed once all channels are closed.
+//
+// The warning is charged to the window of the downstream, which requires
+// trackWindow, and is skipped on the sessions whose window is too small. The
+// upstream is not told: the window it believes it has left is paid back out of
+// the next window adjusts of the downstream, and its data beyond the actual
+// window is queued meanwhile.
+func (m *messagePipe) drain(warning string) <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.drained == nil {
+		m.drained = make(chan struct{})
+	}
+
+	if warning != "" && m.trackWindow {
+		for _, ch := range m.channels[FromDownstream] {
+			if ch.ChanType != "session" || !ch.confirmed || ch.eof[FromUpstream] || ch.closed[FromUpstream] ||
+				len(ch.queued) > 0 || uint32(len(warning)) > ch.window {
+				continue
+			}
+
+			var peersID [4]byte
+			binary.BigEndian.PutUint32(peersID[:], ch.DownstreamID)
+
+			limit := len(warning)
+			if ch.maxPacket[FromDownstream] > 0 {
+				limit = int(min(ch.maxPacket[FromDownstream], limit))
+			}
+			for data := []byte(warning); len(data) > 0; {
+				n := min(uint32(limit), len(data))
+				if m.conns[FromDownstream].writePacket(marshalChannelData(peersID[:], 1, data[:n])) != nil {
+					break
+				}
+				ch.window -= n
+				ch.debt += n
+				data = data[n:]
+			}
+		}
+	}
+
+	m.checkDrained()
+	return m.drained
+}
+
+// checkDrained closes drained once draining and no channel is left. m.mu must
+// be held.
+func (m *messagePipe) checkDrained() {
+	if m.drained == nil || m.drainClosed {
+		return
+	}
+
+	if len(m.channels[FromDownstream]) == 0 && len(m.channels[FromUpstream]) == 0 {
+		close(m.drained)
+		m.drainClosed = true
+	}
+}
+
+func (m *messagePipe) channelData(dir PipeDirection, packet []byte) ([]byte, error) {
+	extended := packet[0] == msgChannelExtendedData
+	headerLen := 9
+	if extended {
+		headerLen = 13
+	}
+
+	if len(packet) < headerLen {
+		return nil, parseError(packet[0])
+	}
+
+	ch := m.lookup(dir, binary.BigEndian.Uint32(packet[1:5]))
+	if ch == nil {
+		return packet, nil
+	}
+
+	data := &PipedChannelData{
+		Channel: ch,
+		Data:    packet[headerLen:],
+	}
+	if extended {
+		data.DataType = binary.BigEndian.Uint32(packet[5:9])
+	}
+
+	if length := binary.BigEndian.Uint32(packet[headerLen-4 : headerLen]); int(length) != len(data.Data) {
+		return nil, parseError(packet[0])
+	}
+
+	size := len(data.Data)
+	rejected := false
+
+	for _, h := range m.hooks {
+		if h.OnChannelData == nil {
+			continue
+		}
+
+		verdict, err := h.OnChannelData(dir, data)
+		if err != nil {
+			return nil, err
+		}
+
+		if verdict == PipeReject {
+			rejected = true
+			break
+		}
+	}
+
+	if rejected {
+		data.Data = nil
+	}
+
+	held := ch.held[dir] + data.Held
+	back := size - len(data.Data) - data.Held
+	if held < 0 || back < 0 {
+		return nil, errors.New("ssh: channel data hook forwarded more data than received")
+	}
+	ch.held[dir] = held
+
+	// Give what the receiver will not see back to the sender, otherwise
+	// the sender's window would shrink for good.
+	if back > 0 {
+		if err := m.conns[dir].writePacket(Marshal(&windowAdjustMsg{
+			PeersID:         ch.id(dir),
+			AdditionalBytes: uint32(back),
+		})); err != nil {
+			return nil, err
+		}
+	}
+
+	if rejected || len(data.Data) == 0 {
+		return nil, nil
+	}
+
+	// data added back by hooks may not fit in a single packet
+	out := data.Data
+	if limit := int(ch.maxPacket[dir.peer()]); limit > 0 {
+		for len(out) > limit {
+			if err := m.send(dir, marshalChannelData(packet[1:5], data.DataType, out[:limit])); err != nil {
+				return nil, err
+			}
+			out = out[limit:]
+		}
+	}
+
+	return marshalChannelData(packet[1:5], data.DataType, out), nil
+}
+
+func marshalChannelData(peersID []byte, dataType uint32, data []byte) []byte {
+	if dataType == 0 {
+		p := make([]byte, 9, 9+len(data))
+		p[0] = msgChannelData
+		copy(p[1:5], peersID)
+		binary.BigEndian.PutUint32(p[5:9], uint32(len(data)))
+		return append(p, data...)
+	}
+
+	p := make([]byte, 13, 13+len(data))
+	p[0] = msgChannelExtendedData
+	copy(p[1:5], peersID)
+	binary.BigEndian.PutUint32(p[5:9], dataType)
+	binary.BigEndian.PutUint32(p[9:13], uint32(len(data)))
+	return append(p, data...)
+}
+
+func (m *messagePipe) channelRequest(dir PipeDirection, packet []byte) ([]byte, error) {
+	var msg channelRequestMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return nil, err
+	}
+
+	// forwarding it would bypass the hooks, and the other side would not
+	// know the channel either
+	ch := m.lookup(dir, msg.PeersID)
+	if ch == nil {
+		return nil, fmt.Errorf("ssh: invalid channel %d", msg.PeersID)
+	}
+
+	req := &PipedChannelRequest{
+		Channel:   ch,
+		Type:      msg.Request,
+		WantReply: msg.WantReply,
+		Payload:   msg.RequestSpecificData,
+	}
+
+	for _, h := range m.hooks {
+		if h.OnChannelRequest == nil {
+			continue
+		}
+
+		verdict, err := h.OnChannelRequest(dir, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if verdict == PipeReject {
+			var exit []byte
+			if req.ExitStatus != nil {
+				exit = Marshal(&channelRequestMsg{
+					PeersID:             ch.id(dir),
+					Request:             "exit-status",
+					RequestSpecificData: Marshal(&struct{ Status uint32 }{*req.ExitStatus}),
+				})
+			}
+
+			var end *PipedChannel
+			if exit != nil {
+				end = ch
+			}
+
+			if !msg.WantReply {
+				if exit == nil {
+					return nil, nil
+				}
+				return nil, m.replyLocally(dir, &ch.pending[dir], nil, exit, end)
+			}
+
+			return nil, m.replyLocally(dir, &ch.pending[dir], Marshal(&channelRequestFailureMsg{
+				PeersID: ch.id(dir),
+			}), exit, end)
+		}
+	}
+
+	if msg.WantReply {
+		m.mu.Lock()
+		ch.pending[dir] = append(ch.pending[dir], pendingReply{})
+		m.mu.Unlock()
+	}
+
+	msg.Request = req.Type
+	msg.RequestSpecificData = req.Payload
+	return Marshal(&msg), nil
+}
+
+func (m *messagePipe) channelReply(dir PipeDirection, packet []byte) error {
+	if len(packet) < 5 {
+		return parseError(packet[0])
+	}
+
+	ch := m.lookup(dir, binary.BigEndian.Uint32(packet[1:5]))
+	if ch == nil {
+		return m.send(dir, packet)
+	}
+
+	return m.forwardReply(dir, &ch.pending[dir.peer()], packet, func() []byte {
+		return Marshal(&channelRequestFailureMsg{
+			PeersID: ch.id(dir.peer()),
+		})
+	})
+}
+
+func (m *messagePipe) globalRequest(dir PipeDirection, packet []byte) ([]byte, error) {
+	var msg globalRequestMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return nil, err
+	}
+
+	req := &PipedGlobalRequest{
+		Type:      msg.Type,
+		WantReply: msg.WantReply,
+		Payload:   msg.Data,
+	}
+
+	for _, h := range m.hooks {
+		if h.OnGlobalRequest == nil {
+			continue
+		}
+
+		verdict, err := h.OnGlobalRequest(dir, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if verdict == PipeReject {
+			if !msg.WantReply {
+				return nil, nil
+			}
+
+			return nil, m.replyLocally(dir, &m.globalPending[dir], Marshal(&globalRequestFailureMsg{}), nil, nil)
+		}
+	}
+
+	msg.Type = req.Type
+	msg.Data = req.Payload
+	if !msg.WantReply {
+		return Marshal(&msg), nil
+	}
+
+	// written while holding mu, so the replies of the other side match the
+	// order of the pending requests, keepalive probes included
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.globalPending[dir] = append(m.globalPending[dir], pendingReply{})
+	return nil, m.conns[dir.peer()].writePacket(Marshal(&msg))
+}
+
+func (m *messagePipe) globalReply(dir PipeDirection, packet []byte) error {
+	return m.forwardReply(dir, &m.globalPending[dir.peer()], packet, func() []byte {
+		return Marshal(&globalRequestFailureMsg{})
+	})
+}
+
+// replyLocally answers a rejected request sent by dir, with failure unless
+// nil and followed by after if non-nil, or queues the answer if earlier
+// requests are still waiting for the other side. The answer is sent as if by
+// the other side, behind its delayed data on the channel. The channel end,
+// if non-nil, is then closed, see endChannel.
+func (m *messagePipe) replyLocally(dir PipeDirection, pending *[]pendingReply, failure, after []byte, end *PipedChannel) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(*pending) > 0 {
+		*pending = append(*pending, pendingReply{local: true, after: after, silent: failure == nil, end: end})
+		return nil
+	}
+
+	if failure != nil {
+		if err := m.sendLocked(dir.peer(), failure); err != nil {
+			return err
+		}
+	}
+	if after != nil {
+		if err := m.sendLocked(dir.peer(), after); err != nil {
+			return err
+		}
+	}
+	if end == nil {
+		return nil
+	}
+	return m.endChannel(dir, end)
+}
+
+// forwardReply forwards a reply from dir to the oldest forwarded request,
+// followed by the answers to the rejected requests queued behind it.
+func (m *messagePipe) forwardReply(dir PipeDirection, pending *[]pendingReply, packet []byte, failure func() []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := *pending
+	switch {
+	case len(q) > 0 && q[0].probe:
+		q = q[1:]
+		m.unanswered[dir] = 0
+	default:
+		if len(q) > 0 && !q[0].local {
+			q = q[1:]
+		}
+
+		if err := m.sendLocked(dir, packet); err != nil {
+			return err
+		}
+	}
+
+	for len(q) > 0 && q[0].local {
+		r := q[0]
+		q = q[1:]
+		if !r.silent {
+			if err := m.sendLocked(dir, failure()); err != nil {
+				return err
+			}
+		}
+		if r.after != nil {
+			if err := m.sendLocked(dir, r.after); err != nil {
+				return err
+			}
+		}
+		if r.end != nil {
+			// the requests were sent by the peer of dir
+			if err := m.endChannel(dir.peer(), r.end); err != nil {
+				return err
+			}
+		}
+	}
+
+	*pending = q
+	return nil
+}
+
+// probeData is the payload of the ping@openssh.com probes of the piper, to
+// tell their pongs from the ones of the pings of the other side.
+const probeData = "keepalive@sshpiper"
+
+// probe sends a keepalive to side, as a ping@openssh.com if ping is set, or
+// as a keepalive@openssh.com global request. It reports false, sending
+// nothing, if side left countMax probes unanswered.
+func (m *messagePipe) probe(side PipeDirection, ping bool, countMax int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.unanswered[side] >= countMax {
+		return false, nil
+	}
+	m.unanswered[side]++
+
+	if ping {
+		return true, m.conns[side].writePacket(Marshal(&pingMsg{Data: probeData}))
+	}
+
+	// requests to side are pending in the queue of its peer
+	m.globalPending[side.peer()] = append(m.globalPending[side.peer()], pendingReply{probe: true})
+	return true, m.conns[side].writePacket(Marshal(&globalRequestMsg{
+		Type:      "keepalive@openssh.com",
+		WantReply: true,
+	}))
+}
+
+// pong reports whether a pong from dir answers a probe of the piper.
+func (m *messagePipe) pong(dir PipeDirection, packet []byte) bool {
+	var msg pongMsg
+	if err := Unmarshal(packet, &msg); err != nil || msg.Data != probeData {
+		return false
+	}
+
+	m.mu.Lock()
+	m.unanswered[dir] = 0
+	m.mu.Unlock()
+	return true
+}
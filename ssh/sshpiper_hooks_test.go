@@ -0,0 +1,540 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+func noneAuthUpstream(handler serverType, t *testing.T) func(conn ConnMetadata, challengeCtx ChallengeContext) (*Upstream, error) {
+	return func(conn ConnMetadata, challengeCtx ChallengeContext) (*Upstream, error) {
+		s, err := dialUpstream(handler, &ServerConfig{NoClientAuth: true}, t)
+		return &Upstream{
+			Conn: s,
+			ClientConfig: ClientConfig{
+				HostKeyCallback: InsecureIgnoreHostKey(),
+			},
+		}, err
+	}
+}
+
+func dialPiperClient(piper *PiperConfig, waiter func(*PiperConn), t *testing.T) *Client {
+	c, err := dialPiper(piper, nil, waiter, t)
+	if err != nil {
+		t.Fatalf("connect dial to piper: %v", err)
+	}
+
+	sshc, chans, reqs, err := NewClientConn(c, "", &ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("can connect to piper %v", err)
+	}
+
+	return NewClient(sshc, chans, reqs)
+}
+
+func echoThroughSession(conn *Client, data []byte, t *testing.T) []byte {
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe failed: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe failed: %v", err)
+	}
+
+	if _, err := stdin.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	stdin.Close()
+
+	res, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	return res
+}
+
+func TestPiperMessageHooksRejectChannelOpen(t *testing.T) {
+	var mu sync.Mutex
+	opens := 0
+	closed := make(chan string, 1)
+
+	conn := dialPiperClient(&PiperConfig{
+		NoClientAuthCallback: noneAuthUpstream(simpleEchoHandler, t),
+	}, func(p *PiperConn) {
+		p.WaitWithMessageHooks(&MessageHooks{
+			OnChannelOpen: func(dir PipeDirection, msg *PipedChannelOpen) (PipeVerdict, error) {
+				if dir != FromDownstream {
+					t.Errorf("channel opened from %v", dir)
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				opens++
+				if opens == 1 {
+					msg.Reason = ResourceShortage
+					msg.Message = "try again"
+					return PipeReject, nil
+				}
+
+				return PipeForward, nil
+			},
+			OnChannelClose: func(ch *PipedChannel) {
+				closed <- ch.ChanType
+			},
+		})
+	}, t)
+	defer conn.Close()
+
+	_, err := conn.NewSession()
+	var openErr *OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ResourceShortage || openErr.Message != "try again" {
+		t.Fatalf("got %v, want rejected channel open", err)
+	}
+
+	if res := echoThroughSession(conn, []byte("0000"), t); string(res) != "0000" {
+		t.Fatalf("got %q after rejected open, want %q", res, "0000")
+	}
+
+	if typ := <-closed; typ != "session" {
+		t.Fatalf("got close of %q channel, want session", typ)
+	}
+}
+
+func TestPiperMessageHooksChannelRequest(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+
+	handler := func(ch Channel, in <-chan *Request, t *testing.T) {
+		defer ch.Close()
+		for req := range in {
+			mu.Lock()
+			seen = append(seen, req.Type+":"+string(req.Payload[4:]))
+			mu.Unlock()
+
+			req.Reply(true, nil)
+			if req.Type == "shell" {
+				break
+			}
+		}
+	}
+
+	conn := dialPiperClient(&PiperConfig{
+		NoClientAuthCallback: noneAuthUpstream(handler, t),
+	}, func(p *PiperConn) {
+		p.WaitWithMessageHooks(&MessageHooks{
+			OnChannelRequest: func(dir PipeDirection, msg *PipedChannelRequest) (PipeVerdict, error) {
+				if msg.Channel.ChanType != "session" {
+					t.Errorf("request on %q channel", msg.Channel.ChanType)
+				}
+
+				switch msg.Type {
+				case "exec":
+					return PipeReject, nil
+				case "subsystem":
+					msg.Type = "shell"
+					msg.Payload = Marshal(struct{ S string }{"rewritten"})
+				}
+
+				return PipeForward, nil
+			},
+		})
+	}, t)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if err := session.Setenv("A", "b"); err != nil {
+		t.Fatalf("Setenv: %v", err)
+	}
+
+	if err := session.Start("forbidden"); err == nil {
+		t.Fatalf("exec request not rejected")
+	}
+
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		t.Fatalf("RequestSubsystem: %v", err)
+	}
+
+	session.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 2 || seen[0][:4] != "env:" || seen[1] != "shell:rewritten" {
+		t.Fatalf("upstream got requests %q", seen)
+	}
+}
+
+func TestPiperMessageHooksGlobalRequest(t *testing.T) {
+	c, err := dialPiper(&PiperConfig{
+		NoClientAuthCallback: func(conn ConnMetadata, challengeCtx ChallengeContext) (*Upstream, error) {
+			c, s, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+
+			go func() {
+				config := &ServerConfig{NoClientAuth: true}
+				config.AddHostKey(testSigners["rsa"])
+
+				_, chans, reqs, err := NewServerConn(s, config)
+				if err != nil {
+					t.Errorf("cannot start upstream %v", err)
+					return
+				}
+
+				go func() {
+					for req := range reqs {
+						req.Reply(true, nil)
+					}
+				}()
+				for newCh := range chans {
+					newCh.Reject(UnknownChannelType, "unknown channel type")
+				}
+			}()
+
+			return &Upstream{
+				Conn: c,
+				ClientConfig: ClientConfig{
+					HostKeyCallback: InsecureIgnoreHostKey(),
+				},
+			}, nil
+		},
+	}, nil, func(p *PiperConn) {
+		p.WaitWithMessageHooks(&MessageHooks{
+			OnGlobalRequest: func(dir PipeDirection, msg *PipedGlobalRequest) (PipeVerdict, error) {
+				if msg.Type == "deny@test" {
+					return PipeReject, nil
+				}
+
+				return PipeForward, nil
+			},
+		})
+	}, t)
+	if err != nil {
+		t.Fatalf("connect dial to piper: %v", err)
+	}
+
+	sshc, chans, reqs, err := NewClientConn(c, "", &ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("can connect to piper %v", err)
+	}
+	conn := NewClient(sshc, chans, reqs)
+	defer conn.Close()
+
+	for _, typ := range []string{"allow@test", "deny@test", "allow@test"} {
+		ok, _, err := conn.SendRequest(typ, true, nil)
+		if err != nil || ok != (typ == "allow@test") {
+			t.Fatalf("SendRequest(%q) = %v, %v", typ, ok, err)
+		}
+	}
+}
+
+func TestPiperMessageHooksRejectData(t *testing.T) {
+	conn := dialPiperClient(&PiperConfig{
+		NoClientAuthCallback: noneAuthUpstream(simpleEchoHandler, t),
+	}, func(p *PiperConn) {
+		p.WaitWithMessageHooks(&MessageHooks{
+			OnChannelData: func(dir PipeDirection, msg *PipedChannelData) (PipeVerdict, error) {
+				if dir == FromDownstream && bytes.HasPrefix(msg.Data, []byte("x")) {
+					return PipeReject, nil
+				}
+
+				if dir == FromDownstream && bytes.HasPrefix(msg.Data, []byte("short")) {
+					msg.Data = msg.Data[:2]
+				}
+
+				return PipeForward, nil
+			},
+		})
+	}, t)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe failed: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe failed: %v", err)
+	}
+
+	// more than the channel window, so the writes only finish if the
+	// dropped data is given back to the sender
+	junk := bytes.Repeat([]byte("x"), 1<<15)
+	for i := 0; i < 3*channelWindowSize/len(junk); i++ {
+		if _, err := stdin.Write(junk); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	if _, err := stdin.Write([]byte("shortened")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := stdin.Write([]byte("ok")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	stdin.Close()
+
+	res, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	if string(res) != "shok" {
+		t.Fatalf("got %q, want %q", res, "shok")
+	}
+}
+
+func TestPiperMessageHooksHoldData(t *testing.T) {
+	var held []byte
+
+	conn := dialPiperClient(&PiperConfig{
+		NoClientAuthCallback: noneAuthUpstream(simpleEchoHandler, t),
+	}, func(p *PiperConn) {
+		p.WaitWithMessageHooks(&MessageHooks{
+			OnChannelData: func(dir PipeDirection, msg *PipedChannelData) (PipeVerdict, error) {
+				if dir != FromDownstream {
+					return PipeForward, nil
+				}
+
+				// hold everything until the end marker
+				held = append(held, msg.Data...)
+				if !bytes.HasSuffix(held, []byte("!")) {
+					msg.Held += len(msg.Data)
+					msg.Data = nil
+					return PipeForward, nil
+				}
+
+				msg.Held -= len(held) - len(msg.Data)
+				msg.Data, held = held, nil
+				return PipeForward, nil
+			},
+		})
+	}, t)
+	defer conn.Close()
+
+	// released at once, the data exceeds the packet size of the receiver
+	data := append(bytes.Repeat([]byte("x"), 3*channelMaxPacket), '!')
+	if got := echoThroughSession(conn, data, t); !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes through the session, want %d", len(got), len(data))
+	}
+}
+
+func TestPiperMessageHooksUnknownChannelRequest(t *testing.T) {
+	downstream, _ := memPipe()
+	upstream, _ := memPipe()
+	defer downstream.Close()
+	defer upstream.Close()
+
+	m := newMessagePipe(downstream, upstream, []*MessageHooks{{
+		OnChannelRequest: func(dir PipeDirection, msg *PipedChannelRequest) (PipeVerdict, error) {
+			return PipeReject, nil
+		},
+	}})
+
+	// a request for a channel the piper does not know must not bypass the hooks
+	err := m.handle(FromDownstream, Marshal(&channelRequestMsg{
+		PeersID:   7,
+		Request:   "exec",
+		WantReply: true,
+	}))
+	if err == nil {
+		t.Fatal("request for an unknown channel was accepted")
+	}
+}
+
+func TestPiperHookDropsEmptyPacket(t *testing.T) {
+	src, peer := memPipe()
+	downstream, _ := memPipe()
+	upstream, _ := memPipe()
+	defer downstream.Close()
+	defer upstream.Close()
+
+	if err := peer.writePacket([]byte{msgIgnore}); err != nil {
+		t.Fatal(err)
+	}
+	peer.Close()
+
+	m := newMessagePipe(downstream, upstream, nil)
+	err := piping(FromDownstream, src, func(msg []byte) ([]byte, error) {
+		return []byte{}, nil
+	}, m)
+	if err != io.EOF {
+		t.Fatalf("got %v, want io.EOF once the source is closed", err)
+	}
+}
+
+func TestPiperDrainWarningWindow(t *testing.T) {
+	downstream, downPeer := memPipe()
+	upstream, upPeer := memPipe()
+	defer downstream.Close()
+	defer upstream.Close()
+
+	m := newMessagePipe(downstream, upstream, nil)
+	m.trackWindow = true
+
+	handle := func(dir PipeDirection, msg interface{}) {
+		t.Helper()
+		if err := m.handle(dir, Marshal(msg)); err != nil {
+			t.Fatalf("handle %T: %v", msg, err)
+		}
+	}
+	read := func(c packetConn) []byte {
+		t.Helper()
+		p, err := c.readPacket()
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		return p
+	}
+
+	handle(FromDownstream, &channelOpenMsg{ChanType: "session", PeersID: 1, PeersWindow: 16, MaxPacketSize: 4})
+	read(upPeer)
+	handle(FromUpstream, &channelOpenConfirmMsg{PeersID: 1, MyID: 2, MyWindow: 1 << 20, MaxPacketSize: 1 << 15})
+	read(downPeer)
+
+	m.drain("going down\n")
+
+	// the warning is split to the packet size of the downstream
+	var warning []byte
+	for len(warning) < len("going down\n") {
+		p := read(downPeer)
+		if p[0] != msgChannelExtendedData || len(p)-13 > 4 {
+			t.Fatalf("got packet %v, want stderr data of at most 4 bytes", p)
+		}
+		warning = append(warning, p[13:]...)
+	}
+	if string(warning) != "going down\n" {
+		t.Fatalf("got warning %q", warning)
+	}
+
+	// 5 bytes are left of the window of the downstream, the upstream still
+	// believes it has 16
+	handle(FromUpstream, &channelDataMsg{PeersID: 1, Length: 8, Rest: []byte("12345678")})
+	handle(FromUpstream, &channelEOFMsg{PeersID: 1})
+
+	// the adjust pays the debt first, and lets the queue through
+	handle(FromDownstream, &windowAdjustMsg{PeersID: 2, AdditionalBytes: 11})
+	if p := read(downPeer); p[0] != msgChannelData || string(p[9:]) != "12345678" {
+		t.Fatalf("got %v, want the queued data", p)
+	}
+	if p := read(downPeer); p[0] != msgChannelEOF {
+		t.Fatalf("got %v, want the queued EOF", p)
+	}
+
+	handle(FromDownstream, &windowAdjustMsg{PeersID: 2, AdditionalBytes: 8})
+	var adjust windowAdjustMsg
+	if err := Unmarshal(read(upPeer), &adjust); err != nil || adjust.AdditionalBytes != 8 {
+		t.Fatalf("got adjust %+v, %v, want 8 bytes", adjust, err)
+	}
+}
+
+func TestPiperMessageHooksExitStatusOrder(t *testing.T) {
+	downstream, downPeer := memPipe()
+	upstream, upPeer := memPipe()
+	defer downstream.Close()
+	defer upstream.Close()
+
+	status := uint32(126)
+	m := newMessagePipe(downstream, upstream, []*MessageHooks{{
+		OnChannelRequest: func(dir PipeDirection, req *PipedChannelRequest) (PipeVerdict, error) {
+			if req.Type == "exec" {
+				req.ExitStatus = &status
+				return PipeReject, nil
+			}
+			return PipeForward, nil
+		},
+	}})
+
+	handle := func(dir PipeDirection, msg interface{}) {
+		t.Helper()
+		if err := m.handle(dir, Marshal(msg)); err != nil {
+			t.Fatalf("handle %T: %v", msg, err)
+		}
+	}
+	read := func(c packetConn) []byte {
+		t.Helper()
+		p, err := c.readPacket()
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		return p
+	}
+
+	handle(FromDownstream, &channelOpenMsg{ChanType: "session", PeersID: 1, PeersWindow: 1 << 20, MaxPacketSize: 1 << 15})
+	read(upPeer)
+	handle(FromUpstream, &channelOpenConfirmMsg{PeersID: 1, MyID: 2, MyWindow: 1 << 20, MaxPacketSize: 1 << 15})
+	read(downPeer)
+
+	// the exit status of the rejected exec waits for the reply to pty-req
+	handle(FromDownstream, &channelRequestMsg{PeersID: 2, Request: "pty-req", WantReply: true})
+	read(upPeer)
+	handle(FromDownstream, &channelRequestMsg{PeersID: 2, Request: "exec", RequestSpecificData: Marshal(&execMsg{Command: "id"})})
+	handle(FromUpstream, &channelRequestSuccessMsg{PeersID: 1})
+
+	if p := read(downPeer); p[0] != msgChannelSuccess {
+		t.Fatalf("got %v, want the reply to pty-req", p)
+	}
+	var msg channelRequestMsg
+	if err := Unmarshal(read(downPeer), &msg); err != nil || msg.Request != "exit-status" {
+		t.Fatalf("got %+v, %v, want exit-status", msg, err)
+	}
+
+	// then the session is closed on both sides
+	for _, want := range []byte{msgChannelEOF, msgChannelClose} {
+		if p := read(downPeer); p[0] != want {
+			t.Fatalf("got %v, want message %d", p, want)
+		}
+	}
+	if p := read(upPeer); p[0] != msgChannelClose {
+		t.Fatalf("got %v, want the close of the upstream", p)
+	}
+
+	// the packets still on their way are dropped, the closes end the channel
+	handle(FromUpstream, &channelDataMsg{PeersID: 1, Length: 2, Rest: []byte("hi")})
+	handle(FromUpstream, &channelCloseMsg{PeersID: 1})
+	handle(FromDownstream, &channelCloseMsg{PeersID: 2})
+
+	m.mu.Lock()
+	left := len(m.channels[FromDownstream]) + len(m.channels[FromUpstream])
+	m.mu.Unlock()
+	if left != 0 || m.ended.Load() != 0 {
+		t.Errorf("%d channels left in the table, %d ended, want none", left, m.ended.Load())
+	}
+
+	downstream.Close()
+	if p, err := downPeer.readPacket(); err == nil {
+		t.Errorf("got %v forwarded to the downstream, want nothing", p)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"time"
+)
+
+// probeWithPing reports whether side is probed with ping@openssh.com. Only
+// the upstreams advertising it are: a peer not supporting it would never
+// answer, and the pongs of a pooled upstream do not reach its downstreams.
+func (p *PiperConn) probeWithPing(side PipeDirection) bool {
+	if !p.config.KeepalivePing || side == FromDownstream {
+		return false
+	}
+
+	if _, pooled := p.upstreamConn.(*pooledConn); pooled {
+		return false
+	}
+	_, ok := p.upstream.extensions["ping@openssh.com"]
+	return ok
+}
+
+// watchdog ends the piped connection of m once it is idle, reached its
+// maximum duration, or a side stopped answering the keepalive probes.
+func (p *PiperConn) watchdog(m *messagePipe) {
+	config := p.config
+
+	var idle, expired, keepalive <-chan time.Time
+	if config.IdleTimeout > 0 {
+		t := time.NewTimer(config.IdleTimeout)
+		defer t.Stop()
+		idle = t.C
+	}
+	if config.MaxSessionDuration > 0 {
+		t := time.NewTimer(config.MaxSessionDuration)
+		defer t.Stop()
+		expired = t.C
+	}
+	if config.KeepaliveInterval > 0 {
+		t := time.NewTicker(config.KeepaliveInterval)
+		defer t.Stop()
+		keepalive = t.C
+	}
+
+	countMax := config.KeepaliveCountMax
+	if countMax <= 0 {
+		countMax = 3
+	}
+
+	for {
+		select {
+		case <-m.done:
+			return
+
+		case now := <-idle:
+			last := time.Unix(0, m.lastData.Load())
+			if left := config.IdleTimeout - now.Sub(last); left > 0 {
+				idle = time.After(left)
+				continue
+			}
+
+			p.end(ErrIdleTimeout, 11, "idle timeout") // SSH_DISCONNECT_BY_APPLICATION
+			return
+
+		case <-expired:
+			p.end(ErrMaxSessionDuration, 11, "maximum session duration reached") // SSH_DISCONNECT_BY_APPLICATION
+			return
+
+		case <-keepalive:
+			for _, side := range []PipeDirection{FromDownstream, FromUpstream} {
+				alive, err := m.probe(side, p.probeWithPing(side), countMax)
+				if err != nil {
+					// the piping of side fails as well
+					return
+				}
+
+				if !alive {
+					p.end(&PipeError{side, ErrKeepaliveTimeout}, 10, side.String()+" not responding") // SSH_DISCONNECT_CONNECTION_LOST
+					return
+				}
+			}
+		}
+	}
+}
+
+// end ends the piped connection on behalf of the piper, sending
+// SSH_MSG_DISCONNECT with reason and message to both sides. Wait returns err.
+func (p *PiperConn) end(err error, reason uint32, message string) {
+	p.mu.Lock()
+	if p.ended == nil {
+		p.ended = err
+	}
+	p.mu.Unlock()
+
+	msg := Marshal(&disconnectMsg{
+		Reason:  reason,
+		Message: message,
+	})
+	p.downstream.transport.writePacket(msg)
+	p.upstreamConn.writePacket(msg)
+	p.Close()
+}
@@ -0,0 +1,165 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func waitError(piper *PiperConfig, t *testing.T) (*Client, <-chan error) {
+	errs := make(chan error, 1)
+	conn := dialPiperClient(piper, func(p *PiperConn) {
+		errs <- p.Wait()
+	}, t)
+	return conn, errs
+}
+
+func TestPiperIdleTimeout(t *testing.T) {
+	conn, errs := waitError(&PiperConfig{
+		NoClientAuthCallback: noneAuthUpstream(simpleEchoHandler, t),
+		IdleTimeout:          300 * time.Millisecond,
+	}, t)
+	defer conn.Close()
+
+	// activity postpones the timeout
+	for i := 0; i < 3; i++ {
+		time.Sleep(150 * time.Millisecond)
+		if got := echoThroughSession(conn, []byte("active"), t); string(got) != "active" {
+			t.Fatalf("got %q through the session, want %q", got, "active")
+		}
+	}
+
+	select {
+	case err := <-errs:
+		if err != ErrIdleTimeout {
+			t.Fatalf("Wait: got %v, want ErrIdleTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle piped connection not closed")
+	}
+}
+
+func TestPiperMaxSessionDuration(t *testing.T) {
+	start := time.Now()
+	conn, errs := waitError(&PiperConfig{
+		NoClientAuthCallback: noneAuthUpstream(simpleEchoHandler, t),
+		MaxSessionDuration:   200 * time.Millisecond,
+	}, t)
+	defer conn.Close()
+
+	select {
+	case err := <-errs:
+		if err != ErrMaxSessionDuration {
+			t.Fatalf("Wait: got %v, want ErrMaxSessionDuration", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("piped connection not closed")
+	}
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("piped connection closed after %v", elapsed)
+	}
+}
+
+func TestPiperKeepaliveTimeout(t *testing.T) {
+	conn, errs := waitError(&PiperConfig{
+		NoClientAuthCallback: func(conn ConnMetadata, challengeCtx ChallengeContext) (*Upstream, error) {
+			c, s, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+
+			go func() {
+				defer s.Close()
+
+				config := &ServerConfig{NoClientAuth: true}
+				config.AddHostKey(testSigners["rsa"])
+
+				// never reading the requests stalls the upstream
+				sc, _, _, err := NewServerConn(s, config)
+				if err != nil {
+					return
+				}
+				sc.Wait()
+			}()
+
+			return &Upstream{
+				Conn: c,
+				ClientConfig: ClientConfig{
+					HostKeyCallback: InsecureIgnoreHostKey(),
+				},
+			}, nil
+		},
+		KeepaliveInterval: 50 * time.Millisecond,
+		KeepaliveCountMax: 2,
+	}, t)
+	defer conn.Close()
+
+	select {
+	case err := <-errs:
+		var pipeErr *PipeError
+		if !errors.As(err, &pipeErr) || pipeErr.Side != FromUpstream || pipeErr.Err != ErrKeepaliveTimeout {
+			t.Fatalf("Wait: got %v, want the keepalive of the upstream timing out", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("unresponsive upstream not detected")
+	}
+}
+
+func TestPiperKeepalive(t *testing.T) {
+	for _, ping := range []bool{false, true} {
+		conn, errs := waitError(&PiperConfig{
+			NoClientAuthCallback: noneAuthUpstream(simpleEchoHandler, t),
+			KeepaliveInterval:    10 * time.Millisecond,
+			KeepaliveCountMax:    5,
+			KeepalivePing:        ping,
+		}, t)
+
+		deadline := time.Now().Add(300 * time.Millisecond)
+		for time.Now().Before(deadline) {
+			if got := echoThroughSession(conn, []byte("alive"), t); string(got) != "alive" {
+				t.Fatalf("ping %v: got %q through the session, want %q", ping, got, "alive")
+			}
+
+			// the replies of the upstream are not mixed up with the probes
+			ok, _, err := conn.SendRequest("test", true, nil)
+			if ok || err != nil {
+				t.Fatalf("ping %v: got reply %v %v, want the rejection of the upstream", ping, ok, err)
+			}
+		}
+
+		select {
+		case err := <-errs:
+			t.Fatalf("ping %v: piped connection ended with %v", ping, err)
+		default:
+		}
+
+		conn.Close()
+		<-errs
+	}
+}
+
+func TestPiperProbeWithPing(t *testing.T) {
+	for _, tt := range []struct {
+		side       PipeDirection
+		extensions map[string][]byte
+		want       bool
+	}{
+		{FromUpstream, map[string][]byte{"ping@openssh.com": []byte("0")}, true},
+		{FromUpstream, map[string][]byte{"server-sig-algs": nil}, false},
+		{FromUpstream, nil, false},
+		{FromDownstream, map[string][]byte{"ping@openssh.com": []byte("0")}, false},
+	} {
+		p := &PiperConn{
+			config:   &PiperConfig{KeepalivePing: true},
+			upstream: &upstream{extensions: tt.extensions},
+		}
+		if got := p.probeWithPing(tt.side); got != tt.want {
+			t.Errorf("%v with extensions %q: got ping %v, want %v", tt.side, tt.extensions, got, tt.want)
+		}
+	}
+}
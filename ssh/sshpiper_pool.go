@@ -0,0 +1,708 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// UpstreamPool shares authenticated upstream connections between piped
+// connections. Downstreams mapped to the same address, user and
+// Upstream.PoolIdentity open their channels on one upstream connection,
+// instead of each connecting and authenticating again.
+//
+// The channels of each downstream are isolated from the others: channel
+// numbers are translated, and the replies to global requests are routed to
+// the downstream which sent them. Global requests of the upstream are
+// answered by the pool, and the channels it opens are only accepted for the
+// remote forwardings requested by a downstream. The rekeys of the upstream
+// are reported to all the downstreams sharing it, none of which may request
+// one, see PiperConn.RequestRekey.
+//
+// Downstreams sharing a connection all act as the upstream user
+// authenticated by the first one, and joining it skips the authentication
+// with the upstream. PoolIdentity must therefore name the credentials used
+// for the upstream, and only the downstreams entitled to them may be given
+// it: upstreams with an empty PoolIdentity are never pooled. Neither are
+// upstreams authenticated on behalf of the downstream, with
+// DownstreamAgentAuth or Certificate, upstreams sent the addresses of the
+// downstream with ProxyProtocol and upstreams with a Conn.
+type UpstreamPool struct {
+	// MaxDownstreams, if non-zero, is the number of downstreams sharing an
+	// upstream connection. Further downstreams open another connection.
+	MaxDownstreams int
+
+	// IdleTimeout, if non-zero, keeps an upstream connection open for that
+	// long after its last downstream is gone, to be reused by the next ones.
+	IdleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[poolKey][]*pooledUpstream
+}
+
+type poolKey struct {
+	address  string
+	user     string
+	identity string
+}
+
+// poolKey returns the key of upstream in its pool, and whether it can be
+// pooled.
+func (u *Upstream) poolKey() (poolKey, bool) {
+	if u.Pool == nil || u.PoolIdentity == "" || u.Conn != nil || u.DownstreamAgentAuth != nil || u.Certificate != nil ||
+		u.ProxyProtocol != 0 {
+		return poolKey{}, false
+	}
+
+	return poolKey{
+		address:  u.Address,
+		user:     u.User,
+		identity: u.PoolIdentity,
+	}, true
+}
+
+// join returns a connection to the upstream of key, if one is pooled. kex
+// is called for the rekeys of the upstream while the downstream shares it.
+func (pool *UpstreamPool) join(key poolKey, kex func(NegotiatedAlgorithms, bool)) (*upstream, *pooledConn) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for _, u := range pool.conns[key] {
+		if c := u.join(pool.MaxDownstreams, kex); c != nil {
+			return u.conn, c
+		}
+	}
+
+	return nil, nil
+}
+
+// newUpstream returns the pooledUpstream of key, whose connection is yet to
+// be dialed with its kexCallback, and added with add.
+func (pool *UpstreamPool) newUpstream(key poolKey) *pooledUpstream {
+	return &pooledUpstream{
+		pool:     pool,
+		key:      key,
+		members:  make(map[*pooledConn]struct{}),
+		channels: make(map[uint32]*pooledChannel),
+		forwards: make(map[tcpipForward]*pooledConn),
+	}
+}
+
+// add pools conn, freshly authenticated, as u, and returns the connection of
+// its first downstream.
+func (pool *UpstreamPool) add(u *pooledUpstream, conn *upstream, kex func(NegotiatedAlgorithms, bool)) *pooledConn {
+	u.conn = conn
+	c := u.join(0, kex)
+
+	pool.mu.Lock()
+	if pool.conns == nil {
+		pool.conns = make(map[poolKey][]*pooledUpstream)
+	}
+	pool.conns[u.key] = append(pool.conns[u.key], u)
+	pool.mu.Unlock()
+
+	go u.demux()
+
+	return c
+}
+
+func (pool *UpstreamPool) remove(u *pooledUpstream) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	conns := pool.conns[u.key]
+	for i, c := range conns {
+		if c == u {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+
+	if len(conns) == 0 {
+		delete(pool.conns, u.key)
+	} else {
+		pool.conns[u.key] = conns
+	}
+}
+
+// Len returns the number of pooled upstream connections.
+func (pool *UpstreamPool) Len() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	n := 0
+	for _, conns := range pool.conns {
+		n += len(conns)
+	}
+	return n
+}
+
+// pooledUpstream is an upstream connection shared by downstreams.
+type pooledUpstream struct {
+	pool *UpstreamPool
+	key  poolKey
+	conn *upstream
+
+	// mu guards the fields below.
+	mu      sync.Mutex
+	members map[*pooledConn]struct{}
+	closed  bool
+	idle    *time.Timer
+
+	// channels maps the channel numbers allocated by the pool for the
+	// channels of the downstreams.
+	channels map[uint32]*pooledChannel
+	nextID   uint32
+
+	// globalPending holds the senders of the global requests waiting for a
+	// reply, in order. It holds nil for the senders gone since.
+	globalPending []pendingGlobal
+
+	// forwards maps the remote forwardings to the downstreams requesting them.
+	forwards map[tcpipForward]*pooledConn
+}
+
+type pendingGlobal struct {
+	from *pooledConn
+
+	// forward is the forwarding requested, if any.
+	forward *tcpipForward
+}
+
+type tcpipForward struct {
+	Addr string
+	Port uint32
+}
+
+// pooledChannel is a channel of a downstream on a pooled upstream connection.
+type pooledChannel struct {
+	from *pooledConn
+
+	// downID is the number of the channel allocated by the downstream, upID
+	// the one allocated by the upstream, once confirmed.
+	downID    uint32
+	upID      uint32
+	confirmed bool
+
+	sentClose     bool
+	receivedClose bool
+}
+
+// kexCallback returns the Config.kexCallback of the connection: the first
+// key exchange is reported to first, the kexCallback of the downstream
+// dialing it, and the rekeys to all the downstreams sharing it.
+func (u *pooledUpstream) kexCallback(first func(NegotiatedAlgorithms, bool)) func(NegotiatedAlgorithms, bool) {
+	return func(algs NegotiatedAlgorithms, isFirst bool) {
+		if isFirst {
+			if first != nil {
+				first(algs, true)
+			}
+			return
+		}
+
+		u.mu.Lock()
+		var members []func(NegotiatedAlgorithms, bool)
+		for c := range u.members {
+			if c.kex != nil {
+				members = append(members, c.kex)
+			}
+		}
+		u.mu.Unlock()
+
+		for _, kex := range members {
+			kex(algs, false)
+		}
+	}
+}
+
+// join adds a downstream, unless max downstreams share the connection.
+func (u *pooledUpstream) join(max int, kex func(NegotiatedAlgorithms, bool)) *pooledConn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed || (max > 0 && len(u.members) >= max) {
+		return nil
+	}
+
+	if u.idle != nil {
+		if !u.idle.Stop() {
+			// the timer already fired and the connection is closing
+			return nil
+		}
+		u.idle = nil
+	}
+
+	c := &pooledConn{
+		u:       u,
+		kex:     kex,
+		upIDs:   make(map[uint32]*pooledChannel),
+		opening: make(map[uint32]bool),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	u.members[c] = struct{}{}
+
+	return c
+}
+
+// leave removes a downstream, closing its channels. The packets to write to
+// the upstream are returned, and whether the connection must then be closed.
+func (u *pooledUpstream) leave(c *pooledConn) (out [][]byte, last bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, ok := u.members[c]; !ok {
+		return nil, false
+	}
+	delete(u.members, c)
+
+	for id, ch := range u.channels {
+		if ch.from != c {
+			continue
+		}
+
+		if ch.confirmed && !ch.sentClose {
+			ch.sentClose = true
+			out = append(out, Marshal(&channelCloseMsg{PeersID: ch.upID}))
+		}
+
+		if ch.sentClose && ch.receivedClose {
+			delete(u.channels, id)
+		}
+	}
+
+	for id := range c.opening {
+		out = append(out, Marshal(&channelOpenFailureMsg{
+			PeersID: id,
+			Reason:  ConnectionFailed,
+			Message: "downstream gone",
+		}))
+	}
+
+	for f, from := range u.forwards {
+		if from != c {
+			continue
+		}
+		delete(u.forwards, f)
+
+		out = append(out, Marshal(&globalRequestMsg{
+			Type: "cancel-tcpip-forward",
+			Data: Marshal(&f),
+		}))
+	}
+
+	for i := range u.globalPending {
+		if u.globalPending[i].from == c {
+			u.globalPending[i].from = nil
+		}
+	}
+
+	if len(u.members) == 0 && !u.closed {
+		if u.pool.IdleTimeout == 0 {
+			return out, true
+		}
+		u.idle = time.AfterFunc(u.pool.IdleTimeout, u.closeIdle)
+	}
+
+	return out, false
+}
+
+func (u *pooledUpstream) closeIdle() {
+	u.close(true)
+}
+
+// close closes the connection, only if it has no downstream left if idle is
+// set. The pool is locked before the connection, so it is removed from the
+// pool once unlocked.
+func (u *pooledUpstream) close(idle bool) {
+	u.mu.Lock()
+	if u.closed || (idle && len(u.members) > 0) {
+		u.mu.Unlock()
+		return
+	}
+	u.closed = true
+	u.mu.Unlock()
+
+	u.pool.remove(u)
+	u.conn.transport.Close()
+}
+
+func (u *pooledUpstream) write(packets [][]byte) error {
+	for _, p := range packets {
+		if err := u.conn.transport.writePacket(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// demux reads the packets of the upstream and routes them to the downstreams.
+func (u *pooledUpstream) demux() {
+	var err error
+	for {
+		var packet []byte
+		packet, err = u.conn.transport.readPacket()
+		if err != nil {
+			break
+		}
+
+		if err = u.write(u.route(packet)); err != nil {
+			break
+		}
+	}
+
+	u.close(false)
+
+	u.mu.Lock()
+	members := u.members
+	u.members = nil
+	u.mu.Unlock()
+
+	for c := range members {
+		c.fail(err)
+	}
+}
+
+// route delivers a packet of the upstream to its downstream, and returns the
+// packets to write back to the upstream.
+func (u *pooledUpstream) route(packet []byte) [][]byte {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	switch packet[0] {
+	case msgChannelOpen:
+		var msg channelOpenMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return nil
+		}
+
+		var c *pooledConn
+		if msg.ChanType == "forwarded-tcpip" {
+			var f tcpipForward
+			if err := Unmarshal(msg.TypeSpecificData, &f); err == nil {
+				c = u.forwards[f]
+			}
+		}
+
+		if c == nil {
+			return [][]byte{Marshal(&channelOpenFailureMsg{
+				PeersID: msg.PeersID,
+				Reason:  Prohibited,
+				Message: "channel not accepted on a pooled connection",
+			})}
+		}
+
+		c.opening[msg.PeersID] = true
+		c.deliver(packet)
+
+	case msgChannelOpenConfirm, msgChannelOpenFailure, msgChannelWindowAdjust, msgChannelData, msgChannelExtendedData,
+		msgChannelEOF, msgChannelClose, msgChannelRequest, msgChannelSuccess, msgChannelFailure:
+		if len(packet) < 5 {
+			return nil
+		}
+
+		id := binary.BigEndian.Uint32(packet[1:5])
+		ch, ok := u.channels[id]
+		if !ok {
+			return nil
+		}
+		binary.BigEndian.PutUint32(packet[1:5], ch.downID)
+
+		_, alive := u.members[ch.from]
+
+		switch packet[0] {
+		case msgChannelOpenConfirm:
+			if len(packet) < 9 {
+				return nil
+			}
+			ch.confirmed = true
+			ch.upID = binary.BigEndian.Uint32(packet[5:9])
+			ch.from.upIDs[ch.upID] = ch
+
+			if !alive {
+				ch.sentClose = true
+				return [][]byte{Marshal(&channelCloseMsg{PeersID: ch.upID})}
+			}
+		case msgChannelOpenFailure:
+			delete(u.channels, id)
+		case msgChannelClose:
+			ch.receivedClose = true
+			if ch.sentClose {
+				delete(u.channels, id)
+				delete(ch.from.upIDs, ch.upID)
+			}
+		}
+
+		if alive {
+			ch.from.deliver(packet)
+		}
+
+	case msgGlobalRequest:
+		var msg globalRequestMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return nil
+		}
+
+		if msg.WantReply {
+			return [][]byte{Marshal(&globalRequestFailureMsg{})}
+		}
+
+	case msgRequestSuccess, msgRequestFailure:
+		if len(u.globalPending) == 0 {
+			return nil
+		}
+		pending := u.globalPending[0]
+		u.globalPending = u.globalPending[1:]
+
+		if pending.from == nil {
+			if pending.forward != nil && packet[0] == msgRequestSuccess {
+				// the downstream left before its forwarding was set up
+				return [][]byte{Marshal(&globalRequestMsg{
+					Type: "cancel-tcpip-forward",
+					Data: Marshal(pending.forward),
+				})}
+			}
+			return nil
+		}
+
+		if pending.forward != nil && packet[0] == msgRequestSuccess {
+			f := *pending.forward
+			if f.Port == 0 && len(packet) >= 5 {
+				f.Port = binary.BigEndian.Uint32(packet[1:5])
+			}
+			u.forwards[f] = pending.from
+		}
+
+		pending.from.deliver(packet)
+	}
+
+	return nil
+}
+
+// send translates a packet of downstream c, and returns it unless it must
+// not reach the upstream.
+func (u *pooledUpstream) send(c *pooledConn, packet []byte) ([]byte, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, ok := u.members[c]; !ok {
+		return nil, errors.New("ssh: pooled upstream connection closed")
+	}
+
+	switch packet[0] {
+	case msgChannelOpen:
+		var msg channelOpenMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return nil, err
+		}
+
+		msg.PeersID = u.allocate(c, msg.PeersID)
+		return Marshal(&msg), nil
+
+	case msgChannelOpenConfirm:
+		var msg channelOpenConfirmMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return nil, err
+		}
+
+		if !c.opening[msg.PeersID] {
+			return nil, fmt.Errorf("ssh: downstream confirmed unknown channel %d", msg.PeersID)
+		}
+		delete(c.opening, msg.PeersID)
+
+		id := u.allocate(c, msg.MyID)
+		ch := u.channels[id]
+		ch.confirmed = true
+		ch.upID = msg.PeersID
+		c.upIDs[ch.upID] = ch
+
+		msg.MyID = id
+		return Marshal(&msg), nil
+
+	case msgChannelOpenFailure:
+		if len(packet) < 5 {
+			return nil, parseError(packet[0])
+		}
+
+		id := binary.BigEndian.Uint32(packet[1:5])
+		if !c.opening[id] {
+			return nil, fmt.Errorf("ssh: downstream refused unknown channel %d", id)
+		}
+		delete(c.opening, id)
+
+	case msgChannelWindowAdjust, msgChannelData, msgChannelExtendedData,
+		msgChannelEOF, msgChannelClose, msgChannelRequest, msgChannelSuccess, msgChannelFailure:
+		if len(packet) < 5 {
+			return nil, parseError(packet[0])
+		}
+
+		id := binary.BigEndian.Uint32(packet[1:5])
+		ch, ok := c.upIDs[id]
+		if !ok {
+			return nil, fmt.Errorf("ssh: downstream sent to unknown channel %d", id)
+		}
+
+		if packet[0] == msgChannelClose {
+			if ch.sentClose {
+				return nil, nil
+			}
+			ch.sentClose = true
+			if ch.receivedClose {
+				delete(c.upIDs, id)
+				for pid, pch := range u.channels {
+					if pch == ch {
+						delete(u.channels, pid)
+						break
+					}
+				}
+			}
+		}
+
+	case msgGlobalRequest:
+		var msg globalRequestMsg
+		if err := Unmarshal(packet, &msg); err != nil {
+			return nil, err
+		}
+
+		var forward *tcpipForward
+		switch msg.Type {
+		case "tcpip-forward":
+			var f tcpipForward
+			if err := Unmarshal(msg.Data, &f); err == nil {
+				forward = &f
+			}
+		case "cancel-tcpip-forward":
+			var f tcpipForward
+			if err := Unmarshal(msg.Data, &f); err == nil && u.forwards[f] == c {
+				delete(u.forwards, f)
+			}
+		}
+
+		if msg.WantReply {
+			u.globalPending = append(u.globalPending, pendingGlobal{
+				from:    c,
+				forward: forward,
+			})
+
+			// written under the lock, so the requests reach the upstream
+			// in the order of their replies in globalPending
+			return nil, u.conn.transport.writePacket(packet)
+		}
+
+	case msgRequestSuccess, msgRequestFailure:
+		// the global requests of the upstream are answered by the pool
+		return nil, nil
+
+	case msgDisconnect, msgIgnore, msgDebug, msgUnimplemented:
+		// the connection is shared, and not the downstream's to end
+		return nil, nil
+	}
+
+	return packet, nil
+}
+
+// allocate returns a new channel number for the channel downID of c.
+func (u *pooledUpstream) allocate(c *pooledConn, downID uint32) uint32 {
+	for {
+		id := u.nextID
+		u.nextID++
+
+		if _, ok := u.channels[id]; !ok {
+			u.channels[id] = &pooledChannel{
+				from:   c,
+				downID: downID,
+			}
+			return id
+		}
+	}
+}
+
+// pooledConn is the packetConn of a downstream to a pooled upstream
+// connection.
+type pooledConn struct {
+	u *pooledUpstream
+
+	// kex is the kexCallback of the PiperConn of the downstream, see
+	// pooledUpstream.kexCallback.
+	kex func(NegotiatedAlgorithms, bool)
+
+	// upIDs maps the channel numbers allocated by the upstream to the
+	// channels of the downstream, opening holds the channels opened by the
+	// upstream the downstream has yet to answer. Both are guarded by the
+	// mutex of u.
+	upIDs   map[uint32]*pooledChannel
+	opening map[uint32]bool
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	err    error
+	closed bool
+}
+
+func (c *pooledConn) deliver(packet []byte) {
+	c.mu.Lock()
+	c.queue = append(c.queue, packet)
+	c.mu.Unlock()
+	c.cond.Signal()
+}
+
+func (c *pooledConn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+func (c *pooledConn) readPacket() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.queue) == 0 && c.err == nil {
+		c.cond.Wait()
+	}
+
+	if len(c.queue) == 0 {
+		return nil, c.err
+	}
+
+	p := c.queue[0]
+	c.queue = c.queue[1:]
+	return p, nil
+}
+
+func (c *pooledConn) writePacket(packet []byte) error {
+	p, err := c.u.send(c, packet)
+	if err != nil || p == nil {
+		return err
+	}
+
+	return c.u.conn.transport.writePacket(p)
+}
+
+// Close leaves the pooled connection, closing the channels of the downstream.
+func (c *pooledConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	c.fail(errors.New("ssh: pooled upstream connection closed"))
+
+	out, last := c.u.leave(c)
+	err := c.u.write(out)
+	if last {
+		c.u.close(true)
+	}
+	return err
+}
@@ -0,0 +1,281 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pooledUpstreamServer serves sessions with simpleEchoHandler and replies to
+// the global requests with their payload.
+func pooledUpstreamServer(s net.Conn, t *testing.T) {
+	defer s.Close()
+
+	config := &ServerConfig{NoClientAuth: true}
+	config.AddHostKey(testSigners["rsa"])
+
+	_, chans, reqs, err := NewServerConn(s, config)
+	if err != nil {
+		t.Errorf("cannot start upstream %v", err)
+		return
+	}
+
+	go func() {
+		for req := range reqs {
+			req.Reply(true, req.Payload)
+		}
+	}()
+
+	for newCh := range chans {
+		ch, inReqs, err := newCh.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			continue
+		}
+		go DiscardRequests(inReqs)
+		go simpleEchoHandler(ch, inReqs, t)
+	}
+}
+
+func pooledPiper(pool *UpstreamPool, identity string, dials *atomic.Int32, t *testing.T) *PiperConfig {
+	return &PiperConfig{
+		NoClientAuthCallback: func(conn ConnMetadata, challengeCtx ChallengeContext) (*Upstream, error) {
+			return &Upstream{
+				DialFunc: func(ctx context.Context) (net.Conn, error) {
+					dials.Add(1)
+					c, s, err := netPipe()
+					if err != nil {
+						return nil, err
+					}
+					go pooledUpstreamServer(s, t)
+					return c, nil
+				},
+				Pool:         pool,
+				PoolIdentity: identity,
+				ClientConfig: ClientConfig{
+					User:            "up",
+					HostKeyCallback: InsecureIgnoreHostKey(),
+				},
+			}, nil
+		},
+	}
+}
+
+func TestPiperUpstreamPool(t *testing.T) {
+	pool := &UpstreamPool{}
+	var dials atomic.Int32
+
+	var wg sync.WaitGroup
+	waiter := func(p *PiperConn) {
+		defer wg.Done()
+		p.Wait()
+	}
+
+	wg.Add(2)
+	a := dialPiperClient(pooledPiper(pool, "none", &dials, t), waiter, t)
+	b := dialPiperClient(pooledPiper(pool, "none", &dials, t), waiter, t)
+
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("dialed the upstream %d times, want 1", n)
+	}
+	if n := pool.Len(); n != 1 {
+		t.Fatalf("got %d pooled connections, want 1", n)
+	}
+
+	// both downstreams number their first channel 0
+	open, err := a.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+
+	if got := echoThroughSession(b, []byte("from b"), t); string(got) != "from b" {
+		t.Errorf("got %q through the session of b, want %q", got, "from b")
+	}
+	if got := echoThroughSession(a, []byte("from a"), t); string(got) != "from a" {
+		t.Errorf("got %q through the session of a, want %q", got, "from a")
+	}
+	open.Close()
+
+	// the replies to global requests go to their sender
+	var replies sync.WaitGroup
+	for _, c := range []*Client{a, b} {
+		for i := 0; i < 10; i++ {
+			replies.Add(1)
+			go func(c *Client, payload string) {
+				defer replies.Done()
+				ok, reply, err := c.SendRequest("test", true, []byte(payload))
+				if err != nil || !ok || string(reply) != payload {
+					t.Errorf("got reply %v %q %v, want %q", ok, reply, err, payload)
+				}
+			}(c, c.LocalAddr().String()+string(rune('0'+i)))
+		}
+	}
+	replies.Wait()
+
+	a.Close()
+	b.Close()
+	wg.Wait()
+
+	if n := pool.Len(); n != 0 {
+		t.Errorf("got %d pooled connections once the downstreams left, want 0", n)
+	}
+}
+
+func TestPiperUpstreamPoolGlobalRequests(t *testing.T) {
+	pool := &UpstreamPool{}
+	var dials atomic.Int32
+
+	var wg sync.WaitGroup
+	waiter := func(p *PiperConn) {
+		defer wg.Done()
+		p.Wait()
+	}
+
+	clients := make([]*Client, 4)
+	for i := range clients {
+		wg.Add(1)
+		clients[i] = dialPiperClient(pooledPiper(pool, "none", &dials, t), waiter, t)
+	}
+
+	// the replies follow the requests of all the downstreams in order
+	var replies sync.WaitGroup
+	for i, c := range clients {
+		for j := 0; j < 50; j++ {
+			replies.Add(1)
+			go func(c *Client, payload string) {
+				defer replies.Done()
+				ok, reply, err := c.SendRequest("test", true, []byte(payload))
+				if err != nil || !ok || string(reply) != payload {
+					t.Errorf("got reply %v %q %v, want %q", ok, reply, err, payload)
+				}
+			}(c, fmt.Sprintf("%d-%d", i, j))
+		}
+	}
+	replies.Wait()
+
+	for _, c := range clients {
+		c.Close()
+	}
+	wg.Wait()
+}
+
+func TestPiperUpstreamPoolNoIdentity(t *testing.T) {
+	pool := &UpstreamPool{}
+	var dials atomic.Int32
+
+	var wg sync.WaitGroup
+	waiter := func(p *PiperConn) {
+		defer wg.Done()
+		p.Wait()
+	}
+
+	// nothing tells whether the downstreams may act as the same upstream user
+	wg.Add(2)
+	a := dialPiperClient(pooledPiper(pool, "", &dials, t), waiter, t)
+	b := dialPiperClient(pooledPiper(pool, "", &dials, t), waiter, t)
+
+	if n := dials.Load(); n != 2 {
+		t.Errorf("dialed the upstream %d times, want 2", n)
+	}
+	if n := pool.Len(); n != 0 {
+		t.Errorf("got %d pooled connections, want 0", n)
+	}
+
+	a.Close()
+	b.Close()
+	wg.Wait()
+}
+
+func TestPiperUpstreamPoolRekey(t *testing.T) {
+	pool := &UpstreamPool{}
+	var dials atomic.Int32
+
+	rekeys := make(chan ConnMetadata, 2)
+	piped := make(chan *PiperConn, 2)
+	var wg sync.WaitGroup
+	waiter := func(p *PiperConn) {
+		defer wg.Done()
+		piped <- p
+		p.Wait()
+	}
+
+	pipers := make([]*PiperConn, 2)
+	for i := range pipers {
+		config := pooledPiper(pool, "none", &dials, t)
+		config.RekeyCallback = func(conn ConnMetadata, side PipeDirection, algs NegotiatedAlgorithms, challengeCtx ChallengeContext) {
+			if side == FromUpstream {
+				rekeys <- conn
+			}
+		}
+
+		wg.Add(1)
+		c := dialPiperClient(config, waiter, t)
+		defer c.Close()
+		pipers[i] = <-piped
+	}
+
+	if err := pipers[1].RequestRekey(FromUpstream); err == nil {
+		t.Error("RequestRekey of a pooled upstream succeeded")
+	}
+
+	pipers[0].upstream.transport.requestKeyExchange()
+
+	seen := map[ConnMetadata]bool{}
+	for len(seen) < 2 {
+		select {
+		case conn := <-rekeys:
+			seen[conn] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("rekey reported to %d downstreams, want 2", len(seen))
+		}
+	}
+}
+
+func TestPiperUpstreamPoolLimits(t *testing.T) {
+	pool := &UpstreamPool{
+		MaxDownstreams: 1,
+		IdleTimeout:    time.Hour,
+	}
+	var dials atomic.Int32
+
+	var wg sync.WaitGroup
+	waiter := func(p *PiperConn) {
+		defer wg.Done()
+		p.Wait()
+	}
+
+	wg.Add(2)
+	a := dialPiperClient(pooledPiper(pool, "none", &dials, t), waiter, t)
+	b := dialPiperClient(pooledPiper(pool, "none", &dials, t), waiter, t)
+
+	if n := dials.Load(); n != 2 {
+		t.Fatalf("dialed the upstream %d times, want 2", n)
+	}
+
+	a.Close()
+	b.Close()
+	wg.Wait()
+
+	if n := pool.Len(); n != 2 {
+		t.Fatalf("got %d idle pooled connections, want 2", n)
+	}
+
+	wg.Add(1)
+	c := dialPiperClient(pooledPiper(pool, "none", &dials, t), waiter, t)
+	if n := dials.Load(); n != 2 {
+		t.Errorf("dialed the upstream %d times, want the idle connection reused", n)
+	}
+	if got := echoThroughSession(c, []byte("idle"), t); string(got) != "idle" {
+		t.Errorf("got %q through the session, want %q", got, "idle")
+	}
+	c.Close()
+	wg.Wait()
+}
@@ -0,0 +1,244 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The PROXY protocol of HAProxy carries the addresses of the client through
+// proxies and load balancers, in a header sent before anything else.
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// proxyV1MaxLen is the maximum length of a version 1 header, CRLF
+	// included.
+	proxyV1MaxLen = 107
+
+	proxyV2Local = 0x20
+	proxyV2Proxy = 0x21
+
+	proxyV2Unspec = 0x00
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+)
+
+// proxiedConn is a connection whose addresses were received in a PROXY
+// protocol header.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr { return c.remote }
+func (c *proxiedConn) LocalAddr() net.Addr  { return c.local }
+
+// readProxyHeader reads the PROXY protocol header, version 1 or 2, at the
+// start of conn, and returns conn with the addresses of the header. Headers
+// without addresses, such as the health checks of the proxy, leave the
+// addresses of conn. Nothing past the header is read.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	// shorter than any header
+	start := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(conn, start); err != nil {
+		return nil, fmt.Errorf("ssh: reading PROXY header: %w", err)
+	}
+
+	var remote, local net.Addr
+	var err error
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		remote, local, err = readProxyV2(conn)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		remote, local, err = readProxyV1(conn, start)
+	default:
+		err = errors.New("ssh: connection did not start with a PROXY header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if remote == nil {
+		return conn, nil
+	}
+
+	return &proxiedConn{
+		Conn:   conn,
+		remote: remote,
+		local:  local,
+	}, nil
+}
+
+func readProxyV1(conn net.Conn, start []byte) (net.Addr, net.Addr, error) {
+	line := start
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, nil, errors.New("ssh: PROXY header too long")
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return nil, nil, fmt.Errorf("ssh: reading PROXY header: %w", err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("ssh: invalid PROXY header %q", line)
+	}
+
+	remote, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	local, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return remote, local, nil
+}
+
+func parseProxyV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("ssh: invalid address %q in PROXY header", host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: invalid port %q in PROXY header", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyV2(conn net.Conn) (net.Addr, net.Addr, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, nil, fmt.Errorf("ssh: reading PROXY header: %w", err)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, nil, fmt.Errorf("ssh: reading PROXY header: %w", err)
+	}
+
+	switch hdr[0] {
+	case proxyV2Local:
+		return nil, nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("ssh: unsupported PROXY header version and command %#x", hdr[0])
+	}
+
+	var ipLen int
+	switch hdr[1] {
+	case proxyV2TCP4:
+		ipLen = net.IPv4len
+	case proxyV2TCP6:
+		ipLen = net.IPv6len
+	default:
+		// UDP and unix sockets do not address SSH clients
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("ssh: PROXY header too short for its addresses")
+	}
+
+	remote := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	local := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+
+	return remote, local, nil
+}
+
+// writeProxyHeader writes the PROXY protocol header of version to the
+// connection of an upstream, carrying the addresses of downstream.
+func writeProxyHeader(c net.Conn, version int, downstream ConnMetadata) error {
+	header, err := proxyHeader(version, downstream.RemoteAddr(), downstream.LocalAddr())
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	if _, err := c.Write(header); err != nil {
+		c.Close()
+		return err
+	}
+
+	return nil
+}
+
+// proxyHeader returns the PROXY protocol header of version carrying remote
+// and local, the addresses of a client and of the server it connected to.
+func proxyHeader(version int, remote, local net.Addr) ([]byte, error) {
+	src, srcOK := remote.(*net.TCPAddr)
+	dst, dstOK := local.(*net.TCPAddr)
+
+	// both addresses must be of the same family
+	tcp4 := srcOK && dstOK && src.IP.To4() != nil && dst.IP.To4() != nil
+	tcp6 := srcOK && dstOK && !tcp4 && src.IP.To4() == nil && dst.IP.To4() == nil
+
+	switch version {
+	case 1:
+		switch {
+		case tcp4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP.To4(), dst.IP.To4(), src.Port, dst.Port)), nil
+		case tcp6:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", src.IP.To16(), dst.IP.To16(), src.Port, dst.Port)), nil
+		default:
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+
+	case 2:
+		header := append([]byte{}, proxyV2Signature...)
+
+		var family byte
+		var payload []byte
+		switch {
+		case tcp4:
+			family = proxyV2TCP4
+			payload = append(append(payload, src.IP.To4()...), dst.IP.To4()...)
+		case tcp6:
+			family = proxyV2TCP6
+			payload = append(append(payload, src.IP.To16()...), dst.IP.To16()...)
+		default:
+			family = proxyV2Unspec
+		}
+		if payload != nil {
+			payload = binary.BigEndian.AppendUint16(payload, uint16(src.Port))
+			payload = binary.BigEndian.AppendUint16(payload, uint16(dst.Port))
+		}
+
+		header = append(header, proxyV2Proxy, family)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+		return append(header, payload...), nil
+
+	default:
+		return nil, fmt.Errorf("ssh: unsupported PROXY protocol version %d", version)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// headerConn is a net.Conn reading from r, for the PROXY headers.
+type headerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *headerConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *headerConn) RemoteAddr() net.Addr       { return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1} }
+func (c *headerConn) LocalAddr() net.Addr        { return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2} }
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		remote, local *net.TCPAddr
+	}{
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51234}, &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 22}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 22}},
+	} {
+		for _, version := range []int{1, 2} {
+			header, err := proxyHeader(version, tt.remote, tt.local)
+			if err != nil {
+				t.Fatalf("proxyHeader(%d): %v", version, err)
+			}
+
+			r := bytes.NewReader(append(header, "SSH-2.0-"...))
+			conn, err := readProxyHeader(&headerConn{r: r})
+			if err != nil {
+				t.Fatalf("readProxyHeader(%d): %v", version, err)
+			}
+
+			if got := conn.RemoteAddr().String(); got != tt.remote.String() {
+				t.Errorf("version %d: got remote %s, want %s", version, got, tt.remote)
+			}
+			if got := conn.LocalAddr().String(); got != tt.local.String() {
+				t.Errorf("version %d: got local %s, want %s", version, got, tt.local)
+			}
+			if r.Len() != len("SSH-2.0-") {
+				t.Errorf("version %d: read %d bytes past the header", version, len("SSH-2.0-")-r.Len())
+			}
+		}
+	}
+}
+
+func TestProxyHeaderWithoutAddresses(t *testing.T) {
+	local := append(append([]byte{}, proxyV2Signature...), proxyV2Local, proxyV2Unspec, 0, 0)
+	unknown, err := proxyHeader(1, &net.UnixAddr{Name: "sock"}, &net.UnixAddr{Name: "sock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unspec, err := proxyHeader(2, &net.UnixAddr{Name: "sock"}, &net.UnixAddr{Name: "sock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, header := range [][]byte{local, unknown, unspec} {
+		conn, err := readProxyHeader(&headerConn{r: bytes.NewReader(header)})
+		if err != nil {
+			t.Errorf("readProxyHeader(%q): %v", header, err)
+			continue
+		}
+		if got := conn.RemoteAddr().String(); got != "10.0.0.1:1" {
+			t.Errorf("readProxyHeader(%q): got remote %s, want the address of the connection", header, got)
+		}
+	}
+
+	for _, header := range []string{
+		"SSH-2.0-OpenSSH_9.6\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 51234\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 51234 65536\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 51234 22",
+	} {
+		if _, err := readProxyHeader(&headerConn{r: bytes.NewReader([]byte(header))}); err == nil {
+			t.Errorf("readProxyHeader(%q) succeeded", header)
+		}
+	}
+}
+
+func TestPiperProxyProtocol(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51234}
+	server := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 22}
+
+	var mu sync.Mutex
+	var seen []string
+
+	c, err := dialPiper(&PiperConfig{
+		ProxyProtocol: true,
+		NoClientAuthCallback: func(conn ConnMetadata, challengeCtx ChallengeContext) (*Upstream, error) {
+			mu.Lock()
+			seen = append(seen, "piper "+conn.RemoteAddr().String())
+			mu.Unlock()
+
+			s, err := dialUpstream(simpleEchoHandler, &ServerConfig{
+				ProxyProtocol: true,
+				NoClientAuth:  true,
+				NoClientAuthCallback: func(conn ConnMetadata) (*Permissions, error) {
+					mu.Lock()
+					seen = append(seen, "upstream "+conn.RemoteAddr().String())
+					mu.Unlock()
+					return nil, nil
+				},
+			}, t)
+			return &Upstream{
+				Conn:          s,
+				ProxyProtocol: 2,
+				ClientConfig: ClientConfig{
+					HostKeyCallback: InsecureIgnoreHostKey(),
+				},
+			}, err
+		},
+	}, nil, nil, t)
+	if err != nil {
+		t.Fatalf("dialPiper: %v", err)
+	}
+	defer c.Close()
+
+	header, err := proxyHeader(1, client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(header); err != nil {
+		t.Fatalf("write PROXY header: %v", err)
+	}
+
+	sshc, chans, reqs, err := NewClientConn(c, "", &ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	conn := NewClient(sshc, chans, reqs)
+	defer conn.Close()
+
+	if got := echoThroughSession(conn, []byte("proxied"), t); string(got) != "proxied" {
+		t.Errorf("got %q through the session, want %q", got, "proxied")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"piper " + client.String(), "upstream " + client.String()}
+	if len(seen) != 2 || seen[0] != want[0] || seen[1] != want[1] {
+		t.Errorf("got remote addresses %q, want %q", seen, want)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the bytes of channel data piped per
+// second. A RateLimiter may be shared by many piped connections, to limit
+// their total bandwidth, and its limit may be changed at any time.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing bytesPerSecond, with bursts
+// of up to burst bytes. See SetLimit.
+func NewRateLimiter(bytesPerSecond, burst int) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetLimit(bytesPerSecond, burst)
+	return l
+}
+
+// SetLimit changes the limit to bytesPerSecond, with bursts of up to burst
+// bytes. If burst is zero, one second worth of data is used. A zero
+// bytesPerSecond lifts the limit. Packets already waiting keep their delay,
+// the new limit applies to the following ones.
+func (l *RateLimiter) SetLimit(bytesPerSecond, burst int) {
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// a new bucket starts full
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	}
+
+	l.refill(time.Now())
+	l.rate = float64(bytesPerSecond)
+	l.burst = float64(burst)
+	l.tokens = math.Min(l.tokens, l.burst)
+}
+
+// Limit returns the current limit, see SetLimit.
+func (l *RateLimiter) Limit() (bytesPerSecond, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate), int(l.burst)
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() && l.rate > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller must
+// wait before sending them. Packets larger than the burst are let through by
+// running the bucket into debt, delaying the following packets instead.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// RateLimits holds the limiters of the channel data piped in each direction.
+// A nil limiter leaves its direction unlimited.
+type RateLimits struct {
+	// FromDownstream limits the data sent by the downstream, such as uploads.
+	FromDownstream *RateLimiter
+
+	// FromUpstream limits the data sent by the upstream, such as downloads.
+	FromUpstream *RateLimiter
+}
+
+func (r RateLimits) limiter(dir PipeDirection) *RateLimiter {
+	if dir == FromUpstream {
+		return r.FromUpstream
+	}
+	return r.FromDownstream
+}
+
+// SetRateLimits replaces the limits of this piped connection, such as the ones
+// returned by PiperConfig.ConnRateLimitsCallback, and applies them to the
+// following data packets. The limits of the PiperConfig still apply.
+func (p *PiperConn) SetRateLimits(limits RateLimits) {
+	p.rateLimits[FromDownstream].Store(limits.FromDownstream)
+	p.rateLimits[FromUpstream].Store(limits.FromUpstream)
+}
+
+// RateLimits returns the limits of this piped connection, see SetRateLimits.
+func (p *PiperConn) RateLimits() RateLimits {
+	return RateLimits{
+		FromDownstream: p.rateLimits[FromDownstream].Load(),
+		FromUpstream:   p.rateLimits[FromUpstream].Load(),
+	}
+}
+
+// throttle returns how long n bytes of channel data of dir must wait, as the
+// limits of the connection and of the config require.
+func (p *PiperConn) throttle(dir PipeDirection, n int) time.Duration {
+	var delay time.Duration
+	for _, l := range []*RateLimiter{p.config.RateLimits.limiter(dir), p.rateLimits[dir].Load()} {
+		if l != nil {
+			delay = max(delay, l.reserve(n))
+		}
+	}
+	return delay
+}
+
+// delayQueue holds the packets of one direction waiting for the rate limits,
+// see messagePipe.send. Its size is bounded by the windows of the channels.
+type delayQueue struct {
+	mu      sync.Mutex
+	packets []delayedPacket
+	err     error
+	started bool
+
+	// pending counts the queued packets of each channel, by the channel
+	// number of their recipient.
+	pending map[uint32]int
+
+	// wake is signaled when packets are queued.
+	wake chan struct{}
+}
+
+type delayedPacket struct {
+	packet []byte
+	at     time.Time
+}
+
+// send writes packet from dir to the other side once the rate limits allow.
+// Delayed data waits in the queue of its direction, along with the messages
+// following it on the same channel, to keep their order. The other messages,
+// such as window adjusts and global requests, are never delayed, and neither
+// is the reading of the connection.
+func (m *messagePipe) send(dir PipeDirection, packet []byte) error {
+	return m.sendVia(m.forward, dir, packet)
+}
+
+// sendLocked is send for the callers holding m.mu, such as the answers to
+// requests, which are written in order under it.
+func (m *messagePipe) sendLocked(dir PipeDirection, packet []byte) error {
+	return m.sendVia(m.forwardLocked, dir, packet)
+}
+
+// sendVia is send, writing the packets not delayed with forward.
+func (m *messagePipe) sendVia(forward func(PipeDirection, []byte) error, dir PipeDirection, packet []byte) error {
+	if m.throttle == nil {
+		return forward(dir, packet)
+	}
+
+	var delay time.Duration
+	switch packet[0] {
+	case msgChannelData, msgChannelExtendedData:
+		delay = m.throttle(dir, channelDataLen(packet))
+	case msgChannelEOF, msgChannelClose, msgChannelRequest, msgChannelSuccess, msgChannelFailure:
+	default:
+		return forward(dir, packet)
+	}
+
+	if len(packet) < 5 {
+		return forward(dir, packet)
+	}
+	id := binary.BigEndian.Uint32(packet[1:5])
+
+	q := &m.delayed[dir]
+	q.mu.Lock()
+	if q.err != nil {
+		q.mu.Unlock()
+		return q.err
+	}
+	if delay <= 0 && q.pending[id] == 0 {
+		q.mu.Unlock()
+		return forward(dir, packet)
+	}
+
+	if !q.started {
+		q.started = true
+		q.pending = make(map[uint32]int)
+		q.wake = make(chan struct{}, 1)
+		go m.writeDelayed(dir, q)
+	}
+	q.packets = append(q.packets, delayedPacket{
+		packet: append([]byte(nil), packet...),
+		at:     time.Now().Add(delay),
+	})
+	q.pending[id]++
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeDelayed writes the packets of q, each once its time came, until piping
+// ended or a write failed.
+func (m *messagePipe) writeDelayed(dir PipeDirection, q *delayQueue) {
+	for {
+		q.mu.Lock()
+		if len(q.packets) == 0 {
+			q.mu.Unlock()
+			select {
+			case <-q.wake:
+				continue
+			case <-m.done:
+				return
+			}
+		}
+		next := q.packets[0]
+		q.mu.Unlock()
+
+		if wait := time.Until(next.at); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-m.done:
+				t.Stop()
+				return
+			}
+		}
+
+		err := m.forward(dir, next.packet)
+
+		q.mu.Lock()
+		q.packets[0] = delayedPacket{}
+		q.packets = q.packets[1:]
+		id := binary.BigEndian.Uint32(next.packet[1:5])
+		if q.pending[id]--; q.pending[id] == 0 {
+			delete(q.pending, id)
+		}
+		q.err = err
+		q.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// channelDataLen returns the length of the data carried by a
+// SSH_MSG_CHANNEL_DATA or SSH_MSG_CHANNEL_EXTENDED_DATA packet.
+func channelDataLen(packet []byte) int {
+	// type, recipient channel, and for extended data, data type
+	offset := 5
+	if packet[0] == msgChannelExtendedData {
+		offset = 9
+	}
+
+	if len(packet) < offset+4 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(packet[offset:]))
+}
@@ -0,0 +1,169 @@
+// Copyright 2014 Boshi Lian<farmer1992@gmail.com>. All rights reserved.
+// this file is governed by MIT-license
+//
+// https://github.com/tg123/sshpiper
+package ssh
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	l := NewRateLimiter(1000, 500)
+
+	if d := l.reserve(500); d != 0 {
+		t.Errorf("reserving the burst: got delay %v, want 0", d)
+	}
+	if d := l.reserve(1000); d < 900*time.Millisecond || d > time.Second {
+		t.Errorf("reserving past the burst: got delay %v, want about 1s", d)
+	}
+
+	l.SetLimit(0, 0)
+	if d := l.reserve(1 << 20); d != 0 {
+		t.Errorf("reserving without limit: got delay %v, want 0", d)
+	}
+	if rate, burst := l.Limit(); rate != 0 || burst != 0 {
+		t.Errorf("got limit %d/%d, want 0/0", rate, burst)
+	}
+}
+
+func TestPiperRateLimits(t *testing.T) {
+	global := NewRateLimiter(64<<10, 16<<10)
+	perConn := NewRateLimiter(1<<30, 0)
+	connLimits := make(chan RateLimits, 1)
+
+	conn := dialPiperClient(&PiperConfig{
+		NoClientAuthCallback: noneAuthUpstream(simpleEchoHandler, t),
+		RateLimits:           RateLimits{FromUpstream: global},
+		ConnRateLimitsCallback: func(conn ConnMetadata, challengeCtx ChallengeContext) RateLimits {
+			return RateLimits{FromDownstream: perConn}
+		},
+	}, func(p *PiperConn) {
+		connLimits <- p.RateLimits()
+		p.Wait()
+	}, t)
+	defer conn.Close()
+
+	if got := <-connLimits; got.FromDownstream != perConn || got.FromUpstream != nil {
+		t.Errorf("got connection limits %+v, want the ones of ConnRateLimitsCallback", got)
+	}
+
+	data := bytes.Repeat([]byte("x"), 64<<10)
+
+	start := time.Now()
+	if got := echoThroughSession(conn, data, t); !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes through the session, want %d", len(got), len(data))
+	}
+	// the burst goes through at once, the remaining 48KiB at 64KiB/s
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+		t.Errorf("piped 64KiB at 64KiB/s in %v", elapsed)
+	}
+
+	global.SetLimit(0, 0)
+
+	start = time.Now()
+	if got := echoThroughSession(conn, data, t); !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes through the session, want %d", len(got), len(data))
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("piped 64KiB in %v once the limit was lifted", elapsed)
+	}
+}
+
+func TestPiperThrottleDelaysOnlyData(t *testing.T) {
+	downstream, downPeer := memPipe()
+	upstream, _ := memPipe()
+	defer downstream.Close()
+	defer upstream.Close()
+
+	m := newMessagePipe(downstream, upstream, nil)
+	m.throttle = func(dir PipeDirection, n int) time.Duration {
+		return 100 * time.Millisecond
+	}
+	defer close(m.done)
+
+	start := time.Now()
+	for _, msg := range []interface{}{
+		&channelDataMsg{PeersID: 1, Length: 5, Rest: []byte("hello")},
+		&channelEOFMsg{PeersID: 1},
+		&windowAdjustMsg{PeersID: 1, AdditionalBytes: 5},
+		&channelRequestMsg{PeersID: 2, Request: "keepalive@openssh.com"},
+	} {
+		if err := m.handle(FromUpstream, Marshal(msg)); err != nil {
+			t.Fatalf("handle %T: %v", msg, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("reading was delayed by %v", elapsed)
+	}
+
+	// the data and the EOF following it on its channel wait, the rest does not
+	for _, want := range []byte{msgChannelWindowAdjust, msgChannelRequest, msgChannelData, msgChannelEOF} {
+		p, err := downPeer.readPacket()
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		if p[0] != want {
+			t.Fatalf("got message %d, want %d", p[0], want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("data was forwarded after %v, want it throttled", elapsed)
+	}
+}
+
+func TestPiperThrottleKeepsReplyOrder(t *testing.T) {
+	downstream, downPeer := memPipe()
+	upstream, upPeer := memPipe()
+	defer downstream.Close()
+	defer upstream.Close()
+
+	m := newMessagePipe(downstream, upstream, []*MessageHooks{{
+		OnChannelRequest: func(dir PipeDirection, req *PipedChannelRequest) (PipeVerdict, error) {
+			if req.Type == "x11-req" {
+				return PipeReject, nil
+			}
+			return PipeForward, nil
+		},
+	}})
+	defer close(m.done)
+
+	handle := func(dir PipeDirection, msg interface{}) {
+		t.Helper()
+		if err := m.handle(dir, Marshal(msg)); err != nil {
+			t.Fatalf("handle %T: %v", msg, err)
+		}
+	}
+
+	handle(FromDownstream, &channelOpenMsg{ChanType: "session", PeersID: 1, PeersWindow: 1 << 20, MaxPacketSize: 1 << 15})
+	handle(FromUpstream, &channelOpenConfirmMsg{PeersID: 1, MyID: 2, MyWindow: 1 << 20, MaxPacketSize: 1 << 15})
+	handle(FromDownstream, &channelRequestMsg{PeersID: 2, Request: "pty-req", WantReply: true})
+
+	m.throttle = func(dir PipeDirection, n int) time.Duration {
+		return 100 * time.Millisecond
+	}
+
+	// the reply of the upstream and the local one queued behind it follow
+	// the delayed data of the upstream
+	handle(FromDownstream, &channelRequestMsg{PeersID: 2, Request: "x11-req", WantReply: true})
+	handle(FromUpstream, &channelDataMsg{PeersID: 1, Length: 5, Rest: []byte("hello")})
+	handle(FromUpstream, &channelRequestSuccessMsg{PeersID: 1})
+
+	for _, want := range []byte{msgChannelOpenConfirm, msgChannelData, msgChannelSuccess, msgChannelFailure} {
+		p, err := downPeer.readPacket()
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		if p[0] != want {
+			t.Fatalf("got message %d, want %d", p[0], want)
+		}
+	}
+
+	for _, want := range []byte{msgChannelOpen, msgChannelRequest} {
+		if p, err := upPeer.readPacket(); err != nil || p[0] != want {
+			t.Fatalf("got %v, %v from the piper, want message %d", p, err, want)
+		}
+	}
+}
@@ -6,10 +6,18 @@ package ssh
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func ExampleNewSSHPiperConn() {
@@ -515,7 +523,7 @@ func TestPiperUsernameNotChangedWithinSession(t *testing.T) {
 			}), nil
 		},
 
-		NextAuthMethods: func(conn ConnMetadata, challengeCtx ChallengeContext) ([]string, error) {
+		NextAuthMethods: func(conn ConnMetadata, satisfied []string, challengeCtx ChallengeContext) ([]string, error) {
 			var allow []string
 
 			for k, v := range challengeCtx.(authlistCtx) {
@@ -604,7 +612,7 @@ func TestPiperChallengeContext(t *testing.T) {
 			return fakeChallengerContext{}, nil
 		},
 
-		NextAuthMethods: func(conn ConnMetadata, challengeCtx ChallengeContext) ([]string, error) {
+		NextAuthMethods: func(conn ConnMetadata, satisfied []string, challengeCtx ChallengeContext) ([]string, error) {
 			_, ok := challengeCtx.(fakeChallengerContext)["user"]
 			if !ok {
 				return []string{"keyboard-interactive"}, nil
@@ -674,12 +682,78 @@ func TestPiperChallengeContext(t *testing.T) {
 
 }
 
+func TestPiperPartialSuccess(t *testing.T) {
+	var mu sync.Mutex
+	var lastSatisfied []string
+
+	c, err := dialPiper(&PiperConfig{
+		NextAuthMethods: func(conn ConnMetadata, satisfied []string, challengeCtx ChallengeContext) ([]string, error) {
+			mu.Lock()
+			lastSatisfied = satisfied
+			mu.Unlock()
+
+			if len(satisfied) == 0 {
+				return []string{"password"}, nil
+			}
+			return []string{"keyboard-interactive"}, nil
+		},
+
+		PasswordCallback: func(conn ConnMetadata, password []byte, challengeCtx ChallengeContext) (*Upstream, error) {
+			if string(password) != "password" {
+				return nil, fmt.Errorf("wrong password")
+			}
+			return nil, ErrPartialSuccess
+		},
+
+		KeyboardInteractiveCallback: func(conn ConnMetadata, client KeyboardInteractiveChallenge, challengeCtx ChallengeContext) (*Upstream, error) {
+			ans, err := client("", "", []string{"otp: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if ans[0] != "123456" {
+				return nil, fmt.Errorf("wrong otp")
+			}
+			return noneAuthUpstream(simpleEchoHandler, t)(conn, challengeCtx)
+		},
+	}, nil, nil, t)
+	if err != nil {
+		t.Fatalf("connect dial to piper: %v", err)
+	}
+
+	var passwordResults []authResult
+	_, _, _, err = NewClientConn(c, "", &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			recordedAuth{Password("password"), &passwordResults},
+			KeyboardInteractive(keyboardInteractive{"otp: ": "123456"}.Challenge),
+		},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("can connect to piper %v", err)
+	}
+
+	if want := []authResult{authPartialSuccess}; !reflect.DeepEqual(passwordResults, want) {
+		t.Errorf("got password results %v, want %v", passwordResults, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(lastSatisfied, []string{"password"}) {
+		t.Errorf("got satisfied methods %v, want [password]", lastSatisfied)
+	}
+}
+
 func fakeUpstreamServer(s net.Conn, upstream *ServerConfig, handler serverType, t *testing.T) {
 	defer s.Close()
 
 	upstream.AddHostKey(testSigners["rsa"])
 
 	_, chans, reqs, err := NewServerConn(s, upstream)
+	if _, ok := err.(*ServerAuthError); ok {
+		// the piper hangs up on upstreams rejecting the authentication
+		return
+	}
 	if err != nil {
 		t.Errorf("cannot start upstream %v", err)
 	}
@@ -724,6 +798,9 @@ func TestPiperConnMeta(t *testing.T) {
 			return &Upstream{
 				Conn: s,
 				ClientConfig: ClientConfig{
+					Config: Config{
+						Ciphers: []string{"aes256-ctr"},
+					},
 					User:            "up",
 					HostKeyCallback: InsecureIgnoreHostKey(),
 				},
@@ -739,10 +816,21 @@ func TestPiperConnMeta(t *testing.T) {
 			t.Errorf("different upstream user")
 		}
 
+		if algs := p.DownstreamConnMeta().(AlgorithmsConnMetadata).Algorithms(); algs.Read.Cipher != "aes128-ctr" || algs.Write.Cipher != "aes128-ctr" {
+			t.Errorf("got downstream algorithms %+v, want aes128-ctr", algs)
+		}
+
+		if algs := p.UpstreamConnMeta().(AlgorithmsConnMetadata).Algorithms(); algs.Read.Cipher != "aes256-ctr" || algs.Write.Cipher != "aes256-ctr" {
+			t.Errorf("got upstream algorithms %+v, want aes256-ctr", algs)
+		}
+
 		wait <- 0
 	}, nil, t)
 
 	_, _, _, err = NewClientConn(c, "", &ClientConfig{
+		Config: Config{
+			Ciphers: []string{"aes128-ctr"},
+		},
 		User:            "down",
 		Auth:            []AuthMethod{new(noneAuth)},
 		HostKeyCallback: InsecureIgnoreHostKey(),
@@ -909,3 +997,1014 @@ func TestPiperPipeData(t *testing.T) {
 	}
 	// }}}
 }
+
+func TestPiperPolicy(t *testing.T) {
+	var mu sync.Mutex
+	var denied []string
+
+	c, err := dialPiper(&PiperConfig{
+		NoClientAuthCallback: func(conn ConnMetadata, challengeCtx ChallengeContext) (*Upstream, error) {
+			s, err := dialUpstream(simpleEchoHandler, &ServerConfig{NoClientAuth: true}, t)
+			return &Upstream{
+				Conn: s,
+				ClientConfig: ClientConfig{
+					HostKeyCallback: InsecureIgnoreHostKey(),
+				},
+			}, err
+		},
+		ChannelOpenPolicyCallback: func(conn ConnMetadata, dir PipeDirection, chanType string, extraData []byte, challengeCtx ChallengeContext) error {
+			if chanType == "direct-tcpip" {
+				return &OpenChannelError{Reason: ConnectionFailed, Message: "port forwarding disabled"}
+			}
+			return nil
+		},
+		RequestPolicyCallback: func(conn ConnMetadata, dir PipeDirection, ch *PipedChannel, reqType string, payload []byte, challengeCtx ChallengeContext) error {
+			switch reqType {
+			case "tcpip-forward", "x11-req", "auth-agent-req@openssh.com":
+				mu.Lock()
+				denied = append(denied, reqType)
+				mu.Unlock()
+				return fmt.Errorf("%s disabled", reqType)
+			}
+			return nil
+		},
+	}, nil, nil, t)
+
+	if err != nil {
+		t.Fatalf("connect dial to piper: %v", err)
+	}
+
+	sshc, chans, reqs, err := NewClientConn(c, "", &ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("error create client %v", err)
+	}
+
+	conn := NewClient(sshc, chans, reqs)
+	defer conn.Close()
+
+	_, err = conn.Dial("tcp", "127.0.0.1:22")
+	var openErr *OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ConnectionFailed || openErr.Message != "port forwarding disabled" {
+		t.Fatalf("got %v, want denied direct-tcpip", err)
+	}
+
+	if _, err := conn.Listen("tcp", "127.0.0.1:0"); err == nil {
+		t.Fatalf("tcpip-forward not denied")
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	for _, req := range []string{"x11-req", "auth-agent-req@openssh.com"} {
+		if ok, err := session.SendRequest(req, true, nil); ok || err != nil {
+			t.Fatalf("SendRequest(%q) = %v, %v, want denied", req, ok, err)
+		}
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe failed: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe failed: %v", err)
+	}
+
+	stdin.Write([]byte("0000"))
+	stdin.Close()
+
+	res, err := ioutil.ReadAll(stdout)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	if string(res) != "0000" {
+		t.Fatalf("got %q after denied requests, want %q", res, "0000")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(denied) != 3 {
+		t.Fatalf("denied %q", denied)
+	}
+}
+
+func TestPiperUpstreamFailover(t *testing.T) {
+	var mu sync.Mutex
+	var failures []error
+
+	c, err := dialPiper(&PiperConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte, challengeCtx ChallengeContext) (*Upstream, error) {
+			down, _, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+			down.Close()
+
+			// never answers the version exchange
+			silent, _, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+
+			config := ClientConfig{
+				Auth:            []AuthMethod{Password(string(password))},
+				HostKeyCallback: InsecureIgnoreHostKey(),
+			}
+
+			return &Upstream{
+				Conn:         down,
+				ClientConfig: config,
+				Fallbacks: []*Upstream{
+					{
+						Conn:             silent,
+						ClientConfig:     config,
+						HandshakeTimeout: 100 * time.Millisecond,
+					},
+					{
+						DialFunc: func(ctx context.Context) (net.Conn, error) {
+							return dialUpstream(simpleEchoHandler, &ServerConfig{
+								PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+									return nil, fmt.Errorf("access denied")
+								},
+							}, t)
+						},
+						ClientConfig: config,
+					},
+					{
+						DialFunc: func(ctx context.Context) (net.Conn, error) {
+							return dialUpstream(simpleEchoHandler, &ServerConfig{
+								PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+									return nil, nil
+								},
+							}, t)
+						},
+						ClientConfig: config,
+					},
+				},
+			}, nil
+		},
+		UpstreamAuthFailureCallback: func(conn ConnMetadata, method string, err error, challengeCtx ChallengeContext) {
+			if method != "password" {
+				t.Errorf("got method %q, want password", method)
+			}
+			mu.Lock()
+			failures = append(failures, err)
+			mu.Unlock()
+		},
+	}, nil, nil, t)
+
+	if err != nil {
+		t.Fatalf("connect dial to piper: %v", err)
+	}
+
+	_, _, _, err = NewClientConn(c, "", &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{Password("password")},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("can connect to piper %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(failures) != 3 {
+		t.Fatalf("got failures %v, want 3", failures)
+	}
+
+	if failures[1] != ErrUpstreamHandshakeTimeout {
+		t.Fatalf("got %v, want %v", failures[1], ErrUpstreamHandshakeTimeout)
+	}
+
+	if _, ok := failures[2].(NoMoreMethodsErr); !ok {
+		t.Fatalf("got %v, want NoMoreMethodsErr", failures[2])
+	}
+}
+
+func TestPiperSharedFallback(t *testing.T) {
+	users := make(chan string, 2)
+	shared := &Upstream{
+		DialFunc: func(ctx context.Context) (net.Conn, error) {
+			return dialUpstream(simpleEchoHandler, &ServerConfig{
+				PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+					users <- conn.User()
+					return nil, nil
+				},
+			}, t)
+		},
+		ClientConfig: ClientConfig{
+			Auth:            []AuthMethod{Password("password")},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		},
+	}
+
+	config := &PiperConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte, challengeCtx ChallengeContext) (*Upstream, error) {
+			down, _, err := netPipe()
+			if err != nil {
+				return nil, err
+			}
+			down.Close()
+
+			return &Upstream{
+				Conn:         down,
+				ClientConfig: shared.ClientConfig,
+				Fallbacks:    []*Upstream{shared},
+			}, nil
+		},
+	}
+
+	for _, user := range []string{"alice", "bob"} {
+		c, err := dialPiper(config, nil, nil, t)
+		if err != nil {
+			t.Fatalf("connect dial to piper: %v", err)
+		}
+
+		conn, _, _, err := NewClientConn(c, "", &ClientConfig{
+			User:            user,
+			Auth:            []AuthMethod{Password("password")},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			t.Fatalf("can connect to piper %v", err)
+		}
+		conn.Close()
+
+		if got := <-users; got != user {
+			t.Errorf("the fallback authenticated %q, want %q", got, user)
+		}
+	}
+
+	if shared.User != "" {
+		t.Errorf("the shared fallback was changed to user %q", shared.User)
+	}
+}
+
+func TestPiperContextTimeouts(t *testing.T) {
+	newPiper := func(ctx context.Context, config *PiperConfig) (net.Conn, chan error) {
+		c, s, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+
+		config.AddHostKey(testSigners["rsa"])
+
+		done := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			_, err := NewSSHPiperConnContext(ctx, s, config)
+			done <- err
+		}()
+
+		return c, done
+	}
+
+	t.Run("handshake", func(t *testing.T) {
+		c, done := newPiper(context.Background(), &PiperConfig{
+			HandshakeTimeout: 100 * time.Millisecond,
+		})
+		defer c.Close()
+
+		if err := <-done; err != ErrHandshakeTimeout {
+			t.Fatalf("got %v, want %v", err, ErrHandshakeTimeout)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		c, done := newPiper(ctx, &PiperConfig{})
+		defer c.Close()
+
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		if err := <-done; err != context.Canceled {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		upstreamClosed := make(chan struct{})
+
+		c, done := newPiper(context.Background(), &PiperConfig{
+			AuthTimeout: 200 * time.Millisecond,
+			PasswordCallback: func(conn ConnMetadata, password []byte, challengeCtx ChallengeContext) (*Upstream, error) {
+				return &Upstream{
+					DialFunc: func(ctx context.Context) (net.Conn, error) {
+						// never answers the version exchange
+						c, s, err := netPipe()
+						go func() {
+							io.Copy(io.Discard, s)
+							close(upstreamClosed)
+						}()
+						return c, err
+					},
+					ClientConfig: ClientConfig{
+						HostKeyCallback: InsecureIgnoreHostKey(),
+					},
+				}, nil
+			},
+		})
+		defer c.Close()
+
+		go NewClientConn(c, "", &ClientConfig{
+			User:            "testuser",
+			Auth:            []AuthMethod{Password("password")},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		})
+
+		if err := <-done; err != ErrAuthTimeout {
+			t.Fatalf("got %v, want %v", err, ErrAuthTimeout)
+		}
+
+		<-upstreamClosed
+	})
+}
+
+func TestPiperUpstreamCertificate(t *testing.T) {
+	certs := make(chan *Certificate, 1)
+	certChecker := CertChecker{
+		IsUserAuthority: func(k PublicKey) bool {
+			return bytes.Equal(k.Marshal(), testPublicKeys["ecdsa"].Marshal())
+		},
+	}
+
+	// shared by the connections, it must not collect their certificates
+	shared := &Upstream{
+		DialFunc: func(ctx context.Context) (net.Conn, error) {
+			return dialUpstream(simpleEchoHandler, &ServerConfig{
+				PublicKeyCallback: func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+					perms, err := certChecker.Authenticate(conn, key)
+					if err == nil {
+						certs <- key.(*Certificate)
+					}
+					return perms, err
+				},
+			}, t)
+		},
+		ClientConfig: ClientConfig{
+			User:            "upstreamuser",
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		},
+		Certificate: &UpstreamCertificate{
+			Authority: testSigners["ecdsa"],
+		},
+	}
+
+	c, err := dialPiper(&PiperConfig{
+		PublicKeyCallback: func(conn ConnMetadata, key PublicKey, challengeCtx ChallengeContext) (*Upstream, error) {
+			return shared, nil
+		},
+	}, nil, nil, t)
+
+	if err != nil {
+		t.Fatalf("connect dial to piper: %v", err)
+	}
+
+	sshc, chans, reqs, err := NewClientConn(c, "", &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(testSigners["rsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("can connect to piper %v", err)
+	}
+
+	conn := NewClient(sshc, chans, reqs)
+	defer conn.Close()
+
+	if got := echoThroughSession(conn, []byte("hello"), t); string(got) != "hello" {
+		t.Fatalf("got %q, want hello", got)
+	}
+
+	cert := <-certs
+	if len(cert.ValidPrincipals) != 1 || cert.ValidPrincipals[0] != "upstreamuser" {
+		t.Fatalf("got principals %v, want [upstreamuser]", cert.ValidPrincipals)
+	}
+
+	if fp := FingerprintSHA256(testPublicKeys["rsa"]); !strings.HasPrefix(cert.KeyId, "testuser@") || !strings.HasSuffix(cert.KeyId, " "+fp) {
+		t.Fatalf("got key id %q, want downstream user and %s", cert.KeyId, fp)
+	}
+
+	if _, ok := cert.Permissions.Extensions["permit-pty"]; !ok {
+		t.Fatalf("got extensions %v, want default ones", cert.Permissions.Extensions)
+	}
+
+	if len(shared.Auth) != 0 {
+		t.Fatalf("the shared upstream got %d auth methods, want none", len(shared.Auth))
+	}
+}
+
+type eventLog struct {
+	mu     sync.Mutex
+	events []PiperEvent
+}
+
+func (l *eventLog) Observe(conn ConnMetadata, event PiperEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+func TestPiperObserver(t *testing.T) {
+	log := &eventLog{}
+	done := make(chan error, 1)
+
+	client := dialPiperClient(&PiperConfig{
+		NoClientAuthCallback: noneAuthUpstream(simpleEchoHandler, t),
+		Observer:             log,
+	}, func(p *PiperConn) {
+		done <- p.Wait()
+	}, t)
+
+	if got := echoThroughSession(client, []byte("hello"), t); string(got) != "hello" {
+		t.Fatalf("got %q, want hello", got)
+	}
+
+	client.Conn.(*connection).transport.requestKeyExchange()
+
+	if got := echoThroughSession(client, []byte("world"), t); string(got) != "world" {
+		t.Fatalf("got %q, want world", got)
+	}
+
+	client.Close()
+	<-done
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	var types []string
+	var rekeyed bool
+	var traffic [2]*TrafficEvent
+	for _, e := range log.events {
+		switch e := e.(type) {
+		case *DownstreamHandshakeEvent:
+			if e.ClientVersion != packageVersion || e.Algorithms.KeyExchange == "" || e.Algorithms.Read.Cipher == "" {
+				t.Errorf("got %+v", e)
+			}
+		case *UpstreamHandshakeEvent:
+			if e.Err != nil || e.ServerVersion != packageVersion || e.Algorithms.HostKey == "" {
+				t.Errorf("got %+v", e)
+			}
+		case *RekeyEvent:
+			rekeyed = rekeyed || e.Side == FromDownstream
+			continue
+		case *TrafficEvent:
+			traffic[e.Direction] = e
+		}
+		types = append(types, fmt.Sprintf("%T", e))
+	}
+
+	want := []string{
+		"*ssh.DownstreamHandshakeEvent",
+		"*ssh.UpstreamSelectedEvent",
+		"*ssh.UpstreamHandshakeEvent",
+		"*ssh.AuthAttemptEvent",
+		"*ssh.TrafficEvent",
+		"*ssh.TrafficEvent",
+		"*ssh.DisconnectEvent",
+	}
+	if fmt.Sprint(types) != fmt.Sprint(want) {
+		t.Fatalf("got events %v, want %v", types, want)
+	}
+
+	if !rekeyed {
+		t.Errorf("no downstream rekey event")
+	}
+
+	// the channel data of the echoes, without the headers of the packets
+	for dir, e := range traffic {
+		if e.Packets == 0 || e.Bytes != uint64(len("hello")+len("world")) {
+			t.Errorf("got %+v from %v", e, PipeDirection(dir))
+		}
+	}
+}
+
+func TestPiperObserverTrafficInterval(t *testing.T) {
+	log := &eventLog{}
+
+	client := dialPiperClient(&PiperConfig{
+		NoClientAuthCallback: noneAuthUpstream(simpleEchoHandler, t),
+		Observer:             log,
+		TrafficInterval:      10 * time.Millisecond,
+	}, func(p *PiperConn) {
+		p.Wait()
+	}, t)
+	defer client.Close()
+
+	if got := echoThroughSession(client, []byte("hello"), t); string(got) != "hello" {
+		t.Fatalf("got %q, want hello", got)
+	}
+
+	// the echo is reported while the connection is still piped
+	deadline := time.Now().Add(time.Second)
+	for {
+		var bytes uint64
+		log.mu.Lock()
+		for _, e := range log.events {
+			if e, ok := e.(*TrafficEvent); ok && e.Direction == FromUpstream {
+				bytes += e.Bytes
+			}
+		}
+		log.mu.Unlock()
+
+		if bytes == uint64(len("hello")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d bytes from the upstream in the traffic events, want %d", bytes, len("hello"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPiperObserverDisconnect(t *testing.T) {
+	log := &eventLog{}
+	done := make(chan error, 1)
+
+	client := dialPiperClient(&PiperConfig{
+		NoClientAuthCallback: noneAuthUpstream(simpleEchoHandler, t),
+		Observer:             log,
+	}, func(p *PiperConn) {
+		done <- p.Wait()
+	}, t)
+	defer client.Close()
+
+	if got := echoThroughSession(client, []byte("hello"), t); string(got) != "hello" {
+		t.Fatalf("got %q, want hello", got)
+	}
+
+	if err := client.Conn.(*connection).transport.writePacket(Marshal(&disconnectMsg{
+		Reason:  11, // SSH_DISCONNECT_BY_APPLICATION
+		Message: "bye",
+	})); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	<-done
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	e, ok := log.events[len(log.events)-1].(*DisconnectEvent)
+	if !ok || e.Side != FromDownstream || e.Reason != 11 || e.Message != "bye" {
+		t.Fatalf("got last event %+v, want the disconnect of the downstream", log.events[len(log.events)-1])
+	}
+}
+
+func TestPiperShutdown(t *testing.T) {
+	streamEchoHandler := func(ch Channel, in <-chan *Request, t *testing.T) {
+		defer ch.Close()
+		io.Copy(ch, ch)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		timeout time.Duration
+		want    error
+	}{
+		{"drained", 0, nil},
+		{"deadline", 50 * time.Millisecond, context.DeadlineExceeded},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			piped := make(chan *PiperConn, 1)
+			done := make(chan error, 1)
+			finished := make(chan struct{})
+			defer close(finished)
+
+			client := dialPiperClient(&PiperConfig{
+				NoClientAuthCallback: noneAuthUpstream(streamEchoHandler, t),
+				ShutdownWarning:      "going down\n",
+				ShutdownReason:       7, // SSH_DISCONNECT_SERVICE_NOT_AVAILABLE
+				ShutdownMessage:      "maintenance",
+			}, func(p *PiperConn) {
+				piped <- p
+				done <- p.Wait()
+				// dialPiper closes the client connection once the waiter returns
+				<-finished
+			}, t)
+			defer client.Close()
+
+			ch, reqs, err := client.OpenChannel("session", nil)
+			if err != nil {
+				t.Fatalf("OpenChannel: %v", err)
+			}
+			go DiscardRequests(reqs)
+
+			// a round trip, so the connection is piped
+			if _, err := ch.Write([]byte("hello")); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if _, err := io.ReadFull(ch, make([]byte, 5)); err != nil {
+				t.Fatalf("ReadFull: %v", err)
+			}
+
+			ctx := context.Background()
+			if tt.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			p := <-piped
+			shutdown := make(chan error, 1)
+			go func() {
+				shutdown <- p.Shutdown(ctx)
+			}()
+
+			warning := make([]byte, len("going down\n"))
+			if _, err := io.ReadFull(ch.Stderr(), warning); err != nil || string(warning) != "going down\n" {
+				t.Fatalf("got warning %q, %v", warning, err)
+			}
+
+			var openErr *OpenChannelError
+			if _, _, err := client.OpenChannel("session", nil); !errors.As(err, &openErr) || openErr.Reason != ConnectionFailed {
+				t.Fatalf("got %v, want a new channel refused", err)
+			}
+
+			if tt.want == nil {
+				select {
+				case err := <-shutdown:
+					t.Fatalf("Shutdown returned %v with an open channel", err)
+				default:
+				}
+				ch.Close()
+			}
+
+			if err := <-shutdown; err != tt.want {
+				t.Fatalf("Shutdown: got %v, want %v", err, tt.want)
+			}
+
+			if err := <-done; err != ErrShutdown {
+				t.Fatalf("Wait: got %v, want ErrShutdown", err)
+			}
+
+			var disconnect *disconnectMsg
+			if err := client.Wait(); !errors.As(err, &disconnect) || disconnect.Reason != 7 || disconnect.Message != "maintenance" {
+				t.Fatalf("client Wait: got %v, want the shutdown disconnect", err)
+			}
+		})
+	}
+}
+
+func TestPiperShutdownUpstreamGone(t *testing.T) {
+	upstreamConn := make(chan net.Conn, 1)
+	piped := make(chan *PiperConn, 1)
+	done := make(chan error, 1)
+
+	client := dialPiperClient(&PiperConfig{
+		NoClientAuthCallback: func(conn ConnMetadata, challengeCtx ChallengeContext) (*Upstream, error) {
+			s, err := dialUpstream(simpleEchoHandler, &ServerConfig{NoClientAuth: true}, t)
+			upstreamConn <- s
+			return &Upstream{
+				Conn: s,
+				ClientConfig: ClientConfig{
+					HostKeyCallback: InsecureIgnoreHostKey(),
+				},
+			}, err
+		},
+	}, func(p *PiperConn) {
+		piped <- p
+		done <- p.Wait()
+	}, t)
+	defer client.Close()
+
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	defer ch.Close()
+	go DiscardRequests(reqs)
+
+	// the session is still open when the upstream drops
+	(<-upstreamConn).Close()
+	<-done
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- (<-piped).Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown blocked after piping ended")
+	}
+}
+
+func TestPiperRekey(t *testing.T) {
+	var mu sync.Mutex
+	rekeys := map[PipeDirection]int{}
+	upstreamRekeyed := make(chan NegotiatedAlgorithms, 1)
+
+	piper := &PiperConfig{
+		Config: Config{
+			RekeyThreshold: 1024,
+		},
+		NoClientAuthCallback: func(conn ConnMetadata, challengeCtx ChallengeContext) (*Upstream, error) {
+			s, err := dialUpstream(simpleEchoHandler, &ServerConfig{NoClientAuth: true}, t)
+			return &Upstream{
+				Conn: s,
+				ClientConfig: ClientConfig{
+					Config: Config{
+						Ciphers: []string{"aes256-ctr"},
+					},
+					HostKeyCallback: InsecureIgnoreHostKey(),
+				},
+			}, err
+		},
+		RekeyCallback: func(conn ConnMetadata, side PipeDirection, algs NegotiatedAlgorithms, challengeCtx ChallengeContext) {
+			mu.Lock()
+			rekeys[side]++
+			mu.Unlock()
+
+			if side == FromUpstream {
+				upstreamRekeyed <- algs
+			}
+		},
+	}
+
+	piperConns := make(chan *PiperConn, 1)
+	client := dialPiperClient(piper, func(p *PiperConn) {
+		piperConns <- p
+		p.Wait()
+	}, t)
+	defer client.Close()
+	p := <-piperConns
+
+	data := bytes.Repeat([]byte("rekey"), 2048)
+	if got := echoThroughSession(client, data, t); !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes through the session, want %d", len(got), len(data))
+	}
+
+	mu.Lock()
+	if rekeys[FromDownstream] == 0 || rekeys[FromUpstream] != 0 {
+		t.Errorf("got %d downstream and %d upstream rekeys, want downstream rekeys only", rekeys[FromDownstream], rekeys[FromUpstream])
+	}
+	mu.Unlock()
+
+	if err := p.RequestRekey(FromUpstream); err != nil {
+		t.Fatalf("RequestRekey: %v", err)
+	}
+
+	select {
+	case algs := <-upstreamRekeyed:
+		if algs.Read.Cipher != "aes256-ctr" {
+			t.Errorf("got upstream cipher %q after the rekey, want aes256-ctr", algs.Read.Cipher)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("upstream was not rekeyed")
+	}
+}
+
+func TestPiperHostKeysCallback(t *testing.T) {
+	tenants := map[string]Signer{
+		"SSH-2.0-tenant-a": testSigners["ecdsa"],
+		"SSH-2.0-tenant-b": testSigners["ed25519"],
+	}
+
+	piper := &PiperConfig{
+		NoClientAuthCallback: noneAuthUpstream(simpleEchoHandler, t),
+		HostKeysCallback: func(conn ConnMetadata) ([]Signer, error) {
+			if conn.RemoteAddr() == nil {
+				t.Error("no remote address before the key exchange")
+			}
+			if key, ok := tenants[string(conn.ClientVersion())]; ok {
+				return []Signer{key}, nil
+			}
+			return nil, nil
+		},
+	}
+
+	for _, tt := range []struct {
+		version string
+		want    Signer
+	}{
+		{"SSH-2.0-tenant-a", testSigners["ecdsa"]},
+		{"SSH-2.0-tenant-b", testSigners["ed25519"]},
+		// the keys added with AddHostKey
+		{"SSH-2.0-other", testSigners["rsa"]},
+	} {
+		c, err := dialPiper(piper, nil, nil, t)
+		if err != nil {
+			t.Fatalf("dialPiper: %v", err)
+		}
+
+		var got PublicKey
+		conn, _, _, err := NewClientConn(c, "", &ClientConfig{
+			User:          "testuser",
+			ClientVersion: tt.version,
+			HostKeyCallback: func(hostname string, remote net.Addr, key PublicKey) error {
+				got = key
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: NewClientConn: %v", tt.version, err)
+		}
+		conn.Close()
+
+		if got == nil || !bytes.Equal(got.Marshal(), tt.want.PublicKey().Marshal()) {
+			t.Errorf("%s: got host key %v, want %s", tt.version, got, tt.want.PublicKey().Type())
+		}
+	}
+}
+
+func TestPiperAddHostCertificate(t *testing.T) {
+	ca := testSigners["ecdsa"]
+	cert := &Certificate{
+		Key:             testSigners["ed25519"].PublicKey(),
+		CertType:        HostCert,
+		ValidPrincipals: []string{"piper"},
+		ValidBefore:     CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	piper := &PiperConfig{
+		NoClientAuthCallback: noneAuthUpstream(simpleEchoHandler, t),
+	}
+	if err := piper.AddHostCertificate(&Certificate{CertType: UserCert}, testSigners["ed25519"]); err == nil {
+		t.Error("added a user certificate as host key")
+	}
+	if err := piper.AddHostCertificate(cert, testSigners["ed25519"]); err != nil {
+		t.Fatalf("AddHostCertificate: %v", err)
+	}
+
+	c, err := dialPiper(piper, nil, nil, t)
+	if err != nil {
+		t.Fatalf("dialPiper: %v", err)
+	}
+
+	checker := &CertChecker{
+		IsHostAuthority: func(auth PublicKey, address string) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	conn, _, _, err := NewClientConn(c, "piper:22", &ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: checker.CheckHostKey,
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn with the authority of the piper: %v", err)
+	}
+	conn.Close()
+}
+
+func TestPiperGSSAPIWithMIC(t *testing.T) {
+	var mu sync.Mutex
+	var srcNames []string
+
+	piper := &PiperConfig{
+		GSSAPIWithMICCallback: func(conn ConnMetadata, srcName string, challengeCtx ChallengeContext) (*Upstream, error) {
+			mu.Lock()
+			srcNames = append(srcNames, srcName)
+			mu.Unlock()
+
+			if srcName != conn.User()+"@DOMAIN" {
+				return nil, fmt.Errorf("srcName is %s, conn user is %s", srcName, conn.User())
+			}
+			return noneAuthUpstream(simpleEchoHandler, t)(conn, challengeCtx)
+		},
+		GSSAPIServer: func(conn ConnMetadata) GSSAPIServer {
+			return &FakeServer{
+				exchanges: []*exchange{
+					{
+						outToken:      "server-valid-token-1",
+						expectedToken: "client-valid-token-1",
+					},
+				},
+				maxRound:    1,
+				expectedMIC: []byte("valid-mic"),
+				srcName:     "testuser@DOMAIN",
+			}
+		},
+	}
+	piper.AddHostKey(testSigners["rsa"])
+
+	for _, tt := range []struct {
+		user string
+		mic  string
+		ok   bool
+	}{
+		{"testuser", "valid-mic", true},
+		{"testuser", "invalid-mic", false},
+		{"other", "valid-mic", false},
+	} {
+		c, s, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+
+		go func() {
+			defer s.Close()
+
+			// failed authentications are checked by the client
+			if p, err := NewSSHPiperConn(s, piper); err == nil {
+				p.Wait()
+			}
+		}()
+
+		conn, chans, reqs, err := NewClientConn(c, "", &ClientConfig{
+			User: tt.user,
+			Auth: []AuthMethod{
+				GSSAPIWithMICAuthMethod(&FakeClient{
+					exchanges: []*exchange{
+						{
+							outToken: "client-valid-token-1",
+						},
+						{
+							expectedToken: "server-valid-token-1",
+						},
+					},
+					mic:      []byte(tt.mic),
+					maxRound: 2,
+				}, "testtarget"),
+			},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		})
+		if !tt.ok {
+			if err == nil {
+				conn.Close()
+				t.Errorf("%s with %s: authenticated", tt.user, tt.mic)
+			}
+			c.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s with %s: NewClientConn: %v", tt.user, tt.mic, err)
+		}
+
+		client := NewClient(conn, chans, reqs)
+		if got := echoThroughSession(client, []byte("kerberos"), t); string(got) != "kerberos" {
+			t.Errorf("got %q through the session, want %q", got, "kerberos")
+		}
+		client.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// an invalid MIC never reaches the callback
+	if want := []string{"testuser@DOMAIN", "testuser@DOMAIN"}; !reflect.DeepEqual(srcNames, want) {
+		t.Errorf("got srcNames %q, want %q", srcNames, want)
+	}
+}
+
+func TestPiperHostbased(t *testing.T) {
+	piper := &PiperConfig{
+		HostbasedCallback: func(conn ConnMetadata, clientHost, clientUser string, key PublicKey, challengeCtx ChallengeContext) (*Upstream, error) {
+			if clientHost != "node1.example.com." || !bytes.Equal(key.Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+				return nil, fmt.Errorf("host key of %s not trusted", clientHost)
+			}
+
+			// the piper authenticates as a trusted host of the upstream
+			s, err := dialUpstream(simpleEchoHandler, &ServerConfig{
+				HostbasedCallback: func(conn ConnMetadata, clientHost, clientUser string, key PublicKey) (*Permissions, error) {
+					if clientHost != "piper.example.com." || clientUser != "sshpiper" ||
+						!bytes.Equal(key.Marshal(), testPublicKeys["rsa"].Marshal()) {
+						return nil, fmt.Errorf("host key of %s not trusted", clientHost)
+					}
+					return nil, nil
+				},
+			}, t)
+			return &Upstream{
+				Conn: s,
+				ClientConfig: ClientConfig{
+					User:            conn.User(),
+					Auth:            []AuthMethod{Hostbased(testSigners["rsa"], "piper.example.com.", "sshpiper")},
+					HostKeyCallback: InsecureIgnoreHostKey(),
+				},
+			}, err
+		},
+	}
+
+	c, err := dialPiper(piper, nil, nil, t)
+	if err != nil {
+		t.Fatalf("dialPiper: %v", err)
+	}
+
+	conn, chans, reqs, err := NewClientConn(c, "", &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{Hostbased(testSigners["ecdsa"], "node1.example.com.", "localuser")},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+	if got := echoThroughSession(client, []byte("hostbased"), t); string(got) != "hostbased" {
+		t.Errorf("got %q through the session, want %q", got, "hostbased")
+	}
+}